@@ -0,0 +1,182 @@
+/*
+ *  ar.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Definitions of the XOUT library (archive) format.
+ */
+
+package binlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const ArHdrLen = 26
+const ArFnameLen = 14
+const ArMagic = 0xff65
+
+type ArHdr struct {
+	Name [ArFnameLen]byte
+	Date uint32
+	UID  byte
+	GID  byte
+	Mode uint16
+	Size uint32
+}
+
+func ConvertArName(bname [ArFnameLen]byte) string {
+	var i int
+	for i = 0; i < ArFnameLen; i++ {
+		if bname[i] == 0 {
+			break
+		}
+	}
+	return string(bname[0:i])
+}
+
+// ArTime decodes the date of a member. The CP/M-8000 ar keeps the seconds
+// since 1970 in a Z8000 long, the high word first as the other fields, and
+// libraries made without a clock have 0, which is no date.
+func ArTime(date uint32) (time.Time, bool) {
+	if date == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(date), 0).UTC(), true
+}
+
+// ArReader reads members of a library in sequence.
+type ArReader struct {
+	r      io.Reader
+	remain int64 // bytes left in the current member
+	pad    int64 // a byte to make the member size even
+	left   int64 // bytes left in the library after the member, -1 if unknown
+}
+
+// NewArReader checks the magic and returns a reader at the first member.
+func NewArReader(r io.Reader) (*ArReader, error) {
+	head := make([]byte, 2, len(GnuArMagic))
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, errors.New("Not an XOUT library, too short")
+	}
+	if binary.BigEndian.Uint16(head) != ArMagic {
+		// more bytes to tell GNU ar archives
+		n, _ := io.ReadFull(r, head[2:cap(head)])
+		return nil, CheckKind(head[:2+n], KindXoutLib)
+	}
+	ar := &ArReader{r: r, left: -1}
+	if seeker, ok := r.(io.Seeker); ok {
+		cur, err1 := seeker.Seek(0, io.SeekCurrent)
+		end, err2 := seeker.Seek(0, io.SeekEnd)
+		_, err3 := seeker.Seek(cur, io.SeekStart)
+		if err1 == nil && err2 == nil && err3 == nil {
+			ar.left = end - cur
+		}
+	}
+	return ar, nil
+}
+
+// Next skips the rest of the current member and returns the header of the
+// next one, or io.EOF at the end of the library.
+func (ar *ArReader) Next() (*ArHdr, error) {
+	if _, err := io.CopyN(io.Discard, ar.r, ar.remain); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	// the last member may lack the pad
+	if _, err := io.CopyN(io.Discard, ar.r, ar.pad); err != nil {
+		return nil, io.EOF
+	}
+	ar.remain, ar.pad = 0, 0
+	var arhdr ArHdr
+	if err := binary.Read(ar.r, binary.BigEndian, &arhdr); err != nil {
+		return nil, io.EOF
+	}
+	if arhdr.Name[0] == 0 || arhdr.Size == 0 {
+		return nil, io.EOF
+	}
+	if ar.left >= 0 {
+		ar.left -= ArHdrLen
+		if int64(arhdr.Size) > ar.left {
+			return nil, fmt.Errorf("Member %s of %d bytes exceeds the library size, %d bytes left",
+				ConvertArName(arhdr.Name), arhdr.Size, ar.left)
+		}
+		ar.left -= int64(arhdr.Size) + int64(arhdr.Size%2)
+	}
+	ar.remain = int64(arhdr.Size)
+	ar.pad = ar.remain % 2
+	return &arhdr, nil
+}
+
+// Read reads the contents of the current member.
+func (ar *ArReader) Read(p []byte) (int, error) {
+	if ar.remain == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > ar.remain {
+		p = p[:ar.remain]
+	}
+	n, err := ar.r.Read(p)
+	ar.remain -= int64(n)
+	if err == io.EOF && ar.remain > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// ArWriter writes a library.
+type ArWriter struct {
+	w      io.Writer
+	remain int64
+	pad    int64
+}
+
+// NewArWriter writes the magic and returns a writer.
+func NewArWriter(w io.Writer) (*ArWriter, error) {
+	if err := binary.Write(w, binary.BigEndian, uint16(ArMagic)); err != nil {
+		return nil, err
+	}
+	return &ArWriter{w: w}, nil
+}
+
+// WriteHeader starts a member, Size bytes have to be written by Write.
+func (aw *ArWriter) WriteHeader(arhdr *ArHdr) error {
+	if err := aw.Flush(); err != nil {
+		return err
+	}
+	if err := binary.Write(aw.w, binary.BigEndian, arhdr); err != nil {
+		return err
+	}
+	aw.remain = int64(arhdr.Size)
+	aw.pad = aw.remain % 2
+	return nil
+}
+
+// Write writes the contents of the current member.
+func (aw *ArWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > aw.remain {
+		return 0, errors.New("member is longer than its header")
+	}
+	n, err := aw.w.Write(p)
+	aw.remain -= int64(n)
+	return n, err
+}
+
+// Flush finishes the current member.
+func (aw *ArWriter) Flush() error {
+	if aw.remain != 0 {
+		return errors.New("member is shorter than its header")
+	}
+	if aw.pad != 0 {
+		if _, err := aw.w.Write([]byte{0}); err != nil {
+			return err
+		}
+		aw.pad = 0
+	}
+	return nil
+}
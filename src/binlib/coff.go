@@ -1,39 +1,52 @@
 /*
- *  xout.go
+ *  coff.go
  *
  *  Copyright (c) 2020 4sun5bu
  *  Released under the MIT license.
  *  See LICENSE.
  *
- *  A packge to export COFF file.
+ *  A packge to export and import COFF file.
  */
 
 package binlib
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
-	"os"
+	"io"
 )
 
 const CoffHdrLen = 20
 const CoffSectHdrLen = 40
 const CoffRelocItemLen = 16
 const CoffSymbEntryLen = 18
+const CoffLineNumLen = 6
 
 const CoffNameLen = 8
 const CoffLongNameLen = 32
+const CoffFileNameLen = 14 /* source file names in the .file aux entry */
 
 type CoffFile struct {
-	Filep    *os.File
 	Header   CoffHdr
+	OptHdr   []byte
 	SectTbl  []CoffSectHdr
 	RelocTbl []CoffRelocItem
+	LineTbl  []CoffLineNum
 	SymbTbl  []interface{}
 	CodePart *[]byte
 }
 
+const CoffMagicZ8k = uint16(0x8000)
+
+/* Header flags */
+const CoffFlagRelFlg = uint16(0x0001) /* relocations stripped */
+const CoffFlagExec = uint16(0x0002)   /* executable, no unresolved symbols */
+const CoffFlagLnno = uint16(0x0004)   /* line numbers stripped */
+const CoffFlagAR32W = uint16(0x0200)  /* big endian words */
+const CoffFlagZ8001 = uint16(0x1000)  /* segmented */
+const CoffFlagZ8002 = uint16(0x2000)  /* non segmented */
+
 type CoffHdr struct {
 	Magic       uint16
 	NumSects    uint16
@@ -65,10 +78,43 @@ type CoffRelocItem struct {
 	Stuff   uint16
 }
 
+const CoffAoutHdrLen = 28
+
+/* Magics of the a.out optional header of executables */
+const CoffAoutImpure = uint16(0407) /* text and data in one writable space */
+const CoffAoutShared = uint16(0410) /* read-only shared text */
+const CoffAoutSplit = uint16(0411)  /* separate instruction and data spaces */
+
+type CoffAoutHdr struct {
+	Magic     uint16
+	Vstamp    uint16
+	TextSize  uint32
+	DataSize  uint32
+	BssSize   uint32
+	Entry     uint32
+	TextStart uint32
+	DataStart uint32
+}
+
+// Bytes returns the header to be set in CoffFile.OptHdr
+func (h *CoffAoutHdr) Bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, h)
+	return buf.Bytes()
+}
+
 const CoffSectTEXT = uint32(0x0020)
 const CoffSectDATA = uint32(0x0040)
 const CoffSectBSS = uint32(0x0080)
 
+// CoffLineNum is a line number entry. The first entry of a function has the
+// symbol index in Addr and 0 in Line, the others have addresses and the
+// line numbers counted from 1 at the line of the .bf symbol.
+type CoffLineNum struct {
+	Addr uint32
+	Line uint16
+}
+
 type CoffSymbEntry struct {
 	Name      [CoffNameLen]byte
 	Value     uint32
@@ -89,39 +135,162 @@ type CoffSymbAuxFile struct {
 	Name [18]byte
 }
 
+/* The aux entry of a function symbol */
+type CoffSymbAuxFunc struct {
+	TagIdx       uint32
+	Size         uint32
+	LineNumsFpos int32
+	EndIdx       uint32 /* index of the symbol after the function */
+	TvIdx        uint16
+}
+
+/* The aux entry of .bf and .ef, the first line and the number of lines */
+type CoffSymbAuxBlock struct {
+	TagIdx uint32
+	Line   uint16
+	Size   uint16
+	Dummy  [10]byte
+}
+
+type CoffSymbAuxRaw struct {
+	Data [18]byte
+}
+
 const CoffSymbClassAuto = byte(0x01)
 const CoffSymbClassGlobal = byte(0x02)
 const CoffSymbClassStatic = byte(0x03)
 const CoffSymbClassExternal = byte(0x05)
 const CoffSymbClassLabel = byte(0x06)
+const CoffSymbClassFunc = byte(0x65) /* .bf and .ef */
 const CoffSymbClassFile = byte(0x67)
 
+const CoffSymbTypeFunc = uint16(0x0020) /* function returning int */
+
 const CoffSymbSCNExt = int16(0)
 const CoffSymbSCNAbs = int16(-1)
 
-func (cf *CoffFile) Open(file *os.File) {
-	cf.Filep = file
+// Layout assigns the file positions of the sections, the relocation tables,
+// the line number tables and the symbol table. Relocation items and line
+// numbers have to be sorted by section.
+func (cf *CoffFile) Layout() error {
+	codeLen := 0
+	if cf.CodePart != nil {
+		codeLen = len(*cf.CodePart)
+	}
+	cf.Header.NumSects = uint16(len(cf.SectTbl))
+	cf.Header.NumSymbs = uint32(len(cf.SymbTbl))
+	cf.Header.OptHdrLen = uint16(len(cf.OptHdr))
+	fpos := CoffHdrLen + int(cf.Header.OptHdrLen) + len(cf.SectTbl)*CoffSectHdrLen
+	// Section contents, BSS has no contents in the file
+	sectLen := 0
+	for idx := range cf.SectTbl {
+		sect := &cf.SectTbl[idx]
+		if sect.Flags&CoffSectBSS != 0 {
+			sect.Fpos = 0
+			continue
+		}
+		sect.Fpos = int32(fpos + sectLen)
+		sectLen += int(sect.Length)
+	}
+	if sectLen != codeLen {
+		return errors.New("Coff sections do not match the code part")
+	}
+	fpos += codeLen
+	// Relocation tables follow in the section order
+	numRelocs := 0
+	for idx := range cf.SectTbl {
+		sect := &cf.SectTbl[idx]
+		if sect.NumRelocs == 0 {
+			sect.RelocTblFpos = 0
+			continue
+		}
+		sect.RelocTblFpos = int32(fpos + numRelocs*CoffRelocItemLen)
+		numRelocs += int(sect.NumRelocs)
+	}
+	if numRelocs != len(cf.RelocTbl) {
+		return errors.New("Coff sections do not match the reloc table")
+	}
+	fpos += numRelocs * CoffRelocItemLen
+	// Line number tables follow the relocation tables
+	numLines := 0
+	for idx := range cf.SectTbl {
+		sect := &cf.SectTbl[idx]
+		if sect.NumLines == 0 {
+			sect.LineNumsFpos = 0
+			continue
+		}
+		sect.LineNumsFpos = int32(fpos + numLines*CoffLineNumLen)
+		numLines += int(sect.NumLines)
+	}
+	if numLines != len(cf.LineTbl) {
+		return errors.New("Coff sections do not match the line number table")
+	}
+	fpos += numLines * CoffLineNumLen
+	cf.Header.SymbTblFpos = int32(fpos)
+	return nil
+}
+
+// WriteTo lays out the file and writes it to w.
+func (cf *CoffFile) WriteTo(w io.Writer) (int64, error) {
+	if err := cf.Layout(); err != nil {
+		return 0, err
+	}
+	cw := &countWriter{w: w}
+	if err := cf.writeHdr(cw); err != nil {
+		return cw.n, err
+	}
+	if _, err := cw.Write(cf.OptHdr); err != nil {
+		return cw.n, errors.New("Coff Optional header write error")
+	}
+	if err := cf.writeSectTbl(cw); err != nil {
+		return cw.n, err
+	}
+	if err := cf.writeCodePart(cw); err != nil {
+		return cw.n, err
+	}
+	if err := cf.writeRelocTbl(cw); err != nil {
+		return cw.n, err
+	}
+	if err := binary.Write(cw, binary.BigEndian, cf.LineTbl); err != nil {
+		return cw.n, errors.New("Coff Line number table write error")
+	}
+	if err := cf.writeSymbTbl(cw); err != nil {
+		return cw.n, err
+	}
+	return cw.n, nil
 }
 
-func (cf *CoffFile) WriteHdr() error {
-	err := binary.Write(cf.Filep, binary.BigEndian, cf.Header)
+// Bytes returns the file image.
+func (cf *CoffFile) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := cf.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (cf *CoffFile) writeHdr(w io.Writer) error {
+	err := binary.Write(w, binary.BigEndian, cf.Header)
 	if err != nil {
 		return errors.New("Coff Header write error")
 	}
 	return nil
 }
 
-func (cf *CoffFile) WriteCodePart() error {
-	err := binary.Write(cf.Filep, binary.BigEndian, *cf.CodePart)
+func (cf *CoffFile) writeCodePart(w io.Writer) error {
+	if cf.CodePart == nil {
+		return nil
+	}
+	_, err := w.Write(*cf.CodePart)
 	if err != nil {
 		return errors.New("Coff Code part write error")
 	}
 	return nil
 }
 
-func (cf *CoffFile) WriteSectTbl() error {
-	for idx := 0; idx < int(cf.Header.NumSects); idx++ {
-		err := binary.Write(cf.Filep, binary.BigEndian, cf.SectTbl[idx])
+func (cf *CoffFile) writeSectTbl(w io.Writer) error {
+	for _, sect := range cf.SectTbl {
+		err := binary.Write(w, binary.BigEndian, sect)
 		if err != nil {
 			return errors.New("Coff Section write error")
 		}
@@ -129,9 +298,9 @@ func (cf *CoffFile) WriteSectTbl() error {
 	return nil
 }
 
-func (cf *CoffFile) WriteRelocTbl() error {
+func (cf *CoffFile) writeRelocTbl(w io.Writer) error {
 	for _, reloc := range cf.RelocTbl {
-		err := binary.Write(cf.Filep, binary.BigEndian, reloc)
+		err := binary.Write(w, binary.BigEndian, reloc)
 		if err != nil {
 			return errors.New("Coff Reloc table write error")
 		}
@@ -139,17 +308,169 @@ func (cf *CoffFile) WriteRelocTbl() error {
 	return nil
 }
 
-func (cf *CoffFile) WriteSymbTbl() error {
+func (cf *CoffFile) writeSymbTbl(w io.Writer) error {
 	for _, symb := range cf.SymbTbl {
-		err := binary.Write(cf.Filep, binary.BigEndian, symb)
+		err := binary.Write(w, binary.BigEndian, symb)
 		if err != nil {
-			fmt.Println(err)
 			return errors.New("Coff Symbol table write error")
 		}
 	}
 	return nil
 }
 
+// Parse reads a COFF file image in memory. Contents of the sections are
+// gathered in the code part in the section order.
+func (cf *CoffFile) Parse(data []byte) error {
+	// other magics may be given to COFF files, only known kinds are refused
+	if kind := Identify(data); kind != KindCoff && kind != KindUnknown {
+		return CheckKind(data, KindCoff)
+	}
+	r := bytes.NewReader(data)
+	if err := binary.Read(r, binary.BigEndian, &cf.Header); err != nil {
+		return errors.New("Coff Header read error")
+	}
+	fpos := CoffHdrLen + int(cf.Header.OptHdrLen)
+	if fpos+int(cf.Header.NumSects)*CoffSectHdrLen > len(data) {
+		return errors.New("Coff Section table exceeds the file")
+	}
+	cf.OptHdr = append([]byte(nil), data[CoffHdrLen:fpos]...)
+	r.Seek(int64(fpos), io.SeekStart)
+	cf.SectTbl = make([]CoffSectHdr, cf.Header.NumSects)
+	if err := binary.Read(r, binary.BigEndian, cf.SectTbl); err != nil {
+		return errors.New("Coff Section table read error")
+	}
+
+	// Section contents and relocation tables, their total size is limited
+	// by the file so that sections pointing at one region allocate no more
+	codeLen, numRelocs := 0, 0
+	for _, sect := range cf.SectTbl {
+		if sect.Flags&CoffSectBSS == 0 {
+			if !inFile(data, int64(sect.Fpos), int64(sect.Length)) {
+				return errors.New("Coff Section exceeds the file")
+			}
+			codeLen += int(sect.Length)
+		}
+		if !inFile(data, int64(sect.RelocTblFpos), int64(sect.NumRelocs)*CoffRelocItemLen) {
+			return errors.New("Coff Reloc table exceeds the file")
+		}
+		numRelocs += int(sect.NumRelocs)
+	}
+	if codeLen+numRelocs*CoffRelocItemLen > len(data) {
+		return errors.New("Coff sections and relocations exceed the file")
+	}
+	code := make([]byte, 0, codeLen)
+	cf.RelocTbl = make([]CoffRelocItem, 0, numRelocs)
+	for _, sect := range cf.SectTbl {
+		if sect.Flags&CoffSectBSS == 0 {
+			code = append(code, data[sect.Fpos:int64(sect.Fpos)+int64(sect.Length)]...)
+		}
+		relocs := make([]CoffRelocItem, sect.NumRelocs)
+		r.Seek(int64(sect.RelocTblFpos), io.SeekStart)
+		if err := binary.Read(r, binary.BigEndian, relocs); err != nil {
+			return errors.New("Coff Reloc table read error")
+		}
+		cf.RelocTbl = append(cf.RelocTbl, relocs...)
+	}
+	cf.CodePart = &code
+	// Line number tables, limited in total as the sections
+	numLines := 0
+	for _, sect := range cf.SectTbl {
+		if !inFile(data, int64(sect.LineNumsFpos), int64(sect.NumLines)*CoffLineNumLen) {
+			return errors.New("Coff Line number table exceeds the file")
+		}
+		numLines += int(sect.NumLines)
+	}
+	if numLines*CoffLineNumLen > len(data) {
+		return errors.New("Coff line numbers exceed the file")
+	}
+	cf.LineTbl = nil
+	if numLines > 0 {
+		cf.LineTbl = make([]CoffLineNum, 0, numLines)
+	}
+	for _, sect := range cf.SectTbl {
+		lines := make([]CoffLineNum, sect.NumLines)
+		r.Seek(int64(sect.LineNumsFpos), io.SeekStart)
+		if err := binary.Read(r, binary.BigEndian, lines); err != nil {
+			return errors.New("Coff Line number table read error")
+		}
+		cf.LineTbl = append(cf.LineTbl, lines...)
+	}
+
+	// Symbol table, aux entries follow their symbol
+	if !inFile(data, int64(cf.Header.SymbTblFpos), int64(cf.Header.NumSymbs)*CoffSymbEntryLen) {
+		return errors.New("Coff Symbol table exceeds the file")
+	}
+	r.Seek(int64(cf.Header.SymbTblFpos), io.SeekStart)
+	cf.SymbTbl = make([]interface{}, 0, cf.Header.NumSymbs)
+	for idx := 0; idx < int(cf.Header.NumSymbs); idx++ {
+		var symb CoffSymbEntry
+		if err := binary.Read(r, binary.BigEndian, &symb); err != nil {
+			return errors.New("Coff Symbol table read error")
+		}
+		cf.SymbTbl = append(cf.SymbTbl, symb)
+		for aux := 0; aux < int(symb.NumAux) && idx+1 < int(cf.Header.NumSymbs); aux++ {
+			var entry interface{}
+			switch {
+			case symb.Type&0x30 == CoffSymbTypeFunc:
+				entry = &CoffSymbAuxFunc{}
+			case symb.StrgClass == CoffSymbClassFunc:
+				entry = &CoffSymbAuxBlock{}
+			case symb.StrgClass == CoffSymbClassFile:
+				entry = &CoffSymbAuxFile{}
+			case symb.StrgClass == CoffSymbClassStatic:
+				entry = &CoffSymbAuxSect{}
+			default:
+				entry = &CoffSymbAuxRaw{}
+			}
+			if err := binary.Read(r, binary.BigEndian, entry); err != nil {
+				return errors.New("Coff Symbol table read error")
+			}
+			switch aux := entry.(type) {
+			case *CoffSymbAuxFunc:
+				cf.SymbTbl = append(cf.SymbTbl, *aux)
+			case *CoffSymbAuxBlock:
+				cf.SymbTbl = append(cf.SymbTbl, *aux)
+			case *CoffSymbAuxFile:
+				cf.SymbTbl = append(cf.SymbTbl, *aux)
+			case *CoffSymbAuxSect:
+				cf.SymbTbl = append(cf.SymbTbl, *aux)
+			case *CoffSymbAuxRaw:
+				cf.SymbTbl = append(cf.SymbTbl, *aux)
+			}
+			idx++
+		}
+	}
+	return nil
+}
+
+// GlobalSymbs returns the values of the global symbols defined in the file.
+func (cf *CoffFile) GlobalSymbs() map[string]uint32 {
+	symbs := make(map[string]uint32)
+	for _, entry := range cf.SymbTbl {
+		symb, ok := entry.(CoffSymbEntry)
+		if !ok || symb.StrgClass != CoffSymbClassGlobal || symb.SectNo == CoffSymbSCNExt {
+			continue
+		}
+		symbs[ConvertName(symb.Name)] = symb.Value
+	}
+	return symbs
+}
+
+func inFile(data []byte, fpos, length int64) bool {
+	return fpos >= 0 && length >= 0 && fpos+length <= int64(len(data))
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
 /*
 func (cf *CoffFile) PrintHdr() {
 	fmt.Printf("Coff Header\n")
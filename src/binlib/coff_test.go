@@ -0,0 +1,26 @@
+package binlib_test
+
+import (
+	"testing"
+
+	"binlib"
+	"binlib/convert"
+	"binlib/xouttest"
+)
+
+func TestGlobalSymbs(t *testing.T) {
+	cf, err := convert.Convert(xouttest.Sample(binlib.XoutMagicNonSeg).XoutFile(), &convert.Options{BSS: convert.BSSCommon})
+	if err != nil {
+		t.Fatal(err)
+	}
+	symbs := cf.GlobalSymbs()
+	if value, ok := symbs["_glob"]; !ok || value != 0x10 {
+		t.Errorf("_glob = %x, %v", value, ok)
+	}
+	// undefined externals and commons are not defined
+	for _, name := range []string{"_ext", "_comm", "loc"} {
+		if _, ok := symbs[name]; ok {
+			t.Errorf("%s defined", name)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+/*
+ *  conv.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  A converter from XOUT to COFF
+ *  Converted files can be linked with GNU ld.
+ */
+
+package convert
+
+import (
+	"fmt"
+	"sort"
+
+	"binlib"
+)
+
+func (c *converter) assignBSS() {
+	xf := c.xf
+	// Look for the BSS Segment. If no BSS, create it.
+	var bss int
+	for bss = 0; bss < int(xf.Header.NumSegs); bss++ {
+		if xf.SegTbl[bss].Type == binlib.XoutSegBSS {
+			break
+		}
+	}
+	if bss == int(xf.Header.NumSegs) {
+		var bssSeg binlib.XoutSeg
+		bssSeg.Number = 0xff
+		bssSeg.Type = binlib.XoutSegBSS
+		bssSeg.Length = uint16(0)
+		xf.SegTbl = append(xf.SegTbl, bssSeg)
+		xf.Header.NumSegs++
+	}
+	if c.opts.BSS != BSSAlloc {
+		return
+	}
+	// Add memory space in the BSS segment.
+	for idx, symb := range xf.SymbTbl {
+		if symb.SegIdx == 0xff && symb.Type == binlib.XoutSymbUndefEX && symb.Value != 0 {
+			xf.SymbTbl[idx].Type = binlib.XoutSymbGlobal
+			xf.SymbTbl[idx].SegIdx = byte(bss)
+			size := symb.Value
+			xf.SymbTbl[idx].Value = xf.SegTbl[bss].Length // set address
+			xf.SegTbl[bss].Length += size
+		}
+	}
+}
+
+/* Position of a segment offset in the code part, BSS and stack are not stored */
+func calcAddr(xf *binlib.XoutFile, seg int, offset uint16) int {
+	pos := 0
+	for idx := 0; idx < seg; idx++ {
+		if binlib.XoutSegHasData(xf.SegTbl[idx].Type) {
+			pos += int(xf.SegTbl[idx].Length)
+		}
+	}
+	return pos + int(offset)
+}
+
+/* add symbols for each segment top address */
+func (c *converter) addSegTopSymb() {
+	xf := c.xf
+	c.segTopBase = len(xf.SymbTbl)
+	for idx := range xf.SegTbl {
+		name := fmt.Sprintf("SEG%d0000", idx)
+		var symb binlib.XoutSymbEntry
+		symb.SegIdx = byte(idx)
+		symb.Type = binlib.XoutSymbLocal
+		symb.Value = 0x0000
+		copy(symb.Name[:], []byte(name))
+		xf.SymbTbl = append(xf.SymbTbl, symb)
+		xf.NumSymbs++
+	}
+}
+
+func convSegName(segType byte) string {
+	var name string
+	switch segType {
+	case binlib.XoutSegCODE, binlib.XoutSegCDMIX, binlib.XoutSegCDMIX_P:
+		name = ".text"
+	case binlib.XoutSegDATA:
+		name = ".data"
+	case binlib.XoutSegCONST:
+		name = ".rdata"
+	case binlib.XoutSegBSS:
+		name = ".bss"
+	case binlib.XoutSegSTACK:
+		name = ".stack"
+	default:
+		name = ""
+	}
+	return name
+}
+
+/* Add segmemt Symbols int the table */
+func (c *converter) addSegSymb() {
+	xf := c.xf
+	for segIdx, seg := range xf.SegTbl {
+		var symbIdx int
+		var symb *binlib.XoutSymbEntry
+		for symbIdx = 0; symbIdx < len(xf.SymbTbl); symbIdx++ {
+			symb = &xf.SymbTbl[symbIdx]
+			if symb.Type != binlib.XoutSymbSeg {
+				continue
+			}
+			if int(symb.SegIdx) == segIdx {
+				name := convSegName(c.sectSegType(seg.Type))
+				symb.Name = [8]byte{}
+				copy(symb.Name[:], []byte(name))
+				break
+			}
+		}
+		if symbIdx == len(xf.SymbTbl) {
+			var segSymb binlib.XoutSymbEntry
+			segSymb.Type = binlib.XoutSymbSeg
+			segSymb.SegIdx = uint8(segIdx)
+			segSymb.Value = 0
+			name := convSegName(c.sectSegType(seg.Type))
+			copy(segSymb.Name[:], []byte(name))
+			xf.SymbTbl = append(xf.SymbTbl, segSymb)
+			xf.NumSymbs++
+		}
+	}
+}
+
+// convHdr has to be called after converting sections, relocations, line
+// numbers and symbols, the flags tell what the file has
+func (c *converter) convHdr() {
+	cf := c.cf
+	cf.Header.Magic = c.opts.Magic
+	if cf.Header.Magic == 0 {
+		cf.Header.Magic = binlib.CoffMagicZ8k
+	}
+	cf.Header.Date = c.opts.Date
+	cf.Header.OptHdrLen = 0
+	cf.Header.Flags = binlib.CoffFlagAR32W
+	if c.segmented() {
+		cf.Header.Flags |= binlib.CoffFlagZ8001
+	} else {
+		cf.Header.Flags |= binlib.CoffFlagZ8002
+	}
+	if len(cf.RelocTbl) == 0 {
+		cf.Header.Flags |= binlib.CoffFlagRelFlg
+	}
+	if len(cf.LineTbl) == 0 {
+		cf.Header.Flags |= binlib.CoffFlagLnno
+	}
+	if binlib.XoutExecutable(c.xf.Header.Magic) {
+		cf.Header.Flags |= binlib.CoffFlagExec
+		cf.OptHdr = c.aoutHdr().Bytes()
+	}
+}
+
+/*
+ * The a.out header of an executable, shared text and split I/D have the
+ * magics of the same memory models on Unix.
+ */
+func (c *converter) aoutHdr() *binlib.CoffAoutHdr {
+	magic := c.xf.Header.Magic
+	hdr := binlib.CoffAoutHdr{Magic: binlib.CoffAoutImpure}
+	switch {
+	case binlib.XoutSharedText(magic):
+		hdr.Magic = binlib.CoffAoutShared
+	case binlib.XoutSplitID(magic):
+		hdr.Magic = binlib.CoffAoutSplit
+	}
+	var text, data bool
+	for idx, sect := range c.cf.SectTbl {
+		switch sect.Flags {
+		case binlib.CoffSectTEXT:
+			if !text {
+				hdr.TextStart, hdr.Entry, text = c.bases[idx], c.bases[idx], true
+			}
+			hdr.TextSize += sect.Length
+		case binlib.CoffSectDATA:
+			if !data {
+				hdr.DataStart, data = c.bases[idx], true
+			}
+			hdr.DataSize += sect.Length
+		case binlib.CoffSectBSS:
+			hdr.BssSize += sect.Length
+		}
+	}
+	return &hdr
+}
+
+/*
+ * The segment type of the COFF section. Mixed code and data is in the data
+ * space of split I/D, and it can not be shared unless protectable.
+ */
+func (c *converter) sectSegType(segType byte) byte {
+	magic := c.xf.Header.Magic
+	switch segType {
+	case binlib.XoutSegCDMIX:
+		if binlib.XoutSplitID(magic) || binlib.XoutSharedText(magic) {
+			return binlib.XoutSegDATA
+		}
+	case binlib.XoutSegCDMIX_P:
+		if binlib.XoutSplitID(magic) {
+			return binlib.XoutSegDATA
+		}
+	}
+	return segType
+}
+
+func (c *converter) segmented() bool {
+	switch c.opts.CPU {
+	case CPUZ8001:
+		return true
+	case CPUZ8002:
+		return false
+	}
+	magic := c.xf.Header.Magic
+	return magic == binlib.XoutMagicSeg || magic == binlib.XoutMagicSegX
+}
+
+func convSegType(segType byte) uint32 {
+	switch segType {
+	case binlib.XoutSegBSS, binlib.XoutSegSTACK:
+		return binlib.CoffSectBSS
+	case binlib.XoutSegCODE, binlib.XoutSegCDMIX, binlib.XoutSegCDMIX_P:
+		return binlib.CoffSectTEXT
+	case binlib.XoutSegDATA, binlib.XoutSegCONST:
+		return binlib.CoffSectDATA
+	default:
+		return 0x00
+	}
+}
+
+// convSectHdrs converts xout segment table, the number of relocation items
+// is set by finalize() and file positions by CoffFile.Layout(). Sections of
+// executables are at their linked addresses, the data space ones start from
+// 0 again in split I/D.
+func (c *converter) convSectHdrs() {
+	xf, cf := c.xf, c.cf
+	for idx, seg := range xf.SegTbl {
+		var cfSect binlib.CoffSectHdr
+		segType := c.sectSegType(seg.Type)
+		name := convSegName(segType)
+		copy(cfSect.Name[:], []byte(name))
+		cfSect.Vaddr = c.bases[idx]
+		cfSect.Paddr = c.bases[idx]
+		cfSect.Length = uint32(seg.Length)
+		cfSect.LineNumsFpos = 0
+		cfSect.NumRelocs = 0 // Set by finalize()
+		cfSect.NumLines = 0
+		cfSect.Flags = convSegType(segType)
+		cf.SectTbl = append(cf.SectTbl, cfSect)
+	}
+}
+
+func (c *converter) convSymbIdx(xIdx uint16) uint32 {
+	if idx, ok := c.symbIdx[int(xIdx)]; ok {
+		return idx
+	}
+	return uint32(0xffffffff)
+}
+
+func (c *converter) convSegTopSymbIdx(xIdx uint16) uint32 {
+	if int(xIdx) < len(c.segTopIdx) {
+		return c.segTopIdx[xIdx]
+	}
+	return uint32(0xffffffff)
+}
+
+/* Append a converted symbol, and remember its index for relocations */
+func (c *converter) addSymb(xIdx int, cfSymb binlib.CoffSymbEntry) {
+	cf := c.cf
+	cfIdx := uint32(len(cf.SymbTbl))
+	if xIdx >= c.segTopBase {
+		c.segTopIdx[xIdx-c.segTopBase] = cfIdx
+	} else {
+		c.symbIdx[xIdx] = cfIdx
+	}
+	if f, ok := c.funcs[xIdx]; ok {
+		c.addFunc(f, cfSymb)
+		return
+	}
+	cf.SymbTbl = append(cf.SymbTbl, cfSymb)
+}
+
+func (c *converter) convRelocTbl() error {
+	xf, cf := c.xf, c.cf
+	relocType := map[byte]uint16{0: 0xffff, 1: 0x0001, 2: 0xffff, 3: 0x0011,
+		4: 0xffff, 5: 0x0001, 6: 0xffff, 7: 0x0011}
+	// sort by segment and location, COFF keeps a reloc table per section
+	sort.SliceStable(xf.RelocTbl, func(i, j int) bool {
+		ri, rj := xf.RelocTbl[i], xf.RelocTbl[j]
+		if ri.SegIdx != rj.SegIdx {
+			return ri.SegIdx < rj.SegIdx
+		}
+		return ri.Location < rj.Location
+	})
+	// export to the coff reloc table
+	for _, xReloc := range xf.RelocTbl {
+		var cfReloc binlib.CoffRelocItem
+		cfReloc.Vaddr = c.bases[xReloc.SegIdx] + uint32(xReloc.Location)
+		cfReloc.Type = relocType[xReloc.Type]
+		pos := calcAddr(xf, int(xReloc.SegIdx), xReloc.Location)
+		if relocLen(xReloc.Type) == 4 {
+			// the segment number is given by the symbol, the offset is in the second word
+			pos += 2
+		}
+		cfReloc.Offset = uint32(xf.CodePart[pos])*256 + uint32(xf.CodePart[pos+1])
+		cfReloc.Stuff = 0x5343
+		switch xReloc.Type {
+		case binlib.XoutRelocXOFF, binlib.XoutRelocXSSG, binlib.XoutRelocXLSG:
+			cfReloc.SymbIdx = c.convSymbIdx(xReloc.SymbIdx)
+		default:
+			cfReloc.SymbIdx = c.convSegTopSymbIdx(xReloc.SymbIdx)
+		}
+		if cfReloc.SymbIdx == 0xffffffff {
+			return fmt.Errorf("relocation at %d:%04x refers a symbol not converted",
+				xReloc.SegIdx, xReloc.Location)
+		}
+		cf.RelocTbl = append(cf.RelocTbl, cfReloc)
+	}
+	return nil
+}
+
+/* Local symbols dropped by the symbol policy */
+func (c *converter) dropLocal(idx int) bool {
+	return c.opts.Symbs == SymbGlobal && idx < c.numXoutSymbs && !c.keepSymb[idx]
+}
+
+func (c *converter) convSymbTbl() {
+	xf, cf := c.xf, c.cf
+	c.symbIdx = make(map[int]uint32, len(xf.SymbTbl))
+	c.segTopIdx = make([]uint32, len(xf.SegTbl))
+	for idx := range c.segTopIdx {
+		c.segTopIdx[idx] = 0xffffffff
+	}
+	// Add dummy
+	var dmySymb binlib.CoffSymbEntry
+	copy(dmySymb.Name[:], []byte(".file"))
+	dmySymb.Value = 0
+	dmySymb.SectNo = -2
+	dmySymb.Type = 0
+	dmySymb.StrgClass = binlib.CoffSymbClassFile
+	dmySymb.NumAux = 1
+	cf.SymbTbl = append(cf.SymbTbl, dmySymb)
+	var fdmySymb binlib.CoffSymbAuxFile
+	file := "fake"
+	if c.opts.File != "" {
+		file = c.opts.File
+	}
+	copy(fdmySymb.Name[:binlib.CoffFileNameLen], file)
+	cf.SymbTbl = append(cf.SymbTbl, fdmySymb)
+
+	// Convert local symbols
+	var cfSymb binlib.CoffSymbEntry
+	for idx, symb := range xf.SymbTbl {
+		if symb.SegIdx == 255 || symb.Type != binlib.XoutSymbLocal || c.dropLocal(idx) {
+			continue
+		}
+		cfSymb.Name = symb.Name
+		cfSymb.Value = c.bases[symb.SegIdx] + uint32(symb.Value)
+		cfSymb.SectNo = int16(symb.SegIdx + 1)
+		cfSymb.Type = 0x00
+		cfSymb.StrgClass = binlib.CoffSymbClassStatic
+		cfSymb.NumAux = 0
+		c.addSymb(idx, cfSymb)
+	}
+	// Convert Section symbols
+	for idx, symb := range xf.SymbTbl {
+		if symb.Type != binlib.XoutSymbSeg {
+			continue
+		}
+		cfSymb.Name = symb.Name
+		cfSymb.Value = c.bases[symb.SegIdx]
+		cfSymb.SectNo = int16(symb.SegIdx + 1)
+		cfSymb.Type = 0x00
+		cfSymb.StrgClass = binlib.CoffSymbClassStatic
+		cfSymb.NumAux = 1
+		c.addSymb(idx, cfSymb)
+
+		var sectAuxSymb binlib.CoffSymbAuxSect
+		sectAuxSymb.Length = uint32(xf.SegTbl[symb.SegIdx].Length)
+		sectAuxSymb.NumLines = 0
+		sectAuxSymb.NumRelocs = 0
+		for _, reloc := range xf.RelocTbl {
+			if reloc.SegIdx != symb.SegIdx {
+				continue
+			}
+			sectAuxSymb.NumRelocs++
+		}
+		cf.SymbTbl = append(cf.SymbTbl, sectAuxSymb)
+	}
+	// Convert global symbols
+	for seg := 0; seg < int(xf.Header.NumSegs); seg++ {
+		for idx, symb := range xf.SymbTbl {
+			if symb.SegIdx == byte(seg) && symb.Type == binlib.XoutSymbGlobal {
+				cfSymb.Name = symb.Name
+				cfSymb.Value = c.bases[symb.SegIdx] + uint32(symb.Value)
+				cfSymb.SectNo = int16(symb.SegIdx + 1)
+				cfSymb.Type = 0x00
+				cfSymb.StrgClass = binlib.CoffSymbClassGlobal
+				cfSymb.NumAux = 0
+				c.addSymb(idx, cfSymb)
+			}
+		}
+	}
+	// Convert external symbols and constats
+	for idx, symb := range xf.SymbTbl {
+		if symb.SegIdx != 255 {
+			continue
+		}
+		switch symb.Type {
+		case binlib.XoutSymbUndefEX:
+			cfSymb.Name = symb.Name
+			cfSymb.Value = 0
+			if c.opts.BSS == BSSCommon {
+				cfSymb.Value = uint32(symb.Value) // size of the common
+			}
+			cfSymb.SectNo = binlib.CoffSymbSCNExt
+			cfSymb.Type = 0x00
+			cfSymb.StrgClass = binlib.CoffSymbClassGlobal
+			cfSymb.NumAux = 0
+			c.addSymb(idx, cfSymb)
+		case binlib.XoutSymbGlobal:
+			cfSymb.Name = symb.Name
+			cfSymb.Value = uint32(symb.Value)
+			cfSymb.SectNo = binlib.CoffSymbSCNAbs
+			cfSymb.Type = 0x00
+			cfSymb.StrgClass = binlib.CoffSymbClassGlobal
+			cfSymb.NumAux = 0
+			c.addSymb(idx, cfSymb)
+		case binlib.XoutSymbLocal:
+			if c.dropLocal(idx) {
+				continue
+			}
+			cfSymb.Name = symb.Name
+			cfSymb.Value = uint32(symb.Value)
+			cfSymb.SectNo = binlib.CoffSymbSCNAbs
+			cfSymb.Type = 0x00
+			cfSymb.StrgClass = binlib.CoffSymbClassGlobal
+			cfSymb.NumAux = 0
+			c.addSymb(idx, cfSymb)
+		default:
+		}
+	}
+}
+
+func (c *converter) finalize() error {
+	xf, cf := c.xf, c.cf
+	// Set the number of reloc items in the section table
+	for sect := 0; sect < len(cf.SectTbl); sect++ {
+		count := 0
+		for _, reloc := range xf.RelocTbl {
+			if sect == int(reloc.SegIdx) {
+				count++
+			}
+		}
+		cf.SectTbl[sect].NumRelocs = uint16(count)
+	}
+	// and the number of lines in the section aux entries
+	for idx, symb := range xf.SymbTbl {
+		if symb.Type != binlib.XoutSymbSeg {
+			continue
+		}
+		cfIdx, ok := c.symbIdx[idx]
+		if !ok || int(symb.SegIdx) >= len(cf.SectTbl) {
+			continue
+		}
+		if aux, ok := cf.SymbTbl[cfIdx+1].(binlib.CoffSymbAuxSect); ok {
+			aux.NumLines = cf.SectTbl[symb.SegIdx].NumLines
+			cf.SymbTbl[cfIdx+1] = aux
+		}
+	}
+	if err := cf.Layout(); err != nil {
+		return err
+	}
+	return c.setLineNumsFpos()
+}
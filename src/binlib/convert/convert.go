@@ -0,0 +1,247 @@
+/*
+ *  convert.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  A package to convert XOUT to COFF in-process.
+ *  Converted files can be linked with GNU ld.
+ */
+
+package convert
+
+import (
+	"errors"
+	"fmt"
+
+	"binlib"
+)
+
+/* CPU variants */
+const CPUAuto = 0  /* Z8001 for segmented magics, otherwise Z8002 */
+const CPUZ8001 = 1 /* segmented */
+const CPUZ8002 = 2 /* non segmented */
+
+/* BSS handling of undefined externals with a size */
+const BSSAlloc = 0  /* allocate them in the module's own BSS */
+const BSSExtern = 1 /* leave them as plain undefined externals */
+const BSSCommon = 2 /* COFF common symbols, merged by the linker */
+
+/* Symbol policy */
+const SymbAll = 0    /* convert all symbols */
+const SymbGlobal = 1 /* drop local symbols not referenced by relocations */
+
+type Options struct {
+	CPU     int
+	BSS     int
+	Symbs   int
+	Machine uint16 /* ELF machine number, binlib.ElfMachineZ8000 if 0 */
+	File    string /* source file name of the .file symbol, "fake" if empty */
+	Lines   []Line /* source lines for the COFF line number tables */
+	Date    uint32 /* time stamp of the COFF header, 0 for reproducible outputs */
+	Magic   uint16 /* COFF magic number, binlib.CoffMagicZ8k if 0 */
+}
+
+// ParseOptions gives the options of the command line switches shared by the
+// converters, the CPU variant, the BSS handling and discarding local symbols.
+func ParseOptions(cpu, bss string, discard bool) (Options, error) {
+	var opts Options
+	switch cpu {
+	case "auto":
+		opts.CPU = CPUAuto
+	case "z8001":
+		opts.CPU = CPUZ8001
+	case "z8002":
+		opts.CPU = CPUZ8002
+	default:
+		return opts, fmt.Errorf("unknown CPU variant %s", cpu)
+	}
+	switch bss {
+	case "alloc":
+		opts.BSS = BSSAlloc
+	case "common":
+		opts.BSS = BSSCommon
+	case "extern":
+		opts.BSS = BSSExtern
+	default:
+		return opts, fmt.Errorf("unknown BSS handling %s", bss)
+	}
+	if discard {
+		opts.Symbs = SymbGlobal
+	}
+	return opts, nil
+}
+
+type converter struct {
+	opts Options
+	xf   *binlib.XoutFile
+	cf   *binlib.CoffFile
+
+	numXoutSymbs int          // number of symbols in the input
+	keepSymb     map[int]bool // local symbols referenced by relocations
+	segTopBase   int          // index of the first segment top symbol
+	bases        []uint32     // linked addresses of the segments
+
+	// indexes in the COFF symbol table, used by convRelocTbl
+	symbIdx   map[int]uint32 // by XOUT symbol index
+	segTopIdx []uint32       // segment top symbols by segment index
+
+	funcs map[int]*function // functions with lines by XOUT symbol index
+}
+
+// Convert converts an XOUT file to a COFF file. The input is not modified.
+// A nil opts selects the defaults.
+func Convert(xf *binlib.XoutFile, opts *Options) (*binlib.CoffFile, error) {
+	c, err := newConverter(xf, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.findFuncs(); err != nil {
+		return nil, err
+	}
+	c.cf = &binlib.CoffFile{}
+	c.addSegSymb()
+	c.addSegTopSymb()
+	// convert
+	c.convSectHdrs()
+	c.cf.CodePart = &c.xf.CodePart
+	c.convSymbTbl()
+	if err := c.convRelocTbl(); err != nil {
+		return nil, err
+	}
+	c.convLineTbl()
+	c.convHdr()
+	if err := c.finalize(); err != nil {
+		return nil, err
+	}
+	return c.cf, nil
+}
+
+/* Check the input and the options, and prepare a copy of the input */
+func newConverter(xf *binlib.XoutFile, opts *Options) (*converter, error) {
+	if xf == nil {
+		return nil, errors.New("no XOUT file")
+	}
+	c := &converter{}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if err := c.checkOpts(); err != nil {
+		return nil, err
+	}
+	if int(xf.Header.NumSegs) != len(xf.SegTbl) {
+		return nil, errors.New("segment table does not match the header")
+	}
+	if len(xf.SegTbl) >= 0xff {
+		return nil, errors.New("too many segments")
+	}
+	if len(xf.CodePart) != int(xf.Header.CodePartLen) {
+		return nil, errors.New("code part does not match the header")
+	}
+	c.xf = cloneXout(xf)
+	c.numXoutSymbs = len(c.xf.SymbTbl)
+	if err := c.checkSymbs(); err != nil {
+		return nil, err
+	}
+	if err := c.checkRelocs(); err != nil {
+		return nil, err
+	}
+	c.assignBSS()
+	c.bases = c.xf.LinkedBases()
+	return c, nil
+}
+
+func (c *converter) checkOpts() error {
+	switch c.opts.CPU {
+	case CPUAuto, CPUZ8001, CPUZ8002:
+	default:
+		return errors.New("unknown CPU variant")
+	}
+	switch c.opts.BSS {
+	case BSSAlloc, BSSExtern, BSSCommon:
+	default:
+		return errors.New("unknown BSS handling")
+	}
+	switch c.opts.Symbs {
+	case SymbAll, SymbGlobal:
+	default:
+		return errors.New("unknown symbol policy")
+	}
+	return nil
+}
+
+/* Check symbols are in existing segments, segment symbols can not be absolute */
+func (c *converter) checkSymbs() error {
+	xf := c.xf
+	for _, symb := range xf.SymbTbl {
+		if symb.SegIdx != 0xff && int(symb.SegIdx) >= len(xf.SegTbl) ||
+			symb.SegIdx == 0xff && symb.Type == binlib.XoutSymbSeg {
+			return fmt.Errorf("symbol %s in unknown segment", binlib.ConvertName(symb.Name))
+		}
+	}
+	return nil
+}
+
+/* Check relocation items refer existing segments, symbols and code */
+func (c *converter) checkRelocs() error {
+	xf := c.xf
+	c.keepSymb = make(map[int]bool)
+	for _, reloc := range xf.RelocTbl {
+		if int(reloc.SegIdx) >= len(xf.SegTbl) {
+			return errors.New("relocation in unknown segment")
+		}
+		if !binlib.XoutSegHasData(xf.SegTbl[reloc.SegIdx].Type) {
+			return errors.New("relocation in BSS or stack segment")
+		}
+		if int(reloc.Location)+relocLen(reloc.Type) > int(xf.SegTbl[reloc.SegIdx].Length) {
+			return errors.New("relocation out of segment")
+		}
+		switch reloc.Type {
+		case binlib.XoutRelocOFF, binlib.XoutRelocSSG, binlib.XoutRelocLSG:
+			if int(reloc.SymbIdx) >= len(xf.SegTbl) {
+				return errors.New("relocation refers unknown segment")
+			}
+		case binlib.XoutRelocXOFF, binlib.XoutRelocXSSG, binlib.XoutRelocXLSG:
+			if int(reloc.SymbIdx) >= len(xf.SymbTbl) {
+				return errors.New("relocation refers unknown symbol")
+			}
+			c.keepSymb[int(reloc.SymbIdx)] = true
+		default:
+			return errors.New("unknown relocation type")
+		}
+	}
+	if segLen(xf) > len(xf.CodePart) {
+		return errors.New("segments exceed the code part")
+	}
+	return nil
+}
+
+/* Length of the relocated field */
+func relocLen(relocType byte) int {
+	if relocType == binlib.XoutRelocLSG || relocType == binlib.XoutRelocXLSG {
+		return 4
+	}
+	return 2
+}
+
+/* Total length of the segments stored in the code part */
+func segLen(xf *binlib.XoutFile) int {
+	length := 0
+	for _, seg := range xf.SegTbl {
+		if binlib.XoutSegHasData(seg.Type) {
+			length += int(seg.Length)
+		}
+	}
+	return length
+}
+
+/* A copy of the tables and the code part, the output must not share them */
+func cloneXout(xf *binlib.XoutFile) *binlib.XoutFile {
+	nxf := *xf
+	nxf.CodePart = append([]byte(nil), xf.CodePart...)
+	nxf.SegTbl = append([]binlib.XoutSeg(nil), xf.SegTbl...)
+	nxf.RelocTbl = append([]binlib.XoutRelocItem(nil), xf.RelocTbl...)
+	nxf.SymbTbl = append([]binlib.XoutSymbEntry(nil), xf.SymbTbl...)
+	return &nxf
+}
@@ -0,0 +1,508 @@
+package convert
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"binlib"
+	"binlib/xouttest"
+)
+
+// largeXout makes a synthetic object with a code and a data segment, many
+// globals and externals, and relocations referring them.
+func largeXout(numSymbs, numRelocs int) *binlib.XoutFile {
+	const codeLen = 0xc000
+	const dataLen = 0x2000
+	xf := &binlib.XoutFile{}
+	xf.Header.Magic = binlib.XoutMagicNonSeg
+	xf.Header.NumSegs = 2
+	xf.SegTbl = []binlib.XoutSeg{
+		{Number: 0, Type: binlib.XoutSegCODE, Length: codeLen},
+		{Number: 1, Type: binlib.XoutSegDATA, Length: dataLen},
+	}
+	xf.CodePart = make([]byte, codeLen+dataLen)
+	xf.Header.CodePartLen = int32(len(xf.CodePart))
+	for idx := 0; idx < numSymbs; idx++ {
+		var symb binlib.XoutSymbEntry
+		if idx%2 == 0 {
+			symb.SegIdx = byte(idx / 2 % 2)
+			symb.Type = binlib.XoutSymbGlobal
+			symb.Value = uint16(idx)
+		} else {
+			symb.SegIdx = 0xff
+			symb.Type = binlib.XoutSymbUndefEX
+		}
+		copy(symb.Name[:], fmt.Sprintf("_s%d", idx))
+		xf.SymbTbl = append(xf.SymbTbl, symb)
+	}
+	for idx := 0; idx < numRelocs; idx++ {
+		var reloc binlib.XoutRelocItem
+		reloc.SegIdx = 0
+		reloc.Location = uint16(codeLen - 2 - idx*2%codeLen)
+		if idx%4 == 0 {
+			reloc.Type = binlib.XoutRelocOFF
+			reloc.SymbIdx = 1
+		} else {
+			reloc.Type = binlib.XoutRelocXOFF
+			reloc.SymbIdx = uint16(idx * 7 % numSymbs)
+		}
+		xf.RelocTbl = append(xf.RelocTbl, reloc)
+	}
+	xf.NumSymbs = len(xf.SymbTbl)
+	xf.NumRelocs = len(xf.RelocTbl)
+	xf.Header.SymbsLen = int32(xf.NumSymbs * binlib.XoutSymbEntryLen)
+	xf.Header.RelocsLen = int32(xf.NumRelocs * binlib.XoutRelocItemLen)
+	return xf
+}
+
+func BenchmarkConvert(b *testing.B) {
+	xf := largeXout(4000, 16000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Convert(xf, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+var codeData = []binlib.XoutSeg{
+	{Number: 0, Type: binlib.XoutSegCODE, Length: 16},
+	{Number: 1, Type: binlib.XoutSegDATA, Length: 8},
+}
+
+// relocSymb returns the COFF symbol a relocation item refers.
+func relocSymb(t *testing.T, cf *binlib.CoffFile, idx int) binlib.CoffSymbEntry {
+	t.Helper()
+	symbIdx := cf.RelocTbl[idx].SymbIdx
+	if int(symbIdx) >= len(cf.SymbTbl) {
+		t.Fatalf("reloc %d: symbol index %d out of table", idx, symbIdx)
+	}
+	symb, ok := cf.SymbTbl[symbIdx].(binlib.CoffSymbEntry)
+	if !ok {
+		t.Fatalf("reloc %d: symbol index %d is an aux entry", idx, symbIdx)
+	}
+	return symb
+}
+
+func TestDuplicateLocalNames(t *testing.T) {
+	obj := &xouttest.Object{
+		Magic: binlib.XoutMagicNonSeg,
+		Segs:  codeData,
+		Code:  make([]byte, 24),
+		Relocs: []binlib.XoutRelocItem{
+			{SegIdx: 0, Type: binlib.XoutRelocXOFF, Location: 0, SymbIdx: 1},
+			{SegIdx: 0, Type: binlib.XoutRelocXOFF, Location: 4, SymbIdx: 0},
+		},
+		Symbs: []binlib.XoutSymbEntry{
+			xouttest.Symb(0, binlib.XoutSymbLocal, 2, "lab"),
+			xouttest.Symb(1, binlib.XoutSymbLocal, 4, "lab"),
+		},
+	}
+	xf := obj.XoutFile()
+	cf, err := Convert(xf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := relocSymb(t, cf, 0); s.SectNo != 2 || s.Value != 4 {
+		t.Errorf("reloc 0 refers section %d value %d, want 2 4", s.SectNo, s.Value)
+	}
+	if s := relocSymb(t, cf, 1); s.SectNo != 1 || s.Value != 2 {
+		t.Errorf("reloc 1 refers section %d value %d, want 1 2", s.SectNo, s.Value)
+	}
+}
+
+func TestStaticAndExternSameName(t *testing.T) {
+	obj := &xouttest.Object{
+		Magic: binlib.XoutMagicNonSeg,
+		Segs:  codeData,
+		Code:  make([]byte, 24),
+		Relocs: []binlib.XoutRelocItem{
+			{SegIdx: 0, Type: binlib.XoutRelocXOFF, Location: 0, SymbIdx: 1},
+			{SegIdx: 0, Type: binlib.XoutRelocXOFF, Location: 2, SymbIdx: 0},
+		},
+		Symbs: []binlib.XoutSymbEntry{
+			xouttest.Symb(0, binlib.XoutSymbLocal, 6, "_x"),
+			xouttest.Symb(0xff, binlib.XoutSymbUndefEX, 0, "_x"),
+		},
+	}
+	xf := obj.XoutFile()
+	cf, err := Convert(xf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := relocSymb(t, cf, 0); s.SectNo != binlib.CoffSymbSCNExt || s.StrgClass != binlib.CoffSymbClassGlobal {
+		t.Errorf("reloc 0 refers section %d class %d, want an external", s.SectNo, s.StrgClass)
+	}
+	if s := relocSymb(t, cf, 1); s.SectNo != 1 || s.StrgClass != binlib.CoffSymbClassStatic {
+		t.Errorf("reloc 1 refers section %d class %d, want a static", s.SectNo, s.StrgClass)
+	}
+}
+
+func TestRelocOrder(t *testing.T) {
+	obj := &xouttest.Object{
+		Magic: binlib.XoutMagicNonSeg,
+		Segs:  codeData,
+		Code:  make([]byte, 24),
+		Relocs: []binlib.XoutRelocItem{
+			{SegIdx: 1, Type: binlib.XoutRelocOFF, Location: 2, SymbIdx: 0},
+			{SegIdx: 0, Type: binlib.XoutRelocOFF, Location: 6, SymbIdx: 1},
+			{SegIdx: 0, Type: binlib.XoutRelocOFF, Location: 0, SymbIdx: 1},
+			{SegIdx: 1, Type: binlib.XoutRelocOFF, Location: 0, SymbIdx: 0},
+		},
+	}
+	xf := obj.XoutFile()
+	cf, err := Convert(xf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint32{0, 6, 0, 2}
+	for idx, reloc := range cf.RelocTbl {
+		if reloc.Vaddr != want[idx] {
+			t.Errorf("reloc %d at %d, want %d", idx, reloc.Vaddr, want[idx])
+		}
+	}
+	if cf.SectTbl[0].NumRelocs != 2 || cf.SectTbl[1].NumRelocs != 2 {
+		t.Errorf("relocs per section %d %d, want 2 2",
+			cf.SectTbl[0].NumRelocs, cf.SectTbl[1].NumRelocs)
+	}
+	if cf.SectTbl[1].RelocTblFpos != cf.SectTbl[0].RelocTblFpos+2*binlib.CoffRelocItemLen {
+		t.Errorf("data reloc table at %d, text at %d",
+			cf.SectTbl[1].RelocTblFpos, cf.SectTbl[0].RelocTblFpos)
+	}
+	if s := relocSymb(t, cf, 0); s.SectNo != 2 || s.Value != 0 {
+		t.Errorf("text reloc refers section %d value %d, want the data top", s.SectNo, s.Value)
+	}
+	if s := relocSymb(t, cf, 2); s.SectNo != 1 || s.Value != 0 {
+		t.Errorf("data reloc refers section %d value %d, want the text top", s.SectNo, s.Value)
+	}
+}
+
+func TestLongSegReloc(t *testing.T) {
+	code := make([]byte, 24)
+	copy(code, []byte{0x81, 0x00, 0x00, 0x10})
+	obj := &xouttest.Object{
+		Magic: binlib.XoutMagicNonSeg,
+		Segs:  codeData,
+		Code:  code,
+		Relocs: []binlib.XoutRelocItem{
+			{SegIdx: 0, Type: binlib.XoutRelocLSG, Location: 0, SymbIdx: 1},
+		},
+	}
+	xf := obj.XoutFile()
+	cf, err := Convert(xf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.RelocTbl[0].Offset != 0x10 {
+		t.Errorf("offset %04x, want 0010", cf.RelocTbl[0].Offset)
+	}
+	if s := relocSymb(t, cf, 0); s.SectNo != 2 {
+		t.Errorf("reloc refers section %d, want 2", s.SectNo)
+	}
+}
+
+func TestInputNotModified(t *testing.T) {
+	relocs := []binlib.XoutRelocItem{
+		{SegIdx: 1, Type: binlib.XoutRelocOFF, Location: 2, SymbIdx: 0},
+		{SegIdx: 0, Type: binlib.XoutRelocOFF, Location: 0, SymbIdx: 1},
+	}
+	obj := &xouttest.Object{
+		Magic:  binlib.XoutMagicNonSeg,
+		Segs:   codeData,
+		Code:   make([]byte, 24),
+		Relocs: relocs,
+		Symbs:  []binlib.XoutSymbEntry{xouttest.Symb(0xff, binlib.XoutSymbUndefEX, 4, "_comm")},
+	}
+	xf := obj.XoutFile()
+	cf, err := Convert(xf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	(*cf.CodePart)[0] = 0xff
+	if xf.CodePart[0] != 0 {
+		t.Error("code part shared with the output")
+	}
+	if xf.RelocTbl[0].SegIdx != 1 || len(xf.SegTbl) != 2 || xf.SymbTbl[0].Type != binlib.XoutSymbUndefEX {
+		t.Error("input modified")
+	}
+}
+
+func TestBSSCommon(t *testing.T) {
+	symbs := []binlib.XoutSymbEntry{xouttest.Symb(0xff, binlib.XoutSymbUndefEX, 6, "_comm")}
+	obj := &xouttest.Object{
+		Magic: binlib.XoutMagicNonSeg,
+		Segs:  codeData,
+		Code:  make([]byte, 24),
+		Symbs: symbs,
+	}
+	xf := obj.XoutFile()
+
+	cf, err := Convert(xf, &Options{BSS: BSSCommon})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := cf.SymbTbl[len(cf.SymbTbl)-1].(binlib.CoffSymbEntry)
+	if binlib.ConvertName(s.Name) != "_comm" || s.SectNo != binlib.CoffSymbSCNExt ||
+		s.StrgClass != binlib.CoffSymbClassGlobal || s.Value != 6 {
+		t.Errorf("common %s section %d class %d value %d, want _comm 0 %d 6",
+			binlib.ConvertName(s.Name), s.SectNo, s.StrgClass, s.Value, binlib.CoffSymbClassGlobal)
+	}
+	if bss := cf.SectTbl[2]; binlib.ConvertName(bss.Name) != ".bss" || bss.Length != 0 {
+		t.Errorf("%s length %d, want an empty .bss", binlib.ConvertName(bss.Name), bss.Length)
+	}
+
+	// the default allocates it in the module's BSS
+	cf, err = Convert(xf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bss := cf.SectTbl[2]; bss.Length != 6 {
+		t.Errorf(".bss length %d, want 6", bss.Length)
+	}
+	for _, entry := range cf.SymbTbl {
+		if s, ok := entry.(binlib.CoffSymbEntry); ok && binlib.ConvertName(s.Name) == "_comm" {
+			if s.SectNo != 3 || s.Value != 0 {
+				t.Errorf("_comm in section %d at %d, want 3 0", s.SectNo, s.Value)
+			}
+		}
+	}
+}
+
+func TestMemoryModels(t *testing.T) {
+	segs := []binlib.XoutSeg{
+		{Number: 0, Type: binlib.XoutSegCODE, Length: 16},
+		{Number: 1, Type: binlib.XoutSegCDMIX, Length: 6},
+		{Number: 2, Type: binlib.XoutSegDATA, Length: 8},
+		{Number: 3, Type: binlib.XoutSegBSS, Length: 4},
+	}
+	tests := []struct {
+		magic    uint16
+		aout     []byte
+		mixName  string
+		dataAddr uint32
+	}{
+		{binlib.XoutMagicNonSeg, nil, ".text", 0},
+		{0xee06, nil, ".data", 0},
+		{binlib.XoutMagicNonSegX, []byte{0x01, 0x07, 0, 0, 0, 0, 0, 22, 0, 0, 0, 8, 0, 0, 0, 4,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 22}, ".text", 22},
+		{binlib.XoutMagicNonSegXShared, []byte{0x01, 0x08, 0, 0, 0, 0, 0, 16, 0, 0, 0, 14, 0, 0, 0, 4,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 16}, ".data", 22},
+		{binlib.XoutMagicNonSegXSplit, []byte{0x01, 0x09, 0, 0, 0, 0, 0, 16, 0, 0, 0, 14, 0, 0, 0, 4,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, ".data", 6},
+	}
+	for _, test := range tests {
+		obj := &xouttest.Object{
+			Magic: test.magic,
+			Segs:  segs,
+			Code:  make([]byte, 30),
+			Symbs: []binlib.XoutSymbEntry{xouttest.Symb(2, binlib.XoutSymbGlobal, 2, "_d")},
+		}
+		xf := obj.XoutFile()
+		cf, err := Convert(xf, nil)
+		if err != nil {
+			t.Fatalf("0x%04x: %v", test.magic, err)
+		}
+		if string(cf.OptHdr) != string(test.aout) || int(cf.Header.OptHdrLen) != len(test.aout) {
+			t.Errorf("0x%04x: a.out header % x", test.magic, cf.OptHdr)
+		}
+		if name := binlib.ConvertName(cf.SectTbl[1].Name); name != test.mixName {
+			t.Errorf("0x%04x: mixed segment in %s", test.magic, name)
+		}
+		if addr := cf.SectTbl[2].Vaddr; addr != test.dataAddr {
+			t.Errorf("0x%04x: data at 0x%04x", test.magic, addr)
+		}
+		for _, entry := range cf.SymbTbl {
+			if symb, ok := entry.(binlib.CoffSymbEntry); ok && binlib.ConvertName(symb.Name) == "_d" &&
+				symb.Value != test.dataAddr+2 {
+				t.Errorf("0x%04x: _d at 0x%04x", test.magic, symb.Value)
+			}
+		}
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	file, lines, err := ReadLines(strings.NewReader("# map\nfile prog.c\n\n0:0004 10\n0:0x0a 12 # comment\n"))
+	if err != nil || file != "prog.c" || len(lines) != 2 ||
+		lines[0] != (Line{0, 4, 10}) || lines[1] != (Line{0, 0x0a, 12}) {
+		t.Errorf("%q %+v %v", file, lines, err)
+	}
+	for _, bad := range []string{"0:0004", "0004 10", "x:0004 10", "0:0004 0", "0:zz 1"} {
+		if _, _, err := ReadLines(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+func TestLineNumbers(t *testing.T) {
+	segs := []binlib.XoutSeg{
+		{Number: 0, Type: binlib.XoutSegDATA, Length: 4},
+		{Number: 1, Type: binlib.XoutSegCODE, Length: 16},
+	}
+	symbs := []binlib.XoutSymbEntry{
+		xouttest.Symb(1, binlib.XoutSymbLocal, 0, "_main"),
+		xouttest.Symb(1, binlib.XoutSymbGlobal, 0, "_main"),
+		xouttest.Symb(1, binlib.XoutSymbLocal, 8, "_sub"),
+	}
+	obj := &xouttest.Object{Magic: binlib.XoutMagicNonSeg, Segs: segs, Code: make([]byte, 20), Symbs: symbs}
+	opts := &Options{File: "a_long_source_name.c", Symbs: SymbGlobal, Lines: []Line{
+		{1, 0, 3}, {1, 4, 5}, {1, 2, 4}, {1, 8, 10}, {1, 12, 12},
+	}}
+	cf, err := Convert(obj.XoutFile(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := cf.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf = &binlib.CoffFile{}
+	if err := cf.Parse(data); err != nil {
+		t.Fatal(err)
+	}
+	if aux := cf.SymbTbl[1].(binlib.CoffSymbAuxFile); string(aux.Name[:15]) != "a_long_source_\x00" {
+		t.Errorf(".file %q", aux.Name)
+	}
+	if cf.SectTbl[0].NumLines != 0 || cf.SectTbl[1].NumLines != 7 {
+		t.Errorf("lines %d %d", cf.SectTbl[0].NumLines, cf.SectTbl[1].NumLines)
+	}
+	var funcs []int
+	for idx, entry := range cf.SymbTbl {
+		if symb, ok := entry.(binlib.CoffSymbEntry); ok && symb.Type == binlib.CoffSymbTypeFunc {
+			funcs = append(funcs, idx)
+		}
+	}
+	// the global _main is preferred to the local one, and _sub is kept
+	if len(funcs) != 2 {
+		t.Fatalf("functions %v", funcs)
+	}
+	line := func(addr uint32, line uint16) binlib.CoffLineNum {
+		return binlib.CoffLineNum{Addr: addr, Line: line}
+	}
+	want := []binlib.CoffLineNum{
+		line(uint32(funcs[1]), 0), line(0, 1), line(2, 2), line(4, 3),
+		line(uint32(funcs[0]), 0), line(8, 1), line(12, 3),
+	}
+	// _sub is a local symbol and comes first in the symbol table
+	if binlib.ConvertName(cf.SymbTbl[funcs[0]].(binlib.CoffSymbEntry).Name) != "_sub" {
+		t.Fatalf("first function %+v", cf.SymbTbl[funcs[0]])
+	}
+	if len(cf.LineTbl) != len(want) {
+		t.Fatalf("line table %+v", cf.LineTbl)
+	}
+	for idx := range want {
+		if cf.LineTbl[idx] != want[idx] {
+			t.Errorf("line %d: %+v, want %+v", idx, cf.LineTbl[idx], want[idx])
+		}
+	}
+	tests := []struct {
+		idx      int
+		size     uint32
+		line     int
+		first    uint16
+		numLines uint16
+		end      uint32
+	}{
+		{funcs[1], 8, 0, 3, 3, 8},
+		{funcs[0], 8, 4, 10, 3, 16},
+	}
+	for _, tt := range tests {
+		aux := cf.SymbTbl[tt.idx+1].(binlib.CoffSymbAuxFunc)
+		if aux.Size != tt.size || aux.EndIdx != uint32(tt.idx+6) ||
+			aux.LineNumsFpos != cf.SectTbl[1].LineNumsFpos+int32(tt.line*binlib.CoffLineNumLen) {
+			t.Errorf("%d: aux %+v", tt.idx, aux)
+		}
+		bf := cf.SymbTbl[tt.idx+2].(binlib.CoffSymbEntry)
+		ef := cf.SymbTbl[tt.idx+4].(binlib.CoffSymbEntry)
+		if binlib.ConvertName(bf.Name) != ".bf" || binlib.ConvertName(ef.Name) != ".ef" ||
+			bf.StrgClass != binlib.CoffSymbClassFunc || ef.Value != tt.end ||
+			cf.SymbTbl[tt.idx+3].(binlib.CoffSymbAuxBlock).Line != tt.first ||
+			cf.SymbTbl[tt.idx+5].(binlib.CoffSymbAuxBlock).Line != tt.numLines {
+			t.Errorf("%d: .bf %+v .ef %+v", tt.idx, bf, ef)
+		}
+	}
+
+	opts.Lines = []Line{{0, 0, 1}}
+	if _, err := Convert(obj.XoutFile(), opts); err == nil {
+		t.Error("line in data: no error")
+	}
+}
+
+func TestHeader(t *testing.T) {
+	symbs := []binlib.XoutSymbEntry{xouttest.Symb(0, binlib.XoutSymbGlobal, 0, "_main")}
+	relocs := []binlib.XoutRelocItem{{SegIdx: 0, Type: binlib.XoutRelocOFF, Location: 2, SymbIdx: 1}}
+	tests := []struct {
+		magic  uint16
+		relocs []binlib.XoutRelocItem
+		opts   Options
+		flags  uint16
+	}{
+		{binlib.XoutMagicNonSeg, relocs, Options{}, 0x2204},
+		{binlib.XoutMagicNonSeg, nil, Options{}, 0x2205},
+		{binlib.XoutMagicSeg, relocs, Options{}, 0x1204},
+		{binlib.XoutMagicSeg, relocs, Options{CPU: CPUZ8002}, 0x2204},
+		{binlib.XoutMagicNonSegX, nil, Options{}, 0x2207},
+		{binlib.XoutMagicNonSeg, relocs, Options{Lines: []Line{{0, 0, 1}}}, 0x2200},
+		{binlib.XoutMagicNonSeg, nil, Options{Date: 0x5e0be100, Magic: 0x1234}, 0x2205},
+	}
+	for idx, test := range tests {
+		obj := &xouttest.Object{
+			Magic:  test.magic,
+			Segs:   codeData,
+			Code:   make([]byte, 24),
+			Relocs: test.relocs,
+			Symbs:  symbs,
+		}
+		xf := obj.XoutFile()
+		cf, err := Convert(xf, &test.opts)
+		if err != nil {
+			t.Fatalf("%d: %v", idx, err)
+		}
+		magic := test.opts.Magic
+		if magic == 0 {
+			magic = binlib.CoffMagicZ8k
+		}
+		if cf.Header.Flags != test.flags || cf.Header.Magic != magic || cf.Header.Date != test.opts.Date {
+			t.Errorf("%d: flags %04x magic %04x date %x", idx, cf.Header.Flags, cf.Header.Magic, cf.Header.Date)
+		}
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	opts, err := ParseOptions("z8001", "common", true)
+	if err != nil || opts.CPU != CPUZ8001 || opts.BSS != BSSCommon || opts.Symbs != SymbGlobal {
+		t.Errorf("options %+v: %v", opts, err)
+	}
+	opts, err = ParseOptions("auto", "alloc", false)
+	if err != nil || opts.CPU != CPUAuto || opts.BSS != BSSAlloc || opts.Symbs != SymbAll {
+		t.Errorf("default options %+v: %v", opts, err)
+	}
+	if _, err = ParseOptions("z8000", "alloc", false); err == nil {
+		t.Error("no error for an unknown CPU variant")
+	}
+	if _, err = ParseOptions("auto", "heap", false); err == nil {
+		t.Error("no error for an unknown BSS handling")
+	}
+}
+
+func TestSymbolSegments(t *testing.T) {
+	for _, bad := range []binlib.XoutSymbEntry{
+		xouttest.Symb(7, binlib.XoutSymbLocal, 2, "lab"),
+		xouttest.Symb(7, binlib.XoutSymbSeg, 0, "seg"),
+		xouttest.Symb(0xff, binlib.XoutSymbSeg, 0, "seg"),
+	} {
+		obj := &xouttest.Object{
+			Magic: binlib.XoutMagicNonSeg,
+			Segs:  codeData,
+			Code:  make([]byte, 24),
+			Symbs: []binlib.XoutSymbEntry{bad},
+		}
+		xf := obj.XoutFile()
+		if _, err := Convert(xf, nil); err == nil {
+			t.Errorf("no error for %s in segment %d", binlib.ConvertName(bad.Name), bad.SegIdx)
+		}
+		if _, err := ConvertELF(xf, nil); err == nil {
+			t.Errorf("ELF: no error for %s in segment %d", binlib.ConvertName(bad.Name), bad.SegIdx)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+/*
+ *  elf.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  A converter from XOUT to ELF
+ *  Each segment becomes a section, and the relocations become RELA items
+ *  whose addends are the offsets from the referred symbols. The relocated
+ *  fields keep their contents.
+ */
+
+package convert
+
+import (
+	"errors"
+
+	"binlib"
+)
+
+// ConvertELF converts an XOUT file to an ELF file. The input is not
+// modified. A nil opts selects the defaults.
+func ConvertELF(xf *binlib.XoutFile, opts *Options) (*binlib.ElfFile, error) {
+	c, err := newConverter(xf, opts)
+	if err != nil {
+		return nil, err
+	}
+	ef := &binlib.ElfFile{Type: binlib.ElfTypeRel, Machine: c.opts.Machine}
+	if ef.Machine == 0 {
+		ef.Machine = binlib.ElfMachineZ8000
+	}
+	if c.segmented() {
+		ef.Flags = binlib.ElfFlagSegmented
+	}
+	executable := binlib.XoutExecutable(c.xf.Header.Magic)
+	if executable {
+		ef.Type = binlib.ElfTypeExec
+	}
+	entry := -1
+	for idx, seg := range c.xf.SegTbl {
+		sect := c.elfSect(idx, seg)
+		if sect.Flags&binlib.ElfSectExec != 0 && entry < 0 {
+			entry = idx
+		}
+		ef.SectTbl = append(ef.SectTbl, sect)
+	}
+	if executable && entry >= 0 {
+		ef.Entry = c.bases[entry]
+	}
+	symbIdx := c.elfSymbTbl(ef)
+	if err := c.elfRelocTbl(ef, symbIdx); err != nil {
+		return nil, err
+	}
+	return ef, nil
+}
+
+func elfSectName(segType byte) string {
+	if segType == binlib.XoutSegCONST {
+		return ".rodata"
+	}
+	return convSegName(segType)
+}
+
+func (c *converter) elfSect(idx int, seg binlib.XoutSeg) binlib.ElfSect {
+	segType := c.sectSegType(seg.Type)
+	sect := binlib.ElfSect{Name: elfSectName(segType), Type: binlib.ElfSectProgbits,
+		Addr: c.bases[idx], Align: 2}
+	switch segType {
+	case binlib.XoutSegCODE, binlib.XoutSegCDMIX_P:
+		sect.Flags = binlib.ElfSectAlloc | binlib.ElfSectExec
+	case binlib.XoutSegCDMIX:
+		sect.Flags = binlib.ElfSectAlloc | binlib.ElfSectExec | binlib.ElfSectWrite
+	case binlib.XoutSegCONST:
+		sect.Flags = binlib.ElfSectAlloc
+	default:
+		sect.Flags = binlib.ElfSectAlloc | binlib.ElfSectWrite
+	}
+	if !binlib.XoutSegHasData(seg.Type) {
+		sect.Type = binlib.ElfSectNobits
+		sect.Size = uint32(seg.Length)
+		return sect
+	}
+	pos := calcAddr(c.xf, idx, 0)
+	sect.Data = append([]byte{}, c.xf.CodePart[pos:pos+int(seg.Length)]...)
+	return sect
+}
+
+/*
+ * Section symbols, local symbols and then global symbols. It returns the
+ * ELF symbol indexes by the XOUT symbol indexes, and the segments are at
+ * -1 - segment index.
+ */
+func (c *converter) elfSymbTbl(ef *binlib.ElfFile) map[int]uint32 {
+	xf := c.xf
+	symbIdx := make(map[int]uint32)
+	add := func(xIdx int, symb binlib.ElfSymb) {
+		ef.SymbTbl = append(ef.SymbTbl, symb)
+		symbIdx[xIdx] = uint32(len(ef.SymbTbl))
+	}
+	for idx := range xf.SegTbl {
+		add(-1-idx, binlib.ElfSymb{Value: c.bases[idx], Bind: binlib.ElfSymbLocal,
+			Type: binlib.ElfSymbSection, SectNo: uint16(idx + 1)})
+	}
+	for idx, symb := range xf.SymbTbl {
+		if symb.Type == binlib.XoutSymbLocal && !c.dropLocal(idx) {
+			add(idx, c.elfSymb(symb, ef, binlib.ElfSymbLocal))
+		}
+	}
+	for idx, symb := range xf.SymbTbl {
+		switch symb.Type {
+		case binlib.XoutSymbGlobal:
+			add(idx, c.elfSymb(symb, ef, binlib.ElfSymbGlobal))
+		case binlib.XoutSymbUndefEX:
+			elfSymb := binlib.ElfSymb{Name: binlib.ConvertName(symb.Name), Bind: binlib.ElfSymbGlobal,
+				SectNo: binlib.ElfSHNUndef}
+			if c.opts.BSS == BSSCommon && symb.Value != 0 {
+				elfSymb.Type = binlib.ElfSymbObject
+				elfSymb.SectNo = binlib.ElfSHNCommon
+				elfSymb.Value, elfSymb.Size = 2, uint32(symb.Value) // alignment and size
+			}
+			add(idx, elfSymb)
+		}
+	}
+	return symbIdx
+}
+
+/* A defined symbol, functions in code and objects in data */
+func (c *converter) elfSymb(symb binlib.XoutSymbEntry, ef *binlib.ElfFile, bind byte) binlib.ElfSymb {
+	elfSymb := binlib.ElfSymb{Name: binlib.ConvertName(symb.Name), Value: uint32(symb.Value),
+		Bind: bind, Vis: binlib.ElfSymbVisDefault, SectNo: binlib.ElfSHNAbs}
+	if int(symb.SegIdx) >= len(c.xf.SegTbl) {
+		return elfSymb
+	}
+	elfSymb.Value += c.bases[symb.SegIdx]
+	elfSymb.SectNo = uint16(symb.SegIdx) + 1
+	if bind == binlib.ElfSymbGlobal {
+		elfSymb.Type = binlib.ElfSymbObject
+		if ef.SectTbl[symb.SegIdx].Flags&binlib.ElfSectExec != 0 {
+			elfSymb.Type = binlib.ElfSymbFunc
+		}
+	}
+	return elfSymb
+}
+
+func (c *converter) elfRelocTbl(ef *binlib.ElfFile, symbIdx map[int]uint32) error {
+	xf := c.xf
+	executable := binlib.XoutExecutable(xf.Header.Magic)
+	for _, xReloc := range xf.RelocTbl {
+		item := binlib.ElfRelaItem{Offset: c.bases[xReloc.SegIdx] + uint32(xReloc.Location)}
+		pos := calcAddr(xf, int(xReloc.SegIdx), xReloc.Location)
+		field := uint32(xf.CodePart[pos])<<8 | uint32(xf.CodePart[pos+1])
+		switch xReloc.Type {
+		case binlib.XoutRelocOFF, binlib.XoutRelocXOFF:
+			item.Type = binlib.ElfRelocZ8k16
+		case binlib.XoutRelocSSG, binlib.XoutRelocXSSG:
+			item.Type = binlib.ElfRelocZ8kShortSeg
+			field &= 0xff
+		case binlib.XoutRelocLSG, binlib.XoutRelocXLSG:
+			item.Type = binlib.ElfRelocZ8kLongSeg
+			field = uint32(xf.CodePart[pos+2])<<8 | uint32(xf.CodePart[pos+3])
+		}
+		var target uint32
+		var ok bool
+		switch xReloc.Type {
+		case binlib.XoutRelocOFF, binlib.XoutRelocSSG, binlib.XoutRelocLSG:
+			item.SymbIdx, ok = symbIdx[-1-int(xReloc.SymbIdx)]
+			target = c.bases[xReloc.SymbIdx]
+		default:
+			item.SymbIdx, ok = symbIdx[int(xReloc.SymbIdx)]
+			if ok {
+				target = ef.SymbTbl[item.SymbIdx-1].Value
+			}
+		}
+		if !ok {
+			return errors.New("relocation refers a symbol not converted")
+		}
+		// executables hold the linked addresses, relocatable files the offsets
+		if executable {
+			if item.Type == binlib.ElfRelocZ8kShortSeg {
+				field = (field - target) & 0xff
+			} else {
+				field = (field - target) & 0xffff
+			}
+		}
+		item.Addend = int32(field)
+		if xReloc.Type >= binlib.XoutRelocXOFF && item.Type != binlib.ElfRelocZ8kShortSeg {
+			item.Addend = int32(int16(field))
+		}
+		sect := &ef.SectTbl[xReloc.SegIdx]
+		sect.RelocTbl = append(sect.RelocTbl, item)
+	}
+	return nil
+}
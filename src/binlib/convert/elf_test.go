@@ -0,0 +1,173 @@
+package convert
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"testing"
+
+	"binlib"
+	"binlib/xouttest"
+)
+
+/* The file and the e_flags, which debug/elf does not read */
+func readELF(t *testing.T, xf *binlib.XoutFile, opts *Options) (*elf.File, uint32) {
+	t.Helper()
+	ef, err := ConvertELF(xf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ef.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, binary.BigEndian.Uint32(data[36:])
+}
+
+type rela struct {
+	off   uint32
+	symb  string
+	typ   byte
+	addnd int32
+}
+
+func relocs(t *testing.T, f *elf.File, name string) []rela {
+	t.Helper()
+	sect := f.Section(name)
+	if sect == nil {
+		t.Fatalf("no %s", name)
+	}
+	data, _ := sect.Data()
+	symbs, _ := f.Symbols()
+	var items []rela
+	for pos := 0; pos+12 <= len(data); pos += 12 {
+		info := binary.BigEndian.Uint32(data[pos+4:])
+		symb := symbs[info>>8-1]
+		if elf.ST_TYPE(symb.Info) == elf.STT_SECTION {
+			symb.Name = f.Sections[symb.Section].Name
+		}
+		items = append(items, rela{binary.BigEndian.Uint32(data[pos:]), symb.Name, byte(info),
+			int32(binary.BigEndian.Uint32(data[pos+8:]))})
+	}
+	return items
+}
+
+func TestELFRelocatable(t *testing.T) {
+	f, flags := readELF(t, xouttest.Sample(binlib.XoutMagicNonSeg).XoutFile(), &Options{BSS: BSSCommon})
+	if f.Class != elf.ELFCLASS32 || f.Data != elf.ELFDATA2MSB || f.Type != elf.ET_REL ||
+		f.Machine != elf.Machine(binlib.ElfMachineZ8000) || flags != 0 {
+		t.Errorf("header %v %v %v %v %x", f.Class, f.Data, f.Type, f.Machine, flags)
+	}
+	names := []string{".text", ".rodata", ".data", ".text", ".text", ".bss", ".stack"}
+	for idx, name := range names {
+		sect := f.Sections[idx+1]
+		if sect.Name != name {
+			t.Errorf("section %d: %s, want %s", idx+1, sect.Name, name)
+		}
+	}
+	if text := f.Sections[1]; text.Flags != elf.SHF_ALLOC|elf.SHF_EXECINSTR || text.Size != 32 {
+		t.Errorf(".text flags %v size %d", text.Flags, text.Size)
+	}
+	if bss := f.Sections[6]; bss.Type != elf.SHT_NOBITS || bss.Size != 16 {
+		t.Errorf(".bss type %v size %d", bss.Type, bss.Size)
+	}
+
+	symbs, err := f.Symbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]elf.Symbol)
+	for idx, symb := range symbs {
+		if elf.ST_BIND(symb.Info) == elf.STB_GLOBAL && idx+1 != int(f.Section(".symtab").Info) &&
+			elf.ST_BIND(symbs[idx-1].Info) == elf.STB_LOCAL {
+			t.Errorf("first global %d, sh_info %d", idx+1, f.Section(".symtab").Info)
+		}
+		byName[symb.Name] = symb
+	}
+	tests := []struct {
+		name  string
+		bind  elf.SymBind
+		typ   elf.SymType
+		sect  elf.SectionIndex
+		value uint64
+		size  uint64
+	}{
+		{"ABS", elf.STB_LOCAL, elf.STT_NOTYPE, elf.SHN_ABS, 0x1234, 0},
+		{"_glob", elf.STB_GLOBAL, elf.STT_FUNC, 1, 0x10, 0},
+		{"_gdata", elf.STB_GLOBAL, elf.STT_OBJECT, 3, 0x08, 0},
+		{"_ext", elf.STB_GLOBAL, elf.STT_NOTYPE, elf.SHN_UNDEF, 0, 0},
+		{"_comm", elf.STB_GLOBAL, elf.STT_OBJECT, elf.SHN_COMMON, 2, 6},
+	}
+	for _, tt := range tests {
+		symb, ok := byName[tt.name]
+		if !ok || elf.ST_BIND(symb.Info) != tt.bind || elf.ST_TYPE(symb.Info) != tt.typ ||
+			symb.Section != tt.sect || symb.Value != tt.value || symb.Size != tt.size ||
+			elf.ST_VISIBILITY(symb.Other) != elf.STV_DEFAULT {
+			t.Errorf("%s: %+v", tt.name, symb)
+		}
+	}
+
+	want := []rela{
+		{0x02, ".data", binlib.ElfRelocZ8k16, 4},
+		{0x06, "_ext", binlib.ElfRelocZ8k16, 0},
+		{0x0a, ".rodata", binlib.ElfRelocZ8kShortSeg, 2},
+		{0x0e, "_ext2", binlib.ElfRelocZ8kShortSeg, 0},
+		{0x12, ".data", binlib.ElfRelocZ8kLongSeg, 8},
+		{0x18, "_ext", binlib.ElfRelocZ8kLongSeg, 2},
+	}
+	if got := relocs(t, f, ".rela.text"); len(got) != len(want) {
+		t.Errorf(".rela.text %v", got)
+	} else {
+		for idx := range want {
+			if got[idx] != want[idx] {
+				t.Errorf("reloc %d: %+v, want %+v", idx, got[idx], want[idx])
+			}
+		}
+	}
+
+	f, flags = readELF(t, xouttest.Sample(binlib.XoutMagicSeg).XoutFile(), nil)
+	if flags != binlib.ElfFlagSegmented || f.Section(".bss").Size != 16+6+3 {
+		t.Errorf("segmented flags %x, .bss size %d", flags, f.Section(".bss").Size)
+	}
+	if f, _ = readELF(t, xouttest.Sample(binlib.XoutMagicSeg).XoutFile(), &Options{Machine: 0x1234}); f.Machine != 0x1234 {
+		t.Errorf("machine %v", f.Machine)
+	}
+}
+
+func TestELFExecutable(t *testing.T) {
+	obj := &xouttest.Object{Magic: binlib.XoutMagicNonSegX}
+	obj.Segs = []binlib.XoutSeg{
+		{Number: 0, Type: binlib.XoutSegCODE, Length: 4},
+		{Number: 1, Type: binlib.XoutSegDATA, Length: 4},
+		{Number: 2, Type: binlib.XoutSegBSS, Length: 8},
+	}
+	obj.Code = []byte{0x21, 0x00, 0x00, 0x06, 'd', 'a', 't', 'a'}
+	obj.Relocs = []binlib.XoutRelocItem{{SegIdx: 0, Type: binlib.XoutRelocOFF, Location: 2, SymbIdx: 1}}
+	obj.Symbs = []binlib.XoutSymbEntry{xouttest.Symb(1, binlib.XoutSymbGlobal, 2, "_d")}
+	f, _ := readELF(t, obj.XoutFile(), nil)
+	if f.Type != elf.ET_EXEC || f.Entry != 0 || len(f.Progs) != 3 {
+		t.Fatalf("type %v entry %x programs %d", f.Type, f.Entry, len(f.Progs))
+	}
+	if data := f.Progs[1]; data.Vaddr != 4 || data.Filesz != 4 || data.Flags != elf.PF_R|elf.PF_W {
+		t.Errorf("data program %+v", data.ProgHeader)
+	}
+	if bss := f.Progs[2]; bss.Vaddr != 8 || bss.Filesz != 0 || bss.Memsz != 8 {
+		t.Errorf("bss program %+v", bss.ProgHeader)
+	}
+	code := make([]byte, 4)
+	f.Progs[0].ReadAt(code, 0)
+	if !bytes.Equal(code, obj.Code[:4]) {
+		t.Errorf("code % x", code)
+	}
+	if got := relocs(t, f, ".rela.text"); len(got) != 1 || got[0] != (rela{2, ".data", binlib.ElfRelocZ8k16, 2}) {
+		t.Errorf("relocations %+v", got)
+	}
+	symbs, _ := f.Symbols()
+	if symb := symbs[len(symbs)-1]; symb.Name != "_d" || symb.Value != 6 {
+		t.Errorf("symbol %+v", symb)
+	}
+}
@@ -0,0 +1,95 @@
+package convert
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"binlib"
+	"binlib/xouttest"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+// checkGolden compares got with testdata/name, or rewrites it with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		for idx := 0; idx < len(got) && idx < len(want); idx++ {
+			if got[idx] != want[idx] {
+				t.Fatalf("%s differs at 0x%04x: %02x, want %02x", name, idx, got[idx], want[idx])
+			}
+		}
+		t.Fatalf("%s length %d, want %d", name, len(got), len(want))
+	}
+}
+
+func TestGolden(t *testing.T) {
+	tests := []struct {
+		golden string
+		magic  uint16
+		opts   Options
+	}{
+		{"sample.o", binlib.XoutMagicNonSeg, Options{}},
+		{"sample_seg.o", binlib.XoutMagicSeg, Options{}},
+		{"sample_z8002.o", binlib.XoutMagicSeg, Options{CPU: CPUZ8002}},
+		{"sample_common.o", binlib.XoutMagicNonSeg, Options{BSS: BSSCommon}},
+		{"sample_extern.o", binlib.XoutMagicNonSeg, Options{BSS: BSSExtern}},
+		{"sample_global.o", binlib.XoutMagicNonSeg, Options{Symbs: SymbGlobal}},
+	}
+	for _, test := range tests {
+		t.Run(test.golden, func(t *testing.T) {
+			cf, err := Convert(xouttest.Sample(test.magic).XoutFile(), &test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := cf.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, test.golden, got)
+		})
+	}
+}
+
+func TestGoldenLibrary(t *testing.T) {
+	for _, member := range xouttest.SampleMembers() {
+		t.Run(member.Name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), member.Name)
+			if err := os.WriteFile(path, member.Data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			var xf binlib.XoutFile
+			if err = xf.Read(file); err != nil {
+				t.Fatal(err)
+			}
+			cf, err := Convert(&xf, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := cf.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, "lib_"+member.Name, got)
+		})
+	}
+}
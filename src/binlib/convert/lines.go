@@ -0,0 +1,226 @@
+/*
+ *  lines.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Line number tables of COFF
+ *  The lines of a line map are grouped by the symbols in the code segments.
+ *  Each function has .bf and .ef symbols, and its line numbers count from 1
+ *  at its first line as gdb reads them.
+ */
+
+package convert
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"binlib"
+)
+
+// Line is a source line of the code at an offset of a segment
+type Line struct {
+	Seg    int
+	Offset uint16
+	Line   int
+}
+
+// ReadLines reads a line map. Each line is "segment:offset line" with the
+// offset in hex, or "file name" giving the source file. Empty lines and
+// lines from # are skipped.
+func ReadLines(r io.Reader) (string, []Line, error) {
+	var file string
+	var lines []Line
+	scanner := bufio.NewScanner(r)
+	for num := 1; scanner.Scan(); num++ {
+		text := scanner.Text()
+		if pos := strings.IndexByte(text, '#'); pos >= 0 {
+			text = text[:pos]
+		}
+		fields := strings.Fields(text)
+		switch {
+		case len(fields) == 0:
+			continue
+		case len(fields) == 2 && fields[0] == "file":
+			file = fields[1]
+			continue
+		}
+		addr := strings.SplitN(fields[0], ":", 2)
+		if len(fields) != 2 || len(addr) != 2 {
+			return "", nil, fmt.Errorf("line %d: bad line map", num)
+		}
+		seg, err1 := strconv.ParseUint(addr[0], 10, 8)
+		off, err2 := strconv.ParseUint(strings.TrimPrefix(addr[1], "0x"), 16, 16)
+		line, err3 := strconv.ParseUint(fields[1], 10, 16)
+		if err1 != nil || err2 != nil || err3 != nil || line == 0 {
+			return "", nil, fmt.Errorf("line %d: bad line map", num)
+		}
+		lines = append(lines, Line{Seg: int(seg), Offset: uint16(off), Line: int(line)})
+	}
+	return file, lines, scanner.Err()
+}
+
+/* A symbol in a code segment with the lines from it to the next symbol */
+type function struct {
+	seg        int
+	start, end uint16
+	lines      []Line
+	cfIdx      uint32 /* index of the symbol in the COFF symbol table */
+	lineIdx    int    /* index of the first entry in the line number table */
+}
+
+/*
+ * Group the lines by the functions, preferring global symbols at the same
+ * offset. Lines before the first symbol of a segment are dropped.
+ */
+func (c *converter) findFuncs() error {
+	xf := c.xf
+	c.funcs = make(map[int]*function)
+	if len(c.opts.Lines) == 0 {
+		return nil
+	}
+	bySeg := make(map[int][]int)
+	for idx, symb := range xf.SymbTbl[:c.numXoutSymbs] {
+		if (symb.Type == binlib.XoutSymbLocal || symb.Type == binlib.XoutSymbGlobal) &&
+			int(symb.SegIdx) < len(xf.SegTbl) {
+			bySeg[int(symb.SegIdx)] = append(bySeg[int(symb.SegIdx)], idx)
+		}
+	}
+	for seg, symbs := range bySeg {
+		sort.SliceStable(symbs, func(i, j int) bool {
+			si, sj := xf.SymbTbl[symbs[i]], xf.SymbTbl[symbs[j]]
+			if si.Value != sj.Value {
+				return si.Value < sj.Value
+			}
+			return si.Type == binlib.XoutSymbGlobal && sj.Type != binlib.XoutSymbGlobal
+		})
+		bySeg[seg] = symbs
+	}
+	for _, line := range c.opts.Lines {
+		if line.Seg < 0 || line.Seg >= len(xf.SegTbl) ||
+			convSegType(c.sectSegType(xf.SegTbl[line.Seg].Type)) != binlib.CoffSectTEXT {
+			return fmt.Errorf("line %d in segment %d, not code", line.Line, line.Seg)
+		}
+		if line.Offset >= xf.SegTbl[line.Seg].Length {
+			return fmt.Errorf("line %d at %d:%04x out of segment", line.Line, line.Seg, line.Offset)
+		}
+		symbs := bySeg[line.Seg]
+		pos := sort.Search(len(symbs), func(i int) bool { return xf.SymbTbl[symbs[i]].Value > line.Offset })
+		if pos == 0 {
+			continue
+		}
+		start := xf.SymbTbl[symbs[pos-1]].Value
+		for pos > 1 && xf.SymbTbl[symbs[pos-2]].Value == start {
+			pos--
+		}
+		idx := symbs[pos-1]
+		f := c.funcs[idx]
+		if f == nil {
+			f = &function{seg: line.Seg, start: start, end: xf.SegTbl[line.Seg].Length}
+			for _, next := range symbs[pos:] {
+				if value := xf.SymbTbl[next].Value; value > start {
+					f.end = value
+					break
+				}
+			}
+			c.funcs[idx] = f
+			c.keepSymb[idx] = true
+		}
+		f.lines = append(f.lines, line)
+	}
+	for _, f := range c.funcs {
+		sort.SliceStable(f.lines, func(i, j int) bool { return f.lines[i].Offset < f.lines[j].Offset })
+	}
+	return nil
+}
+
+func (f *function) firstLine() int {
+	first := f.lines[0].Line
+	for _, line := range f.lines {
+		if line.Line < first {
+			first = line.Line
+		}
+	}
+	return first
+}
+
+func (f *function) lastLine() int {
+	last := 0
+	for _, line := range f.lines {
+		if line.Line > last {
+			last = line.Line
+		}
+	}
+	return last
+}
+
+/* Append a function symbol with its aux entry, and .bf and .ef */
+func (c *converter) addFunc(f *function, cfSymb binlib.CoffSymbEntry) {
+	cf := c.cf
+	f.cfIdx = uint32(len(cf.SymbTbl))
+	cfSymb.Type = binlib.CoffSymbTypeFunc
+	cfSymb.NumAux = 1
+	cf.SymbTbl = append(cf.SymbTbl, cfSymb,
+		binlib.CoffSymbAuxFunc{Size: uint32(f.end - f.start), EndIdx: f.cfIdx + 6})
+	block := binlib.CoffSymbEntry{Value: cfSymb.Value, SectNo: cfSymb.SectNo,
+		StrgClass: binlib.CoffSymbClassFunc, NumAux: 1}
+	copy(block.Name[:], ".bf")
+	cf.SymbTbl = append(cf.SymbTbl, block, binlib.CoffSymbAuxBlock{Line: uint16(f.firstLine())})
+	block.Name = [binlib.CoffNameLen]byte{}
+	copy(block.Name[:], ".ef")
+	block.Value = c.bases[f.seg] + uint32(f.end)
+	cf.SymbTbl = append(cf.SymbTbl, block,
+		binlib.CoffSymbAuxBlock{Line: uint16(f.lastLine() - f.firstLine() + 1)})
+}
+
+/* Build the line number tables in the section order */
+func (c *converter) convLineTbl() {
+	cf := c.cf
+	var funcs []*function
+	for _, f := range c.funcs {
+		funcs = append(funcs, f)
+	}
+	sort.Slice(funcs, func(i, j int) bool {
+		if funcs[i].seg != funcs[j].seg {
+			return funcs[i].seg < funcs[j].seg
+		}
+		return funcs[i].start < funcs[j].start
+	})
+	for _, f := range funcs {
+		f.lineIdx = len(cf.LineTbl)
+		cf.LineTbl = append(cf.LineTbl, binlib.CoffLineNum{Addr: f.cfIdx})
+		first := f.firstLine()
+		for _, line := range f.lines {
+			cf.LineTbl = append(cf.LineTbl, binlib.CoffLineNum{Addr: c.bases[f.seg] + uint32(line.Offset),
+				Line: uint16(line.Line - first + 1)})
+		}
+		cf.SectTbl[f.seg].NumLines += uint16(len(f.lines) + 1)
+	}
+}
+
+/* Set the file positions of the lines in the function aux entries, after the layout */
+func (c *converter) setLineNumsFpos() error {
+	cf := c.cf
+	for _, f := range c.funcs {
+		aux, ok := cf.SymbTbl[f.cfIdx+1].(binlib.CoffSymbAuxFunc)
+		if !ok {
+			return errors.New("function symbol without its aux entry")
+		}
+		sectStart := 0
+		for _, g := range c.funcs {
+			if g.seg < f.seg {
+				sectStart += len(g.lines) + 1
+			}
+		}
+		aux.LineNumsFpos = cf.SectTbl[f.seg].LineNumsFpos + int32((f.lineIdx-sectStart)*binlib.CoffLineNumLen)
+		cf.SymbTbl[f.cfIdx+1] = aux
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+/*
+ *  elf.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  A package to export ELF32 big endian files.
+ *  The section headers of the relocations, the symbol table and the string
+ *  tables are generated, and executables have a PT_LOAD program header for
+ *  each allocated section.
+ */
+
+package binlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const ElfHdrLen = 52
+const ElfProgHdrLen = 32
+const ElfSectHdrLen = 40
+const ElfSymbEntryLen = 16
+const ElfRelaItemLen = 12
+
+const ElfTypeRel = uint16(1)
+const ElfTypeExec = uint16(2)
+
+// No machine number is assigned to the Z8000, this one is unofficial
+const ElfMachineZ8000 = uint16(0x8000)
+
+const ElfFlagSegmented = uint32(0x0001) /* Z8001 segmented code */
+
+const ElfSectProgbits = uint32(1)
+const ElfSectSymtab = uint32(2)
+const ElfSectStrtab = uint32(3)
+const ElfSectRela = uint32(4)
+const ElfSectNobits = uint32(8)
+
+const ElfSectWrite = uint32(0x1)
+const ElfSectAlloc = uint32(0x2)
+const ElfSectExec = uint32(0x4)
+
+const ElfSymbLocal = byte(0)
+const ElfSymbGlobal = byte(1)
+
+const ElfSymbNoType = byte(0)
+const ElfSymbObject = byte(1)
+const ElfSymbFunc = byte(2)
+const ElfSymbSection = byte(3)
+
+const ElfSymbVisDefault = byte(0)
+const ElfSymbVisHidden = byte(2)
+
+const ElfSHNUndef = uint16(0)
+const ElfSHNAbs = uint16(0xfff1)
+const ElfSHNCommon = uint16(0xfff2)
+
+/* Relocation types, the fields of the XOUT relocations */
+const ElfRelocZ8kNone = byte(0)
+const ElfRelocZ8k16 = byte(1)       /* 16 bit non segmented address */
+const ElfRelocZ8kShortSeg = byte(2) /* 7 bit segment and 8 bit offset */
+const ElfRelocZ8kLongSeg = byte(3)  /* 32 bit long segmented address */
+
+type ElfFile struct {
+	Type    uint16
+	Machine uint16
+	Flags   uint32
+	Entry   uint32
+	SectTbl []ElfSect /* section header index is the table index + 1 */
+	SymbTbl []ElfSymb /* without the null symbol, locals first */
+}
+
+type ElfSect struct {
+	Name     string
+	Type     uint32
+	Flags    uint32
+	Addr     uint32
+	Align    uint32
+	Data     []byte
+	Size     uint32 /* size of NOBITS */
+	RelocTbl []ElfRelaItem
+}
+
+type ElfSymb struct {
+	Name   string
+	Value  uint32
+	Size   uint32
+	Bind   byte
+	Type   byte
+	Vis    byte
+	SectNo uint16
+}
+
+type ElfRelaItem struct {
+	Offset  uint32
+	SymbIdx uint32 /* index in SymbTbl + 1 */
+	Type    byte
+	Addend  int32
+}
+
+type elfHdr struct {
+	Ident     [16]byte
+	Type      uint16
+	Machine   uint16
+	Version   uint32
+	Entry     uint32
+	ProgFpos  uint32
+	SectFpos  uint32
+	Flags     uint32
+	HdrLen    uint16
+	ProgLen   uint16
+	NumProgs  uint16
+	SectLen   uint16
+	NumSects  uint16
+	StrSectNo uint16
+}
+
+type elfProgHdr struct {
+	Type   uint32
+	Fpos   uint32
+	Vaddr  uint32
+	Paddr  uint32
+	Filesz uint32
+	Memsz  uint32
+	Flags  uint32
+	Align  uint32
+}
+
+type elfSectHdr struct {
+	Name    uint32
+	Type    uint32
+	Flags   uint32
+	Addr    uint32
+	Fpos    uint32
+	Size    uint32
+	Link    uint32
+	Info    uint32
+	Align   uint32
+	EntSize uint32
+}
+
+type elfRelaEntry struct {
+	Offset uint32
+	Info   uint32
+	Addend int32
+}
+
+type elfSymbEntry struct {
+	Name   uint32
+	Value  uint32
+	Size   uint32
+	Info   byte
+	Other  byte
+	SectNo uint16
+}
+
+/* A string table, the first string is empty */
+type elfStrtab struct {
+	data []byte
+}
+
+func (st *elfStrtab) add(name string) uint32 {
+	if len(st.data) == 0 {
+		st.data = []byte{0}
+	}
+	if name == "" {
+		return 0
+	}
+	pos := uint32(len(st.data))
+	st.data = append(append(st.data, name...), 0)
+	return pos
+}
+
+/* A section to write, with its header */
+type elfOutSect struct {
+	hdr  elfSectHdr
+	data []byte
+}
+
+func elfBytes(data interface{}) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, data)
+	return buf.Bytes()
+}
+
+func (ef *ElfFile) sections() ([]elfOutSect, error) {
+	var shstr, str elfStrtab
+	shstr.add("")
+	str.add("")
+	out := []elfOutSect{{}}
+	for _, sect := range ef.SectTbl {
+		size := uint32(len(sect.Data))
+		if sect.Type == ElfSectNobits {
+			size = sect.Size
+		}
+		out = append(out, elfOutSect{hdr: elfSectHdr{Name: shstr.add(sect.Name), Type: sect.Type,
+			Flags: sect.Flags, Addr: sect.Addr, Size: size, Align: sect.Align}, data: sect.Data})
+	}
+
+	symbs := []elfSymbEntry{{}}
+	firstGlobal := uint32(0)
+	for idx, symb := range ef.SymbTbl {
+		if symb.Bind == ElfSymbLocal && firstGlobal != 0 {
+			return nil, errors.New("Local symbol after global ones")
+		}
+		if symb.Bind != ElfSymbLocal && firstGlobal == 0 {
+			firstGlobal = uint32(idx + 1)
+		}
+		symbs = append(symbs, elfSymbEntry{Name: str.add(symb.Name), Value: symb.Value, Size: symb.Size,
+			Info: symb.Bind<<4 | symb.Type&0xf, Other: symb.Vis & 0x3, SectNo: symb.SectNo})
+	}
+	if firstGlobal == 0 {
+		firstGlobal = uint32(len(symbs))
+	}
+	// the symbol table follows the relocation sections
+	symtab := uint32(len(out))
+	for _, sect := range ef.SectTbl {
+		if sect.RelocTbl != nil {
+			symtab++
+		}
+	}
+	for idx, sect := range ef.SectTbl {
+		if sect.RelocTbl == nil {
+			continue
+		}
+		var relocs []elfRelaEntry
+		for _, reloc := range sect.RelocTbl {
+			if reloc.SymbIdx >= uint32(len(symbs)) {
+				return nil, errors.New("Relocation refers unknown symbol")
+			}
+			relocs = append(relocs, elfRelaEntry{reloc.Offset, reloc.SymbIdx<<8 | uint32(reloc.Type), reloc.Addend})
+		}
+		data := elfBytes(relocs)
+		out = append(out, elfOutSect{hdr: elfSectHdr{Name: shstr.add(".rela" + sect.Name), Type: ElfSectRela,
+			Size: uint32(len(data)), Link: symtab, Info: uint32(idx + 1), Align: 4, EntSize: ElfRelaItemLen},
+			data: data})
+	}
+	symData := elfBytes(symbs)
+	out = append(out, elfOutSect{hdr: elfSectHdr{Name: shstr.add(".symtab"), Type: ElfSectSymtab,
+		Size: uint32(len(symData)), Link: symtab + 1, Info: firstGlobal, Align: 4, EntSize: ElfSymbEntryLen},
+		data: symData})
+	out = append(out, elfOutSect{hdr: elfSectHdr{Name: shstr.add(".strtab"), Type: ElfSectStrtab,
+		Size: uint32(len(str.data)), Align: 1}, data: str.data})
+	name := shstr.add(".shstrtab")
+	out = append(out, elfOutSect{hdr: elfSectHdr{Name: name, Type: ElfSectStrtab,
+		Size: uint32(len(shstr.data)), Align: 1}, data: shstr.data})
+	return out, nil
+}
+
+// WriteTo writes the file, the file positions are assigned in the order of
+// the headers
+func (ef *ElfFile) WriteTo(w io.Writer) (int64, error) {
+	sects, err := ef.sections()
+	if err != nil {
+		return 0, err
+	}
+	var progs []elfProgHdr
+	if ef.Type == ElfTypeExec {
+		for _, sect := range sects {
+			if sect.hdr.Flags&ElfSectAlloc == 0 {
+				continue
+			}
+			flags := uint32(4) /* PF_R */
+			if sect.hdr.Flags&ElfSectWrite != 0 {
+				flags |= 2
+			}
+			if sect.hdr.Flags&ElfSectExec != 0 {
+				flags |= 1
+			}
+			progs = append(progs, elfProgHdr{Type: 1, Vaddr: sect.hdr.Addr, Paddr: sect.hdr.Addr,
+				Memsz: sect.hdr.Size, Flags: flags, Align: 2})
+		}
+	}
+
+	fpos := uint32(ElfHdrLen + ElfProgHdrLen*len(progs))
+	prog := 0
+	for idx := range sects {
+		hdr := &sects[idx].hdr
+		if idx == 0 {
+			continue
+		}
+		if hdr.Align > 1 {
+			fpos = (fpos + hdr.Align - 1) &^ (hdr.Align - 1)
+		}
+		hdr.Fpos = fpos
+		if hdr.Type != ElfSectNobits {
+			fpos += hdr.Size
+		}
+		if ef.Type == ElfTypeExec && hdr.Flags&ElfSectAlloc != 0 {
+			progs[prog].Fpos = hdr.Fpos
+			if hdr.Type != ElfSectNobits {
+				progs[prog].Filesz = hdr.Size
+			}
+			prog++
+		}
+	}
+	sectFpos := (fpos + 3) &^ 3
+
+	hdr := elfHdr{Type: ef.Type, Machine: ef.Machine, Version: 1, Entry: ef.Entry, SectFpos: sectFpos,
+		Flags: ef.Flags, HdrLen: ElfHdrLen, SectLen: ElfSectHdrLen, NumSects: uint16(len(sects)),
+		StrSectNo: uint16(len(sects) - 1)}
+	copy(hdr.Ident[:], []byte{0x7f, 'E', 'L', 'F', 1 /* 32 bit */, 2 /* big endian */, 1})
+	if len(progs) > 0 {
+		hdr.ProgFpos, hdr.ProgLen, hdr.NumProgs = ElfHdrLen, ElfProgHdrLen, uint16(len(progs))
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, hdr)
+	binary.Write(&buf, binary.BigEndian, progs)
+	for _, sect := range sects[1:] {
+		if sect.hdr.Type == ElfSectNobits {
+			continue
+		}
+		buf.Write(make([]byte, int(sect.hdr.Fpos)-buf.Len()))
+		buf.Write(sect.data)
+	}
+	buf.Write(make([]byte, int(sectFpos)-buf.Len()))
+	for _, sect := range sects {
+		binary.Write(&buf, binary.BigEndian, sect.hdr)
+	}
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// Bytes returns the file image
+func (ef *ElfFile) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := ef.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,187 @@
+package binlib_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"runtime"
+	"testing"
+
+	"binlib"
+	"binlib/convert"
+	"binlib/xouttest"
+)
+
+// allocLimit is the allocation allowed for parsing an input of n bytes.
+func allocLimit(n int) uint64 {
+	return uint64(64*n) + 1<<20
+}
+
+// allocated returns the bytes allocated by f.
+func allocated(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func FuzzXoutParse(f *testing.F) {
+	f.Add(xouttest.Sample(binlib.XoutMagicNonSeg).Bytes())
+	f.Add(xouttest.Sample(binlib.XoutMagicSeg).Bytes())
+	for _, member := range xouttest.SampleMembers() {
+		f.Add(member.Data)
+	}
+	f.Add([]byte{0xee, 0x02, 0x00, 0x01, 0x7f, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var xf binlib.XoutFile
+		var err error
+		if n := allocated(func() { err = xf.Parse(data) }); n > allocLimit(len(data)) {
+			t.Fatalf("allocated %d bytes for %d bytes input", n, len(data))
+		}
+		if err != nil {
+			return
+		}
+		out, err := xf.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var xf2 binlib.XoutFile
+		if err = xf2.Parse(out); err != nil {
+			t.Fatalf("written file does not parse: %v", err)
+		}
+		out2, err := xf2.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, out2) {
+			t.Fatal("written file does not round-trip")
+		}
+	})
+}
+
+/* A COFF file whose sections all point at one full line number table */
+func sharedLines(numSects int) []byte {
+	data := make([]byte, 0xffff*binlib.CoffLineNumLen)
+	hdr := binlib.CoffHdr{Magic: binlib.CoffMagicZ8k, NumSects: uint16(numSects)}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, hdr)
+	for idx := 0; idx < numSects; idx++ {
+		binary.Write(&buf, binary.BigEndian, binlib.CoffSectHdr{Flags: binlib.CoffSectBSS, NumLines: 0xffff})
+	}
+	copy(data, buf.Bytes())
+	return data
+}
+
+func FuzzCoffParse(f *testing.F) {
+	for _, magic := range []uint16{binlib.XoutMagicNonSeg, binlib.XoutMagicSeg} {
+		cf, err := convert.Convert(xouttest.Sample(magic).XoutFile(), nil)
+		if err != nil {
+			f.Fatal(err)
+		}
+		obj, err := cf.Bytes()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(obj)
+	}
+	f.Add([]byte{0x80, 0x00, 0xff, 0xff})
+	f.Add(sharedLines(200))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var cf binlib.CoffFile
+		var err error
+		if n := allocated(func() { err = cf.Parse(data) }); n > allocLimit(len(data)) {
+			t.Fatalf("allocated %d bytes for %d bytes input", n, len(data))
+		}
+		if err != nil {
+			return
+		}
+		out, err := cf.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cf2 binlib.CoffFile
+		if err = cf2.Parse(out); err != nil {
+			t.Fatalf("written file does not parse: %v", err)
+		}
+		out2, err := cf2.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, out2) {
+			t.Fatal("written file does not round-trip")
+		}
+	})
+}
+
+type arMember struct {
+	hdr  binlib.ArHdr
+	data []byte
+}
+
+func readAr(data []byte) ([]arMember, error) {
+	ar, err := binlib.NewArReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var members []arMember
+	for {
+		arhdr, err := ar.Next()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return members, err
+		}
+		var buf bytes.Buffer
+		if _, err = io.Copy(&buf, ar); err != nil {
+			return members, err
+		}
+		members = append(members, arMember{*arhdr, buf.Bytes()})
+	}
+}
+
+func FuzzArReader(f *testing.F) {
+	f.Add(xouttest.SampleLibrary())
+	f.Add(xouttest.Library([]xouttest.Member{{Name: "odd.o", Data: []byte{1, 2, 3}}}))
+	f.Add([]byte{0xff, 0x65, 'a', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0x7f, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var members []arMember
+		var err error
+		if n := allocated(func() { members, err = readAr(data) }); n > allocLimit(len(data)) {
+			t.Fatalf("allocated %d bytes for %d bytes input", n, len(data))
+		}
+		if err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		aw, err := binlib.NewArWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, member := range members {
+			if err = aw.WriteHeader(&member.hdr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = aw.Write(member.data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = aw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		members2, err := readAr(buf.Bytes())
+		if err != nil {
+			t.Fatalf("written library does not read: %v", err)
+		}
+		if len(members2) != len(members) {
+			t.Fatalf("%d members, want %d", len(members2), len(members))
+		}
+		for idx := range members {
+			if members2[idx].hdr != members[idx].hdr || !bytes.Equal(members2[idx].data, members[idx].data) {
+				t.Fatalf("member %d does not round-trip", idx)
+			}
+		}
+	})
+}
@@ -0,0 +1,113 @@
+/*
+ *  identify.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Identification of the file kinds by their magic numbers
+ */
+
+package binlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+type FileKind int
+
+const (
+	KindUnknown FileKind = iota
+	KindXoutObject
+	KindXoutExec
+	KindXoutLib
+	KindCoff
+	KindGnuAr
+)
+
+const GnuArMagic = "!<arch>\n"
+
+var kindNames = []struct {
+	name string
+	tool string /* the tool to suggest for the kind */
+}{
+	KindUnknown:    {"unknown file", ""},
+	KindXoutObject: {"XOUT object", "xoutdump"},
+	KindXoutExec:   {"XOUT executable", "xoutdump"},
+	KindXoutLib:    {"XOUT library", "xarch"},
+	KindCoff:       {"COFF file", "z8k-coff-objdump"},
+	KindGnuAr:      {"GNU ar archive", "z8k-coff-ar"},
+}
+
+func (kind FileKind) String() string {
+	if kind < 0 || int(kind) >= len(kindNames) {
+		return kindNames[KindUnknown].name
+	}
+	return kindNames[kind].name
+}
+
+/* The name with an article */
+func (kind FileKind) phrase() string {
+	if kind == KindXoutObject || kind == KindXoutExec || kind == KindXoutLib {
+		return "an " + kind.String()
+	}
+	return "a " + kind.String()
+}
+
+// XoutMagicValid tells whether magic is one of the XOUT magics.
+func XoutMagicValid(magic uint16) bool {
+	switch magic {
+	case XoutMagicSeg, XoutMagicNonSeg, XoutMagicNonSegShared, XoutMagicNonSegSplit,
+		XoutMagicSegX, XoutMagicNonSegX, XoutMagicNonSegXShared, XoutMagicNonSegXSplit:
+		return true
+	}
+	return false
+}
+
+// Identify tells the kind of a file from its first bytes. The COFF magic
+// is the Z8000 one, other COFF files are unknown.
+func Identify(head []byte) FileKind {
+	if bytes.HasPrefix(head, []byte(GnuArMagic)) {
+		return KindGnuAr
+	}
+	if len(head) < 2 {
+		return KindUnknown
+	}
+	magic := binary.BigEndian.Uint16(head)
+	switch {
+	case magic == ArMagic:
+		return KindXoutLib
+	case magic == CoffMagicZ8k:
+		return KindCoff
+	case XoutMagicValid(magic) && XoutExecutable(magic):
+		return KindXoutExec
+	case XoutMagicValid(magic):
+		return KindXoutObject
+	}
+	return KindUnknown
+}
+
+// CheckKind returns an error telling what the file is and the tool for it,
+// unless the file is one of the kinds.
+func CheckKind(head []byte, kinds ...FileKind) error {
+	kind := Identify(head)
+	var wants []string
+	for _, want := range kinds {
+		if kind == want {
+			return nil
+		}
+		wants = append(wants, want.phrase())
+	}
+	if kind == KindUnknown {
+		magic := 0
+		if len(head) >= 2 {
+			magic = int(binary.BigEndian.Uint16(head))
+		}
+		return fmt.Errorf("Not %s, unknown magic 0x%04x", strings.Join(wants, " or "), magic)
+	}
+	return fmt.Errorf("This is %s, not %s, did you mean %s?", kind.phrase(),
+		strings.Join(wants, " or "), kindNames[kind].tool)
+}
@@ -0,0 +1,105 @@
+/*
+ *  input.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Reading the inputs and parsing the options of the linker
+ */
+
+package link
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"binlib"
+)
+
+// ReadInput reads an object file, or a library with its members.
+func ReadInput(infpath string) (Input, error) {
+	in := Input{Name: filepath.Base(infpath)}
+	data, err := os.ReadFile(infpath)
+	if err != nil {
+		return in, fmt.Errorf("can not open %s", infpath)
+	}
+	if len(data) < 2 || binary.BigEndian.Uint16(data) != binlib.ArMagic {
+		in.Xout = &binlib.XoutFile{}
+		if err = in.Xout.Parse(data); err != nil {
+			return in, fmt.Errorf("%s: %v", infpath, err)
+		}
+		return in, nil
+	}
+	ar, err := binlib.NewArReader(bytes.NewReader(data))
+	if err != nil {
+		return in, fmt.Errorf("%s: %v", infpath, err)
+	}
+	for {
+		arhdr, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return in, fmt.Errorf("%s: %v", infpath, err)
+		}
+		member := Input{Name: binlib.ConvertArName(arhdr.Name)}
+		var buf bytes.Buffer
+		if _, err = io.Copy(&buf, ar); err != nil {
+			return in, fmt.Errorf("%s: %v", infpath, err)
+		}
+		member.Xout = &binlib.XoutFile{}
+		if err = member.Xout.Parse(buf.Bytes()); err != nil {
+			return in, fmt.Errorf("%s(%s): %v", infpath, member.Name, err)
+		}
+		in.Members = append(in.Members, member)
+	}
+	return in, nil
+}
+
+// ParseOrder parses "type,..." into segment types for Options.Order.
+func ParseOrder(opt string) ([]byte, error) {
+	if opt == "" {
+		return nil, nil
+	}
+	var order []byte
+	for _, name := range strings.Split(opt, ",") {
+		segType, ok := binlib.XoutSegType(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown segment type %s", name)
+		}
+		order = append(order, segType)
+	}
+	return order, nil
+}
+
+// ParseBases parses "type=addr,..." into segment addresses for
+// Options.Bases.
+func ParseBases(opt string) (map[byte]uint32, error) {
+	if opt == "" {
+		return nil, nil
+	}
+	bases := make(map[byte]uint32)
+	for _, item := range strings.Split(opt, ",") {
+		pair := strings.SplitN(item, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("bad segment address %s", item)
+		}
+		segType, ok := binlib.XoutSegType(pair[0])
+		if !ok {
+			return nil, fmt.Errorf("unknown segment type %s", pair[0])
+		}
+		addr, err := strconv.ParseUint(pair[1], 0, 32)
+		if err != nil || addr > 0x7fffff {
+			return nil, fmt.Errorf("bad address %s", pair[1])
+		}
+		bases[segType] = uint32(addr)
+	}
+	return bases, nil
+}
@@ -0,0 +1,65 @@
+package link
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"binlib"
+	"binlib/xouttest"
+)
+
+func TestReadInput(t *testing.T) {
+	dir := t.TempDir()
+	libpath := filepath.Join(dir, "sample.a")
+	if err := os.WriteFile(libpath, xouttest.SampleLibrary(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	in, err := ReadInput(libpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Name != "sample.a" || in.Xout != nil || len(in.Members) != len(xouttest.SampleMembers()) {
+		t.Fatalf("library read as %+v", in)
+	}
+	if in.Members[0].Name != "first.o" || in.Members[0].Xout.Header.Magic != binlib.XoutMagicNonSeg {
+		t.Errorf("first member %s", in.Members[0].Name)
+	}
+
+	objpath := filepath.Join(dir, "sample.rel")
+	if err = os.WriteFile(objpath, xouttest.Sample(binlib.XoutMagicNonSeg).Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if in, err = ReadInput(objpath); err != nil {
+		t.Fatal(err)
+	}
+	if in.Xout == nil || len(in.Xout.SegTbl) != 7 {
+		t.Errorf("object read as %+v", in)
+	}
+
+	if err = os.WriteFile(objpath, []byte{0xee}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadInput(objpath); err == nil {
+		t.Error("no error for a broken object")
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	order, err := ParseOrder("data,code")
+	if err != nil || len(order) != 2 || order[0] != binlib.XoutSegDATA || order[1] != binlib.XoutSegCODE {
+		t.Errorf("order %v, %v", order, err)
+	}
+	if _, err = ParseOrder("text"); err == nil {
+		t.Error("no error for an unknown segment type")
+	}
+	bases, err := ParseBases("code=0x1000,bss=0x050000")
+	if err != nil || bases[binlib.XoutSegCODE] != 0x1000 || bases[binlib.XoutSegBSS] != 0x050000 {
+		t.Errorf("bases %v, %v", bases, err)
+	}
+	for _, opt := range []string{"code", "text=0", "code=0x800000"} {
+		if _, err = ParseBases(opt); err == nil {
+			t.Errorf("no error for %s", opt)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+/*
+ *  layout.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Placing the modules and building the executable
+ */
+
+package link
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"binlib"
+)
+
+/* Segments are placed at even offsets */
+func align(offset uint32) uint32 {
+	return (offset + 1) &^ 1
+}
+
+func (l *linker) newSeg(segType byte) int {
+	l.segs = append(l.segs, &Segment{Type: segType})
+	return len(l.segs) - 1
+}
+
+/* Gather the segments of the modules into output segments by type */
+func (l *linker) layout() {
+	hasCommons := false
+	for _, g := range l.globals {
+		if g.Module < 0 && g.Size > 0 && !l.opts.Relocatable {
+			hasCommons = true
+		}
+	}
+	for _, mod := range l.mods {
+		mod.SegIdx = make([]int, len(mod.Xout.SegTbl))
+		mod.SegOff = make([]uint32, len(mod.Xout.SegTbl))
+		for idx := range mod.SegIdx {
+			mod.SegIdx[idx] = -1
+		}
+	}
+	done := make(map[byte]bool)
+	for _, segType := range append(append([]byte{}, l.opts.Order...), DefaultOrder...) {
+		if done[segType] {
+			continue
+		}
+		done[segType] = true
+		out := -1
+		if segType == binlib.XoutSegBSS && hasCommons {
+			out = l.newSeg(segType)
+		}
+		for m, mod := range l.mods {
+			for idx, seg := range mod.Xout.SegTbl {
+				if seg.Type != segType {
+					continue
+				}
+				if out < 0 {
+					out = l.newSeg(segType)
+				}
+				outSeg := l.segs[out]
+				offset := align(outSeg.Length)
+				outSeg.Parts = append(outSeg.Parts, Part{Module: m, Seg: idx, Offset: offset, Length: uint32(seg.Length)})
+				outSeg.Length = offset + uint32(seg.Length)
+				mod.SegIdx[idx] = out
+				mod.SegOff[idx] = offset
+			}
+		}
+	}
+	for _, mod := range l.mods {
+		for idx, out := range mod.SegIdx {
+			if out < 0 {
+				l.errorf("%s: segment %d of unknown type %d", mod.Name, idx, mod.Xout.SegTbl[idx].Type)
+			}
+		}
+	}
+}
+
+/*
+ * Place the globals, and the commons after the modules' BSS. Commons are
+ * left undefined by a partial link.
+ */
+func (l *linker) allocCommons() {
+	bss := -1
+	for idx, seg := range l.segs {
+		if seg.Type == binlib.XoutSegBSS {
+			bss = idx
+		}
+	}
+	for _, g := range l.sortedSymbs() {
+		if g.Module >= 0 {
+			mod := l.mods[g.Module]
+			symb := mod.Xout.SymbTbl[g.symb]
+			if symb.SegIdx == 0xff {
+				g.Seg, g.Value = -1, uint32(symb.Value)
+			} else {
+				g.Seg = mod.SegIdx[symb.SegIdx]
+				g.Value = mod.SegOff[symb.SegIdx] + uint32(symb.Value)
+			}
+			continue
+		}
+		if l.opts.Relocatable {
+			continue
+		}
+		seg := l.segs[bss]
+		g.Seg = bss
+		g.Value = align(seg.Length)
+		seg.Length = g.Value + uint32(g.Size)
+	}
+}
+
+/* Make the segment table and give the segments their addresses */
+func (l *linker) place() *binlib.XoutFile {
+	xf := &binlib.XoutFile{}
+	switch {
+	case l.opts.Relocatable && l.seg:
+		xf.Header.Magic = binlib.XoutMagicSeg
+	case l.opts.Relocatable && l.split:
+		xf.Header.Magic = binlib.XoutMagicNonSegSplit
+	case l.opts.Relocatable && l.shared:
+		xf.Header.Magic = binlib.XoutMagicNonSegShared
+	case l.opts.Relocatable:
+		xf.Header.Magic = binlib.XoutMagicNonSeg
+	case l.seg:
+		xf.Header.Magic = binlib.XoutMagicSegX
+	case l.split:
+		xf.Header.Magic = binlib.XoutMagicNonSegXSplit
+	case l.shared:
+		xf.Header.Magic = binlib.XoutMagicNonSegXShared
+	default:
+		xf.Header.Magic = binlib.XoutMagicNonSegX
+	}
+	for idx, seg := range l.segs {
+		if seg.Length > 0xffff {
+			l.errorf("%s segment of %d bytes exceeds 64K", binlib.XoutSegName(seg.Type), seg.Length)
+		}
+		xf.SegTbl = append(xf.SegTbl, binlib.XoutSeg{Number: byte(idx), Type: seg.Type, Length: uint16(seg.Length)})
+	}
+	// executables at the default addresses, relocatable segments at 0
+	bases := xf.LinkedBases()
+	for idx, seg := range l.segs {
+		if addr, ok := l.opts.Bases[seg.Type]; ok {
+			bases[idx] = addr
+			if l.seg {
+				xf.SegTbl[idx].Number = byte(binlib.XoutAddrSeg(addr))
+			}
+		}
+		seg.Addr = bases[idx]
+		for pidx := range seg.Parts {
+			seg.Parts[pidx].Addr = seg.Addr + seg.Parts[pidx].Offset
+		}
+		if !l.seg && seg.Addr+seg.Length > 0x10000 {
+			l.errorf("%s segment at 0x%04x exceeds the 64K address space",
+				binlib.XoutSegName(seg.Type), seg.Addr)
+		}
+	}
+	for _, g := range l.globals {
+		g.Addr = g.Value
+		if g.Seg >= 0 {
+			g.Addr += l.segs[g.Seg].Addr
+		}
+	}
+	return xf
+}
+
+/* Make the code part, relocation and symbol tables */
+func (l *linker) build(xf *binlib.XoutFile) {
+	data := make([][]byte, len(l.segs))
+	for idx, seg := range l.segs {
+		if !binlib.XoutSegHasData(seg.Type) {
+			continue
+		}
+		data[idx] = make([]byte, seg.Length)
+		for _, part := range seg.Parts {
+			mod := l.mods[part.Module]
+			pos, err := mod.Xout.SegPos(part.Seg)
+			if err != nil {
+				l.errorf("%s: %v", mod.Name, err)
+				return
+			}
+			copy(data[idx][part.Offset:], mod.Xout.CodePart[pos:pos+int64(part.Length)])
+		}
+	}
+
+	// symbols first, relocations refer the undefined ones
+	if !l.opts.Strip {
+		l.buildSymbTbl(xf)
+	}
+	// relocations are kept for loaders unless the addresses are fixed
+	keepRelocs := !l.opts.Strip && len(l.opts.Bases) == 0
+	for _, mod := range l.mods {
+		for _, reloc := range mod.Xout.RelocTbl {
+			out, ok := l.relocate(mod, reloc, data)
+			if ok && keepRelocs {
+				xf.RelocTbl = append(xf.RelocTbl, out)
+			}
+		}
+	}
+	sort.SliceStable(xf.RelocTbl, func(i, j int) bool {
+		ri, rj := xf.RelocTbl[i], xf.RelocTbl[j]
+		if ri.SegIdx != rj.SegIdx {
+			return ri.SegIdx < rj.SegIdx
+		}
+		return ri.Location < rj.Location
+	})
+	for _, buf := range data {
+		xf.CodePart = append(xf.CodePart, buf...)
+	}
+	xf.Layout()
+}
+
+/*
+ * Patch a relocated field with the target address, and return the relocation
+ * of the output, which refers the output segment of the target. Absolute
+ * targets need no relocation. Undefined symbols left by a partial link are
+ * referred as they are, the field holds the offset from the symbol.
+ */
+func (l *linker) relocate(mod *Module, reloc binlib.XoutRelocItem, data [][]byte) (binlib.XoutRelocItem, bool) {
+	xf := mod.Xout
+	out := mod.SegIdx[reloc.SegIdx]
+	loc := mod.SegOff[reloc.SegIdx] + uint32(reloc.Location)
+	target := -1
+	var addr uint32
+	switch reloc.Type {
+	case binlib.XoutRelocOFF, binlib.XoutRelocSSG, binlib.XoutRelocLSG:
+		target = mod.SegIdx[reloc.SymbIdx]
+		addr = l.segs[target].Addr + mod.SegOff[reloc.SymbIdx]
+	default:
+		symb := xf.SymbTbl[reloc.SymbIdx]
+		switch {
+		case symb.Type == binlib.XoutSymbUndefEX:
+			g := l.globals[binlib.ConvertName(symb.Name)]
+			if g.Module < 0 && l.opts.Relocatable {
+				return binlib.XoutRelocItem{
+					SegIdx:   byte(out),
+					Type:     reloc.Type,
+					Location: uint16(loc),
+					SymbIdx:  uint16(l.undefIdx[g.Name]),
+				}, true
+			}
+			target, addr = g.Seg, g.Addr
+		case symb.SegIdx == 0xff:
+			addr = uint32(symb.Value)
+		default:
+			target = mod.SegIdx[symb.SegIdx]
+			addr = l.segs[target].Addr + mod.SegOff[symb.SegIdx] + uint32(symb.Value)
+		}
+	}
+
+	// relocatable fields hold the offsets from the targets
+	buf := data[out]
+	delta := binlib.XoutAddrOff(addr)
+	outType := reloc.Type
+	switch reloc.Type {
+	case binlib.XoutRelocOFF, binlib.XoutRelocXOFF:
+		outType = binlib.XoutRelocOFF
+		word := binary.BigEndian.Uint16(buf[loc:])
+		binary.BigEndian.PutUint16(buf[loc:], word+delta)
+	case binlib.XoutRelocSSG, binlib.XoutRelocXSSG:
+		outType = binlib.XoutRelocSSG
+		word := binary.BigEndian.Uint16(buf[loc:])
+		off := word&0xff + delta
+		if off > 0xff {
+			l.errorf("%s: short segmented address at %d:%04x out of range",
+				mod.Name, reloc.SegIdx, reloc.Location)
+		}
+		binary.BigEndian.PutUint16(buf[loc:], binlib.XoutAddrSeg(addr)<<8|off&0xff)
+	case binlib.XoutRelocLSG, binlib.XoutRelocXLSG:
+		outType = binlib.XoutRelocLSG
+		word := binary.BigEndian.Uint16(buf[loc+2:])
+		binary.BigEndian.PutUint16(buf[loc:], 0x8000|binlib.XoutAddrSeg(addr)<<8)
+		binary.BigEndian.PutUint16(buf[loc+2:], word+delta)
+	}
+	return binlib.XoutRelocItem{
+		SegIdx:   byte(out),
+		Type:     outType,
+		Location: uint16(loc),
+		SymbIdx:  uint16(target),
+	}, target >= 0
+}
+
+/*
+ * Symbols of the modules moved to the output segments, and the commons,
+ * which are undefined externals with the sizes for a partial link.
+ */
+func (l *linker) buildSymbTbl(xf *binlib.XoutFile) {
+	for _, mod := range l.mods {
+		for _, symb := range mod.Xout.SymbTbl {
+			switch symb.Type {
+			case binlib.XoutSymbGlobal:
+			case binlib.XoutSymbLocal:
+				if l.opts.DiscardLocals {
+					continue
+				}
+			default:
+				continue
+			}
+			if symb.SegIdx != 0xff {
+				symb.Value += uint16(mod.SegOff[symb.SegIdx])
+				symb.SegIdx = byte(mod.SegIdx[symb.SegIdx])
+			}
+			xf.SymbTbl = append(xf.SymbTbl, symb)
+		}
+	}
+	for _, g := range l.sortedSymbs() {
+		if g.Module >= 0 {
+			continue
+		}
+		symb := binlib.XoutSymbEntry{SegIdx: byte(g.Seg), Type: binlib.XoutSymbGlobal, Value: uint16(g.Value)}
+		if l.opts.Relocatable {
+			symb = binlib.XoutSymbEntry{SegIdx: 0xff, Type: binlib.XoutSymbUndefEX, Value: g.Size}
+			l.undefIdx[g.Name] = len(xf.SymbTbl)
+		}
+		copy(symb.Name[:], g.Name)
+		xf.SymbTbl = append(xf.SymbTbl, symb)
+	}
+}
@@ -0,0 +1,325 @@
+/*
+ *  link.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  A package to link XOUT relocatable files into an executable XOUT file
+ *  without going through COFF and GNU ld.
+ */
+
+package link
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"binlib"
+)
+
+// DefaultOrder is the order of the output segments by type.
+var DefaultOrder = []byte{
+	binlib.XoutSegCODE, binlib.XoutSegCONST, binlib.XoutSegDATA,
+	binlib.XoutSegCDMIX, binlib.XoutSegCDMIX_P, binlib.XoutSegBSS, binlib.XoutSegSTACK,
+}
+
+type Options struct {
+	Order         []byte          // segment types placed first, the others follow DefaultOrder
+	Bases         map[byte]uint32 // addresses of the output segments by type
+	SplitID       bool            // code and data in separate address spaces
+	Strip         bool            // write no symbols and relocations
+	DiscardLocals bool            // write no local symbols
+	Relocatable   bool            // partial link, undefined symbols are left
+}
+
+// Input is an object file or a library given to the linker.
+type Input struct {
+	Name    string
+	Xout    *binlib.XoutFile // an object file
+	Members []Input          // objects in a library
+}
+
+// Module is a loaded object file.
+type Module struct {
+	Name   string
+	Xout   *binlib.XoutFile
+	SegIdx []int    // output segment of each segment
+	SegOff []uint32 // offset of each segment in the output segment
+}
+
+// Part is a module's segment placed in an output segment.
+type Part struct {
+	Module int
+	Seg    int    /* index in the module's segment table */
+	Offset uint32 /* offset in the output segment */
+	Length uint32
+	Addr   uint32
+	Guess  bool /* address not confirmed by SetAddrs */
+}
+
+// Segment is an output segment.
+type Segment struct {
+	Type   byte
+	Addr   uint32
+	Length uint32
+	Parts  []Part
+}
+
+// Symbol is a global symbol of the link.
+type Symbol struct {
+	Name   string
+	Module int    // defining module, -1 for commons
+	Seg    int    // output segment, -1 for absolute
+	Value  uint32 // offset in the output segment, or the absolute value
+	Addr   uint32 // address in the image
+	Size   uint16 // size of a common
+	Refs   []int  // referencing modules
+	Guess  bool   // address not confirmed by SetAddrs
+
+	symb int // index in the defining module's symbol table
+}
+
+// Result is a linked executable with the placement of the modules.
+type Result struct {
+	Xout    *binlib.XoutFile
+	Modules []*Module
+	Segs    []*Segment
+	Symbs   []*Symbol // sorted by name
+}
+
+type linker struct {
+	opts    Options
+	mods    []*Module
+	segs    []*Segment
+	globals map[string]*Symbol
+	seg     bool // segmented
+	split   bool // split I/D
+	shared  bool // shared text, split I/D takes over
+	errs    []string
+
+	undefIdx map[string]int // output symbol index of undefined symbols
+}
+
+// Link links the inputs in the order. Library members are loaded when
+// they define symbols undefined at that point. All problems found are
+// returned in one error, a line each. A nil opts selects the defaults.
+//
+// A partial link with Options.Relocatable makes a relocatable file.
+// References between the inputs are resolved to segment relocations, and
+// undefined symbols and commons are left for the final link.
+func Link(inputs []Input, opts *Options) (*Result, error) {
+	l := &linker{globals: make(map[string]*Symbol), undefIdx: make(map[string]int)}
+	if opts != nil {
+		l.opts = *opts
+	}
+	if l.opts.Relocatable && (l.opts.Strip || len(l.opts.Bases) > 0) {
+		return nil, errors.New("a relocatable output can not be stripped or placed")
+	}
+	l.split = l.opts.SplitID
+	for _, in := range inputs {
+		if in.Xout != nil {
+			l.load(in.Name, in.Xout)
+		} else {
+			l.pull(in)
+		}
+	}
+	if !l.opts.Relocatable {
+		l.checkUndefined()
+	}
+	if err := l.err(); err != nil {
+		return nil, err
+	}
+	if len(l.mods) == 0 {
+		return nil, errors.New("no object file")
+	}
+	l.layout()
+	if err := l.err(); err != nil {
+		return nil, err
+	}
+	l.allocCommons()
+	xf := l.place()
+	if err := l.err(); err != nil {
+		return nil, err
+	}
+	l.build(xf)
+	if err := l.err(); err != nil {
+		return nil, err
+	}
+	return &Result{Xout: xf, Modules: l.mods, Segs: l.segs, Symbs: l.sortedSymbs()}, nil
+}
+
+func (l *linker) errorf(format string, args ...interface{}) {
+	l.errs = append(l.errs, fmt.Sprintf(format, args...))
+}
+
+func (l *linker) err() error {
+	if len(l.errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(l.errs, "\n"))
+}
+
+func (l *linker) lookup(name string) *Symbol {
+	g, ok := l.globals[name]
+	if !ok {
+		g = &Symbol{Name: name, Module: -1, Seg: -1}
+		l.globals[name] = g
+	}
+	return g
+}
+
+func (l *linker) sortedSymbs() []*Symbol {
+	symbs := make([]*Symbol, 0, len(l.globals))
+	for _, g := range l.globals {
+		symbs = append(symbs, g)
+	}
+	sort.Slice(symbs, func(i, j int) bool { return symbs[i].Name < symbs[j].Name })
+	return symbs
+}
+
+/* Load an object file, its globals and references */
+func (l *linker) load(name string, xf *binlib.XoutFile) {
+	if err := check(xf); err != nil {
+		l.errorf("%s: %v", name, err)
+		return
+	}
+	seg := binlib.XoutSegmented(xf.Header.Magic)
+	if len(l.mods) == 0 {
+		l.seg = seg
+	} else if seg != l.seg {
+		l.errorf("%s: segmented and non segmented objects are mixed", name)
+		return
+	}
+	if binlib.XoutSplitID(xf.Header.Magic) {
+		l.split = true
+	}
+	if binlib.XoutSharedText(xf.Header.Magic) {
+		l.shared = true
+	}
+	m := len(l.mods)
+	l.mods = append(l.mods, &Module{Name: name, Xout: xf})
+	for idx, symb := range xf.SymbTbl {
+		symbName := binlib.ConvertName(symb.Name)
+		switch symb.Type {
+		case binlib.XoutSymbGlobal:
+			g := l.lookup(symbName)
+			if g.Module >= 0 {
+				l.errorf("duplicate symbol %s in %s and %s", symbName, l.mods[g.Module].Name, name)
+				continue
+			}
+			g.Module = m
+			g.symb = idx
+		case binlib.XoutSymbUndefEX:
+			g := l.lookup(symbName)
+			g.Refs = append(g.Refs, m)
+			if symb.Value > g.Size {
+				g.Size = symb.Value
+			}
+		}
+	}
+}
+
+/* Load library members which define undefined symbols, until none is left */
+func (l *linker) pull(lib Input) {
+	loaded := make([]bool, len(lib.Members))
+	for changed := true; changed; {
+		changed = false
+		for idx, member := range lib.Members {
+			if loaded[idx] || member.Xout == nil || !l.wanted(member.Xout) {
+				continue
+			}
+			loaded[idx] = true
+			changed = true
+			l.load(lib.Name+"("+member.Name+")", member.Xout)
+		}
+	}
+}
+
+/* Whether an object defines a symbol referenced but not defined, commons excluded */
+func (l *linker) wanted(xf *binlib.XoutFile) bool {
+	for _, symb := range xf.SymbTbl {
+		if symb.Type != binlib.XoutSymbGlobal {
+			continue
+		}
+		g, ok := l.globals[binlib.ConvertName(symb.Name)]
+		if ok && g.Module < 0 && g.Size == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *linker) checkUndefined() {
+	for _, g := range l.sortedSymbs() {
+		if g.Module >= 0 || g.Size != 0 {
+			continue
+		}
+		names := make([]string, len(g.Refs))
+		for idx, m := range g.Refs {
+			names[idx] = l.mods[m].Name
+		}
+		l.errorf("undefined symbol %s referenced in %s", g.Name, strings.Join(names, ", "))
+	}
+}
+
+/* Check an object refers existing segments, symbols and code */
+func check(xf *binlib.XoutFile) error {
+	switch xf.Header.Magic {
+	case binlib.XoutMagicSeg, binlib.XoutMagicNonSeg,
+		binlib.XoutMagicNonSegShared, binlib.XoutMagicNonSegSplit:
+	default:
+		return fmt.Errorf("not a relocatable file, magic 0x%04x", xf.Header.Magic)
+	}
+	if len(xf.SegTbl) >= 0xff {
+		return errors.New("too many segments")
+	}
+	length := 0
+	for _, seg := range xf.SegTbl {
+		if binlib.XoutSegHasData(seg.Type) {
+			length += int(seg.Length)
+		}
+	}
+	if length > len(xf.CodePart) {
+		return errors.New("segments exceed the code part")
+	}
+	for _, symb := range xf.SymbTbl {
+		if symb.SegIdx != 0xff && int(symb.SegIdx) >= len(xf.SegTbl) {
+			return fmt.Errorf("symbol %s in unknown segment", binlib.ConvertName(symb.Name))
+		}
+	}
+	for _, reloc := range xf.RelocTbl {
+		if int(reloc.SegIdx) >= len(xf.SegTbl) {
+			return errors.New("relocation in unknown segment")
+		}
+		if !binlib.XoutSegHasData(xf.SegTbl[reloc.SegIdx].Type) {
+			return errors.New("relocation in BSS or stack segment")
+		}
+		if int(reloc.Location)+relocLen(reloc.Type) > int(xf.SegTbl[reloc.SegIdx].Length) {
+			return errors.New("relocation out of segment")
+		}
+		switch reloc.Type {
+		case binlib.XoutRelocOFF, binlib.XoutRelocSSG, binlib.XoutRelocLSG:
+			if int(reloc.SymbIdx) >= len(xf.SegTbl) {
+				return errors.New("relocation refers unknown segment")
+			}
+		case binlib.XoutRelocXOFF, binlib.XoutRelocXSSG, binlib.XoutRelocXLSG:
+			if int(reloc.SymbIdx) >= len(xf.SymbTbl) {
+				return errors.New("relocation refers unknown symbol")
+			}
+		default:
+			return errors.New("unknown relocation type")
+		}
+	}
+	return nil
+}
+
+/* Length of the relocated field */
+func relocLen(relocType byte) int {
+	if relocType == binlib.XoutRelocLSG || relocType == binlib.XoutRelocXLSG {
+		return 4
+	}
+	return 2
+}
@@ -0,0 +1,404 @@
+package link
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"binlib"
+	"binlib/xouttest"
+)
+
+func mainObj() *binlib.XoutFile {
+	obj := &xouttest.Object{Magic: binlib.XoutMagicNonSeg}
+	obj.Segs = []binlib.XoutSeg{
+		{Number: 0, Type: binlib.XoutSegCODE, Length: 8},
+		{Number: 1, Type: binlib.XoutSegDATA, Length: 4},
+	}
+	obj.Code = []byte{
+		0x00, 0x00, // XOFF to _func
+		0x00, 0x02, // OFF to data + 2
+		0x00, 0x02, // XOFF to _comm + 2
+		0x00, 0x00, // XOFF to ABS
+		0x12, 0x34, 0x56, 0x78,
+	}
+	obj.Relocs = []binlib.XoutRelocItem{
+		{SegIdx: 0, Type: binlib.XoutRelocXOFF, Location: 0, SymbIdx: 1},
+		{SegIdx: 0, Type: binlib.XoutRelocOFF, Location: 2, SymbIdx: 1},
+		{SegIdx: 0, Type: binlib.XoutRelocXOFF, Location: 4, SymbIdx: 2},
+		{SegIdx: 0, Type: binlib.XoutRelocXOFF, Location: 6, SymbIdx: 4},
+	}
+	obj.Symbs = []binlib.XoutSymbEntry{
+		xouttest.Symb(0, binlib.XoutSymbGlobal, 0, "_main"),
+		xouttest.Symb(0xff, binlib.XoutSymbUndefEX, 0, "_func"),
+		xouttest.Symb(0xff, binlib.XoutSymbUndefEX, 4, "_comm"),
+		xouttest.Symb(1, binlib.XoutSymbLocal, 2, "loc"),
+		xouttest.Symb(0xff, binlib.XoutSymbLocal, 0x0100, "ABS"),
+	}
+	return obj.XoutFile()
+}
+
+/* An object with a code segment defining a global, referring another */
+func funcObj(name, ref string) *binlib.XoutFile {
+	obj := &xouttest.Object{Magic: binlib.XoutMagicNonSeg}
+	obj.Segs = []binlib.XoutSeg{{Number: 0, Type: binlib.XoutSegCODE, Length: 2}}
+	obj.Code = []byte{0x00, 0x00}
+	obj.Symbs = []binlib.XoutSymbEntry{xouttest.Symb(0, binlib.XoutSymbGlobal, 0, name)}
+	if ref != "" {
+		obj.Relocs = []binlib.XoutRelocItem{{SegIdx: 0, Type: binlib.XoutRelocXOFF, Location: 0, SymbIdx: 1}}
+		obj.Symbs = append(obj.Symbs, xouttest.Symb(0xff, binlib.XoutSymbUndefEX, 0, ref))
+	}
+	return obj.XoutFile()
+}
+
+func library() Input {
+	return Input{Name: "lib.a", Members: []Input{
+		{Name: "helper.o", Xout: funcObj("_helper", "")},
+		{Name: "func.o", Xout: funcObj("_func", "_helper")},
+		{Name: "unused.o", Xout: funcObj("_unused", "")},
+	}}
+}
+
+func TestLink(t *testing.T) {
+	res, err := Link([]Input{{Name: "main.rel", Xout: mainObj()}, library()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, mod := range res.Modules {
+		names = append(names, mod.Name)
+	}
+	if got := strings.Join(names, " "); got != "main.rel lib.a(func.o) lib.a(helper.o)" {
+		t.Errorf("modules %s", got)
+	}
+
+	xf := res.Xout
+	if xf.Header.Magic != binlib.XoutMagicNonSegX {
+		t.Errorf("magic %04x", xf.Header.Magic)
+	}
+	want := []binlib.XoutSeg{
+		{Number: 0, Type: binlib.XoutSegCODE, Length: 12},
+		{Number: 1, Type: binlib.XoutSegDATA, Length: 4},
+		{Number: 2, Type: binlib.XoutSegBSS, Length: 4},
+	}
+	if len(xf.SegTbl) != len(want) {
+		t.Fatalf("segments %+v", xf.SegTbl)
+	}
+	for idx := range want {
+		if xf.SegTbl[idx] != want[idx] {
+			t.Errorf("segment %d %+v, want %+v", idx, xf.SegTbl[idx], want[idx])
+		}
+	}
+	// code at 0, data at 12, the common at 16
+	xouttest.CheckWords(t, xouttest.Words(xf.CodePart), []uint16{
+		0x0008, 0x000e, 0x0012, 0x0100, 0x000a, 0x0000, 0x1234, 0x5678,
+	})
+	wantRelocs := []binlib.XoutRelocItem{
+		{SegIdx: 0, Type: binlib.XoutRelocOFF, Location: 0, SymbIdx: 0},
+		{SegIdx: 0, Type: binlib.XoutRelocOFF, Location: 2, SymbIdx: 1},
+		{SegIdx: 0, Type: binlib.XoutRelocOFF, Location: 4, SymbIdx: 2},
+		{SegIdx: 0, Type: binlib.XoutRelocOFF, Location: 8, SymbIdx: 0},
+	}
+	if len(xf.RelocTbl) != len(wantRelocs) {
+		t.Fatalf("relocations %+v", xf.RelocTbl)
+	}
+	for idx := range wantRelocs {
+		if xf.RelocTbl[idx] != wantRelocs[idx] {
+			t.Errorf("relocation %d %+v, want %+v", idx, xf.RelocTbl[idx], wantRelocs[idx])
+		}
+	}
+	wantSymbs := []binlib.XoutSymbEntry{
+		xouttest.Symb(0, binlib.XoutSymbGlobal, 0, "_main"),
+		xouttest.Symb(1, binlib.XoutSymbLocal, 2, "loc"),
+		xouttest.Symb(0xff, binlib.XoutSymbLocal, 0x0100, "ABS"),
+		xouttest.Symb(0, binlib.XoutSymbGlobal, 8, "_func"),
+		xouttest.Symb(0, binlib.XoutSymbGlobal, 10, "_helper"),
+		xouttest.Symb(2, binlib.XoutSymbGlobal, 0, "_comm"),
+	}
+	if len(xf.SymbTbl) != len(wantSymbs) {
+		t.Fatalf("symbols %+v", xf.SymbTbl)
+	}
+	for idx := range wantSymbs {
+		if xf.SymbTbl[idx] != wantSymbs[idx] {
+			t.Errorf("symbol %d %+v, want %+v", idx, xf.SymbTbl[idx], wantSymbs[idx])
+		}
+	}
+	if int(xf.Header.CodePartLen) != len(xf.CodePart) || int(xf.Header.SymbsLen) != 12*len(wantSymbs) {
+		t.Errorf("header %+v", xf.Header)
+	}
+}
+
+/* The executable relocated by binlib is the same as linked at the addresses */
+func TestLinkBases(t *testing.T) {
+	inputs := []Input{{Name: "main.rel", Xout: mainObj()}, library()}
+	res, err := Link(inputs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bases := map[byte]uint32{binlib.XoutSegCODE: 0x1000, binlib.XoutSegDATA: 0x2000, binlib.XoutSegBSS: 0x3000}
+	fixed, err := Link(inputs, &Options{Bases: bases})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixed.Xout.RelocTbl) != 0 {
+		t.Error("relocations kept with fixed addresses")
+	}
+	segs, err := res.Xout.Relocate([]uint32{0x1000, 0x2000, 0x3000}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(segs[0].Data, segs[1].Data...), fixed.Xout.CodePart) {
+		t.Errorf("relocated % x, linked % x", append(segs[0].Data, segs[1].Data...), fixed.Xout.CodePart)
+	}
+}
+
+func TestLinkOptions(t *testing.T) {
+	inputs := []Input{{Name: "main.rel", Xout: mainObj()}, library()}
+	res, err := Link(inputs, &Options{Order: []byte{binlib.XoutSegDATA}, SplitID: true, DiscardLocals: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	xf := res.Xout
+	if xf.Header.Magic != binlib.XoutMagicNonSegXSplit {
+		t.Errorf("magic %04x", xf.Header.Magic)
+	}
+	if xf.SegTbl[0].Type != binlib.XoutSegDATA || xf.SegTbl[1].Type != binlib.XoutSegCODE {
+		t.Errorf("segments %+v", xf.SegTbl)
+	}
+	// code and data both start at 0
+	if res.Segs[0].Addr != 0 || res.Segs[1].Addr != 0 || res.Segs[2].Addr != 4 {
+		t.Errorf("addresses %x %x %x", res.Segs[0].Addr, res.Segs[1].Addr, res.Segs[2].Addr)
+	}
+	for _, symb := range xf.SymbTbl {
+		if symb.Type == binlib.XoutSymbLocal {
+			t.Errorf("local symbol %s", binlib.ConvertName(symb.Name))
+		}
+	}
+
+	res, err = Link(inputs, &Options{Strip: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Xout.RelocTbl) != 0 || len(res.Xout.SymbTbl) != 0 {
+		t.Error("symbols or relocations not stripped")
+	}
+}
+
+func TestLinkSegmented(t *testing.T) {
+	first := &xouttest.Object{Magic: binlib.XoutMagicSeg}
+	first.Segs = []binlib.XoutSeg{
+		{Number: 0, Type: binlib.XoutSegCODE, Length: 6},
+		{Number: 1, Type: binlib.XoutSegDATA, Length: 2},
+	}
+	first.Code = []byte{
+		0x80, 0x00, 0x00, 0x00, // LSG to data
+		0x00, 0x01, // XSSG to _second + 1
+		0xab, 0xcd,
+	}
+	first.Relocs = []binlib.XoutRelocItem{
+		{SegIdx: 0, Type: binlib.XoutRelocLSG, Location: 0, SymbIdx: 1},
+		{SegIdx: 0, Type: binlib.XoutRelocXSSG, Location: 4, SymbIdx: 0},
+	}
+	first.Symbs = []binlib.XoutSymbEntry{xouttest.Symb(0xff, binlib.XoutSymbUndefEX, 0, "_second")}
+	second := &xouttest.Object{Magic: binlib.XoutMagicSeg}
+	second.Segs = []binlib.XoutSeg{{Number: 0, Type: binlib.XoutSegDATA, Length: 4}}
+	second.Code = []byte{1, 2, 3, 4}
+	second.Symbs = []binlib.XoutSymbEntry{xouttest.Symb(0, binlib.XoutSymbGlobal, 2, "_second")}
+
+	res, err := Link([]Input{
+		{Name: "first.rel", Xout: first.XoutFile()},
+		{Name: "second.rel", Xout: second.XoutFile()},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xf := res.Xout
+	if xf.Header.Magic != binlib.XoutMagicSegX {
+		t.Errorf("magic %04x", xf.Header.Magic)
+	}
+	// code in <<0>>, data in <<1>>, _second at <<1>>0004
+	xouttest.CheckWords(t, xouttest.Words(xf.CodePart), []uint16{0x8100, 0x0000, 0x0105, 0xabcd, 0x0102, 0x0304})
+	if res.Symbs[0].Addr != 0x010004 {
+		t.Errorf("_second at %06x", res.Symbs[0].Addr)
+	}
+
+	res, err = Link([]Input{
+		{Name: "first.rel", Xout: first.XoutFile()},
+		{Name: "second.rel", Xout: second.XoutFile()},
+	}, &Options{Bases: map[byte]uint32{binlib.XoutSegDATA: 0x050010}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Xout.SegTbl[1].Number != 5 {
+		t.Errorf("data segment number %d", res.Xout.SegTbl[1].Number)
+	}
+	if _, err = Link([]Input{
+		{Name: "first.rel", Xout: first.XoutFile()},
+		{Name: "second.rel", Xout: second.XoutFile()},
+	}, &Options{Bases: map[byte]uint32{binlib.XoutSegDATA: 0x0500ff}}); err == nil {
+		t.Error("no error for a short segmented address out of range")
+	}
+}
+
+func TestLinkErrors(t *testing.T) {
+	exe := mainObj()
+	exe.Header.Magic = binlib.XoutMagicNonSegX
+	seg := funcObj("_seg", "")
+	seg.Header.Magic = binlib.XoutMagicSeg
+	tests := []struct {
+		inputs []Input
+		errs   []string
+	}{
+		{[]Input{{Name: "main.rel", Xout: mainObj()}}, []string{
+			"undefined symbol _func referenced in main.rel",
+		}},
+		{[]Input{
+			{Name: "main.rel", Xout: mainObj()},
+			{Name: "a.rel", Xout: funcObj("_func", "_x")},
+			{Name: "b.rel", Xout: funcObj("_func", "")},
+		}, []string{
+			"duplicate symbol _func in a.rel and b.rel",
+			"undefined symbol _x referenced in a.rel",
+		}},
+		{[]Input{{Name: "main.z8k", Xout: exe}}, []string{
+			"main.z8k: not a relocatable file, magic 0xee03",
+		}},
+		{[]Input{{Name: "main.rel", Xout: mainObj()}, {Name: "seg.rel", Xout: seg}, library()}, []string{
+			"seg.rel: segmented and non segmented objects are mixed",
+		}},
+	}
+	for _, test := range tests {
+		_, err := Link(test.inputs, nil)
+		if err == nil {
+			t.Errorf("no error, want %q", test.errs)
+			continue
+		}
+		if got := strings.Split(err.Error(), "\n"); strings.Join(got, "|") != strings.Join(test.errs, "|") {
+			t.Errorf("errors %q, want %q", got, test.errs)
+		}
+	}
+}
+
+func TestWriteMap(t *testing.T) {
+	res, err := Link([]Input{{Name: "main.rel", Xout: mainObj()}, library()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = res.WriteMap(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `Segments
+    0 : code   Addr = 0000  Size = 0x000c
+          0000  0x0008  main.rel
+          0008  0x0002  lib.a(func.o)
+          000a  0x0002  lib.a(helper.o)
+    1 : data   Addr = 000c  Size = 0x0004
+          000c  0x0004  main.rel
+    2 : bss    Addr = 0010  Size = 0x0004
+          0010  0x0004  common _comm
+
+Symbols
+ 0000  code   _main     main.rel
+ 0008  code   _func     lib.a(func.o)
+ 000a  code   _helper   lib.a(helper.o)
+ 0010  bss    _comm     common
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestPartialLink(t *testing.T) {
+	partial, err := Link([]Input{
+		{Name: "main.rel", Xout: mainObj()},
+		{Name: "func.o", Xout: funcObj("_func", "_helper")},
+	}, &Options{Relocatable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	xf := partial.Xout
+	if xf.Header.Magic != binlib.XoutMagicNonSeg || len(xf.SegTbl) != 2 {
+		t.Fatalf("magic %04x, segments %+v", xf.Header.Magic, xf.SegTbl)
+	}
+	// _func is resolved, the common and _helper are left
+	xouttest.CheckWords(t, xouttest.Words(xf.CodePart), []uint16{0x0008, 0x0002, 0x0002, 0x0100, 0x0000, 0x1234, 0x5678})
+	wantRelocs := []binlib.XoutRelocItem{
+		{SegIdx: 0, Type: binlib.XoutRelocOFF, Location: 0, SymbIdx: 0},
+		{SegIdx: 0, Type: binlib.XoutRelocOFF, Location: 2, SymbIdx: 1},
+		{SegIdx: 0, Type: binlib.XoutRelocXOFF, Location: 4, SymbIdx: 4},
+		{SegIdx: 0, Type: binlib.XoutRelocXOFF, Location: 8, SymbIdx: 5},
+	}
+	if len(xf.RelocTbl) != len(wantRelocs) {
+		t.Fatalf("relocations %+v", xf.RelocTbl)
+	}
+	for idx := range wantRelocs {
+		if xf.RelocTbl[idx] != wantRelocs[idx] {
+			t.Errorf("relocation %d %+v, want %+v", idx, xf.RelocTbl[idx], wantRelocs[idx])
+		}
+	}
+	wantSymbs := []binlib.XoutSymbEntry{
+		xouttest.Symb(0, binlib.XoutSymbGlobal, 0, "_main"),
+		xouttest.Symb(1, binlib.XoutSymbLocal, 2, "loc"),
+		xouttest.Symb(0xff, binlib.XoutSymbLocal, 0x0100, "ABS"),
+		xouttest.Symb(0, binlib.XoutSymbGlobal, 8, "_func"),
+		xouttest.Symb(0xff, binlib.XoutSymbUndefEX, 4, "_comm"),
+		xouttest.Symb(0xff, binlib.XoutSymbUndefEX, 0, "_helper"),
+	}
+	if len(xf.SymbTbl) != len(wantSymbs) {
+		t.Fatalf("symbols %+v", xf.SymbTbl)
+	}
+	for idx := range wantSymbs {
+		if xf.SymbTbl[idx] != wantSymbs[idx] {
+			t.Errorf("symbol %d %+v, want %+v", idx, xf.SymbTbl[idx], wantSymbs[idx])
+		}
+	}
+
+	// linking the partial output makes the same executable
+	data, err := xf.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rxf binlib.XoutFile
+	if err = rxf.Parse(data); err != nil {
+		t.Fatal(err)
+	}
+	final, err := Link([]Input{{Name: "partial.rel", Xout: &rxf}, library()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := Link([]Input{{Name: "main.rel", Xout: mainObj()}, library()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(final.Xout.CodePart, full.Xout.CodePart) {
+		t.Errorf("final % x, full % x", final.Xout.CodePart, full.Xout.CodePart)
+	}
+
+	if _, err = Link([]Input{{Name: "main.rel", Xout: mainObj()}}, &Options{Relocatable: true, Strip: true}); err == nil {
+		t.Error("no error for a stripped relocatable output")
+	}
+}
+
+func TestLinkShared(t *testing.T) {
+	shared := funcObj("_func", "")
+	shared.Header.Magic = binlib.XoutMagicNonSegShared
+	tests := []struct {
+		opts  Options
+		magic uint16
+	}{
+		{Options{}, binlib.XoutMagicNonSegXShared},
+		{Options{Relocatable: true}, binlib.XoutMagicNonSegShared},
+		{Options{SplitID: true}, binlib.XoutMagicNonSegXSplit},
+	}
+	for _, test := range tests {
+		res, err := Link([]Input{{Name: "main.rel", Xout: funcObj("_main", "_func")},
+			{Name: "func.rel", Xout: shared}}, &test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if magic := res.Xout.Header.Magic; magic != test.magic {
+			t.Errorf("%+v: magic %04x, want %04x", test.opts, magic, test.magic)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ *  map.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  A link map, where the modules and the global symbols are placed
+ */
+
+package link
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+
+	"binlib"
+)
+
+// FormatAddr formats an address, 24 bits for segmented images.
+func (r *Result) FormatAddr(addr uint32) string {
+	if binlib.XoutSegmented(r.Xout.Header.Magic) {
+		return fmt.Sprintf("%06x", addr)
+	}
+	return fmt.Sprintf("%04x", addr)
+}
+
+// WriteMap writes the segments with the modules placed in them, and the
+// global symbols sorted by address.
+func (r *Result) WriteMap(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "Segments")
+	for idx, seg := range r.Segs {
+		fmt.Fprintf(bw, " %4d : %-5s  Addr = %s  Size = 0x%04x\n",
+			idx, binlib.XoutSegName(seg.Type), r.FormatAddr(seg.Addr), seg.Length)
+		for _, part := range seg.Parts {
+			fmt.Fprintf(bw, "          %s%s 0x%04x  %s\n",
+				r.FormatAddr(part.Addr), guess(part.Guess), part.Length, r.Modules[part.Module].Name)
+		}
+		for _, symb := range r.Symbs {
+			if symb.Module < 0 && symb.Seg == idx {
+				fmt.Fprintf(bw, "          %s%s 0x%04x  common %s\n",
+					r.FormatAddr(symb.Addr), guess(symb.Guess), symb.Size, symb.Name)
+			}
+		}
+	}
+	fmt.Fprintln(bw)
+
+	fmt.Fprintln(bw, "Symbols")
+	for _, symb := range r.SymbsByAddr() {
+		fmt.Fprintf(bw, " %s%s %-5s  %-8s  %s\n", r.FormatAddr(symb.Addr), guess(symb.Guess),
+			r.segName(symb), symb.Name, r.moduleName(symb))
+	}
+	return bw.Flush()
+}
+
+/* Addresses not confirmed by SetAddrs are marked */
+func guess(g bool) string {
+	if g {
+		return "?"
+	}
+	return " "
+}
+
+func (r *Result) segName(symb *Symbol) string {
+	if symb.Seg < 0 && symb.Module < 0 {
+		return "undef"
+	}
+	if symb.Seg < 0 {
+		return "abs"
+	}
+	return binlib.XoutSegName(r.Segs[symb.Seg].Type)
+}
+
+func (r *Result) moduleName(symb *Symbol) string {
+	if symb.Module < 0 && symb.Seg < 0 {
+		return "undefined"
+	}
+	if symb.Module < 0 {
+		return "common"
+	}
+	return r.Modules[symb.Module].Name
+}
+
+// SymbsByAddr returns the global symbols sorted by address, absolute
+// symbols last.
+func (r *Result) SymbsByAddr() []*Symbol {
+	symbs := append([]*Symbol(nil), r.Symbs...)
+	sort.SliceStable(symbs, func(i, j int) bool {
+		if (symbs[i].Seg < 0) != (symbs[j].Seg < 0) {
+			return symbs[j].Seg < 0
+		}
+		return symbs[i].Addr < symbs[j].Addr
+	})
+	return symbs
+}
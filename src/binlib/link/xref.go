@@ -0,0 +1,146 @@
+/*
+ *  xref.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  A cross reference of the global symbols, and a report for JSON
+ */
+
+package link
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"binlib"
+)
+
+// SetAddrs moves the modules and the global symbols to the addresses in
+// addrs, such as the global symbols of an executable linked by GNU ld.
+// A module's segment is placed by a global symbol defined in it. Parts
+// and symbols not found keep the addresses of the link, marked as guesses.
+func (r *Result) SetAddrs(addrs map[string]uint32) {
+	for _, symb := range r.Symbs {
+		addr, ok := addrs[symb.Name]
+		if ok {
+			symb.Addr = addr
+		}
+		symb.Guess = !ok
+	}
+	for _, seg := range r.Segs {
+		found := false
+		for idx := range seg.Parts {
+			part := &seg.Parts[idx]
+			part.Guess = true
+			for _, symb := range r.Modules[part.Module].Xout.SymbTbl {
+				if symb.Type != binlib.XoutSymbGlobal || int(symb.SegIdx) != part.Seg {
+					continue
+				}
+				if addr, ok := addrs[binlib.ConvertName(symb.Name)]; ok {
+					part.Addr = addr - uint32(symb.Value)
+					part.Guess = false
+					break
+				}
+			}
+			if !part.Guess && (!found || part.Addr < seg.Addr) {
+				seg.Addr = part.Addr
+				found = true
+			}
+		}
+	}
+}
+
+// WriteXref writes the global symbols sorted by name, with the defining
+// module and the referencing modules.
+func (r *Result) WriteXref(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "Cross reference")
+	for _, symb := range r.Symbs {
+		line := fmt.Sprintf(" %-8s  %s%s %-16s  %s", symb.Name, r.FormatAddr(symb.Addr), guess(symb.Guess),
+			r.moduleName(symb), strings.Join(r.refNames(symb), " "))
+		fmt.Fprintln(bw, strings.TrimRight(line, " "))
+	}
+	return bw.Flush()
+}
+
+func (r *Result) refNames(symb *Symbol) []string {
+	names := make([]string, len(symb.Refs))
+	for idx, m := range symb.Refs {
+		names[idx] = r.Modules[m].Name
+	}
+	return names
+}
+
+// Report is the map and the cross reference for encoding/json.
+type Report struct {
+	Segments []ReportSeg  `json:"segments"`
+	Symbols  []ReportSymb `json:"symbols"`
+}
+
+type ReportSeg struct {
+	Index   int          `json:"index"`
+	Type    string       `json:"type"`
+	Addr    uint32       `json:"addr"`
+	Length  uint32       `json:"length"`
+	Modules []ReportPart `json:"modules"`
+}
+
+type ReportPart struct {
+	Module string `json:"module"`
+	Addr   uint32 `json:"addr"`
+	Length uint32 `json:"length"`
+	Guess  bool   `json:"guess,omitempty"`
+}
+
+type ReportSymb struct {
+	Name    string   `json:"name"`
+	Addr    uint32   `json:"addr"`
+	Segment string   `json:"segment"`
+	Module  string   `json:"module"`
+	Common  uint16   `json:"common,omitempty"`
+	Refs    []string `json:"refs"`
+	Guess   bool     `json:"guess,omitempty"`
+}
+
+// Report returns the map and the cross reference, symbols sorted by name.
+func (r *Result) Report() *Report {
+	rep := &Report{Segments: []ReportSeg{}, Symbols: []ReportSymb{}}
+	for idx, seg := range r.Segs {
+		rseg := ReportSeg{
+			Index:   idx,
+			Type:    binlib.XoutSegName(seg.Type),
+			Addr:    seg.Addr,
+			Length:  seg.Length,
+			Modules: []ReportPart{},
+		}
+		for _, part := range seg.Parts {
+			rseg.Modules = append(rseg.Modules, ReportPart{
+				Module: r.Modules[part.Module].Name,
+				Addr:   part.Addr,
+				Length: part.Length,
+				Guess:  part.Guess,
+			})
+		}
+		rep.Segments = append(rep.Segments, rseg)
+	}
+	for _, symb := range r.Symbs {
+		common := uint16(0)
+		if symb.Module < 0 {
+			common = symb.Size
+		}
+		rep.Symbols = append(rep.Symbols, ReportSymb{
+			Name:    symb.Name,
+			Addr:    symb.Addr,
+			Segment: r.segName(symb),
+			Module:  r.moduleName(symb),
+			Common:  common,
+			Refs:    r.refNames(symb),
+			Guess:   symb.Guess,
+		})
+	}
+	return rep
+}
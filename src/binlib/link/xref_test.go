@@ -0,0 +1,84 @@
+package link
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestWriteXref(t *testing.T) {
+	res, err := Link([]Input{{Name: "main.rel", Xout: mainObj()}, library()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = res.WriteXref(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `Cross reference
+ _comm     0010  common            main.rel
+ _func     0008  lib.a(func.o)     main.rel
+ _helper   000a  lib.a(helper.o)   lib.a(func.o)
+ _main     0000  main.rel
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestSetAddrs(t *testing.T) {
+	res, err := Link([]Input{{Name: "main.rel", Xout: mainObj()}, library()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.SetAddrs(map[string]uint32{"_main": 0x100, "_func": 0x120, "_comm": 0x300})
+	code := res.Segs[0]
+	if code.Addr != 0x100 {
+		t.Errorf("code at %04x", code.Addr)
+	}
+	if code.Parts[1].Addr != 0x120 || code.Parts[1].Guess {
+		t.Errorf("func.o at %04x", code.Parts[1].Addr)
+	}
+	if !code.Parts[2].Guess {
+		t.Error("helper.o placed without a symbol")
+	}
+	for _, symb := range res.Symbs {
+		if symb.Guess != (symb.Name == "_helper") {
+			t.Errorf("%s guess %v", symb.Name, symb.Guess)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = res.WriteMap(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("000a? 0x0002  lib.a(helper.o)")) {
+		t.Errorf("guess not marked\n%s", buf.String())
+	}
+}
+
+func TestReport(t *testing.T) {
+	res, err := Link([]Input{{Name: "main.rel", Xout: mainObj()}, library()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(res.Report())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rep Report
+	if err = json.Unmarshal(data, &rep); err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Segments) != 3 || rep.Segments[0].Type != "code" || len(rep.Segments[0].Modules) != 3 {
+		t.Errorf("segments %+v", rep.Segments)
+	}
+	comm := rep.Symbols[0]
+	if comm.Name != "_comm" || comm.Addr != 0x10 || comm.Segment != "bss" || comm.Module != "common" ||
+		comm.Common != 4 || len(comm.Refs) != 1 || comm.Refs[0] != "main.rel" {
+		t.Errorf("common %+v", comm)
+	}
+	if !bytes.Contains(data, []byte(`"refs":[]`)) {
+		t.Errorf("no empty refs in %s", data)
+	}
+}
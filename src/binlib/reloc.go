@@ -0,0 +1,233 @@
+/*
+ *  reloc.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Placing XOUT segments in memory and applying relocations
+ */
+
+package binlib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/*
+ * Addresses are 24 bits, a segmented address <<s>>offset is s<<16 | offset,
+ * a non segmented address is a 16 bit offset.
+ */
+func XoutAddrSeg(addr uint32) uint16 { return uint16(addr>>16) & 0x7f }
+func XoutAddrOff(addr uint32) uint16 { return uint16(addr) }
+
+func XoutSegmented(magic uint16) bool {
+	return magic == XoutMagicSeg || magic == XoutMagicSegX
+}
+
+func XoutExecutable(magic uint16) bool {
+	switch magic {
+	case XoutMagicSegX, XoutMagicNonSegX, XoutMagicNonSegXShared, XoutMagicNonSegXSplit:
+		return true
+	}
+	return false
+}
+
+func XoutSplitID(magic uint16) bool {
+	return magic == XoutMagicNonSegSplit || magic == XoutMagicNonSegXSplit
+}
+
+func XoutSharedText(magic uint16) bool {
+	return magic == XoutMagicNonSegShared || magic == XoutMagicNonSegXShared
+}
+
+// XoutModel describes the memory model of a magic
+func XoutModel(magic uint16) string {
+	switch magic {
+	case XoutMagicSeg:
+		return "segmented, relocatable"
+	case XoutMagicSegX:
+		return "segmented, executable, each segment at its number"
+	case XoutMagicNonSeg:
+		return "non-segmented, relocatable"
+	case XoutMagicNonSegX:
+		return "non-segmented, executable, code and data in one 64K space"
+	case XoutMagicNonSegShared:
+		return "non-segmented, relocatable, shared text"
+	case XoutMagicNonSegXShared:
+		return "non-segmented, executable, shared read-only code followed by data"
+	case XoutMagicNonSegSplit:
+		return "non-segmented, relocatable, split I/D"
+	case XoutMagicNonSegXSplit:
+		return "non-segmented, executable, split I/D, code and data in separate 64K spaces"
+	}
+	return "unknown"
+}
+
+// XoutLoadSeg is a segment placed in memory.
+type XoutLoadSeg struct {
+	Index int    /* index in the segment table */
+	Type  byte   /* segment type */
+	Addr  uint32 /* 24 bit address */
+	Data  []byte /* contents, zeros for BSS and STACK */
+}
+
+// DefaultBases returns the default addresses of the segments. Segmented
+// segments start at offset 0 of their segment number, non segmented ones
+// follow each other from 0 in the table order, code and data are in
+// separate spaces for split I/D.
+func (xf *XoutFile) DefaultBases() []uint32 {
+	bases := make([]uint32, len(xf.SegTbl))
+	var next [2]uint32
+	for idx, seg := range xf.SegTbl {
+		if XoutSegmented(xf.Header.Magic) {
+			bases[idx] = uint32(seg.Number&0x7f) << 16
+			continue
+		}
+		space := 0
+		if XoutSplitID(xf.Header.Magic) && seg.Type != XoutSegCODE {
+			space = 1
+		}
+		bases[idx] = next[space]
+		next[space] += (uint32(seg.Length) + 1) &^ 1
+	}
+	return bases
+}
+
+// LinkedBases returns the addresses the words in the code part are relative
+// to. Relocatable files hold offsets from their segments, executables are
+// linked at the default addresses.
+func (xf *XoutFile) LinkedBases() []uint32 {
+	if XoutExecutable(xf.Header.Magic) {
+		return xf.DefaultBases()
+	}
+	return make([]uint32, len(xf.SegTbl))
+}
+
+/* Address of a symbol at the placed and at the linked addresses */
+func (xf *XoutFile) symbAddr(bases, linked []uint32, symbs map[string]uint32, idx uint16) (uint32, uint32, error) {
+	if int(idx) >= len(xf.SymbTbl) {
+		return 0, 0, fmt.Errorf("No symbol %d", idx)
+	}
+	symb := xf.SymbTbl[idx]
+	name := ConvertName(symb.Name)
+	var addr, from uint32
+	switch {
+	case symb.Type == XoutSymbUndefEX:
+		var ok bool
+		if addr, ok = symbs[name]; !ok {
+			return 0, 0, fmt.Errorf("Undefined symbol %s", name)
+		}
+	case symb.SegIdx == 0xff:
+		addr, from = uint32(symb.Value), uint32(symb.Value)
+	case int(symb.SegIdx) >= len(xf.SegTbl):
+		return 0, 0, fmt.Errorf("Symbol %s in no segment", name)
+	default:
+		addr = bases[symb.SegIdx] + uint32(symb.Value)
+		from = linked[symb.SegIdx] + uint32(symb.Value)
+	}
+	if !XoutExecutable(xf.Header.Magic) {
+		// relocatable words hold the offset from the symbol
+		from = 0
+	}
+	return addr, from, nil
+}
+
+func (xf *XoutFile) segData(seg int) ([]byte, error) {
+	length := int(xf.SegTbl[seg].Length)
+	if !XoutSegHasData(xf.SegTbl[seg].Type) {
+		return make([]byte, length), nil
+	}
+	pos, err := xf.SegPos(seg)
+	if err != nil {
+		return nil, err
+	}
+	if xf.CodePart != nil {
+		return append([]byte{}, xf.CodePart[pos:pos+int64(length)]...), nil
+	}
+	sr, err := xf.SegReader(seg)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if _, err = io.ReadFull(sr, data); err != nil {
+		return nil, fmt.Errorf("Segment %d read error", seg)
+	}
+	return data, nil
+}
+
+// Relocate places the segments at bases, the default addresses if nil, and
+// applies the relocations. Undefined externals are resolved with symbs,
+// which maps names to addresses. The file is not modified.
+func (xf *XoutFile) Relocate(bases []uint32, symbs map[string]uint32) ([]XoutLoadSeg, error) {
+	if bases == nil {
+		bases = xf.DefaultBases()
+	}
+	if len(bases) != len(xf.SegTbl) {
+		return nil, fmt.Errorf("%d addresses for %d segments", len(bases), len(xf.SegTbl))
+	}
+	segs := make([]XoutLoadSeg, len(xf.SegTbl))
+	for idx, seg := range xf.SegTbl {
+		data, err := xf.segData(idx)
+		if err != nil {
+			return nil, err
+		}
+		segs[idx] = XoutLoadSeg{Index: idx, Type: seg.Type, Addr: bases[idx], Data: data}
+	}
+
+	linked := xf.LinkedBases()
+	for _, reloc := range xf.RelocTbl {
+		if int(reloc.SegIdx) >= len(segs) {
+			return nil, fmt.Errorf("Relocation in no segment %d", reloc.SegIdx)
+		}
+		data := segs[reloc.SegIdx].Data
+		loc := int(reloc.Location)
+		size := 2
+		if reloc.Type == XoutRelocLSG || reloc.Type == XoutRelocXLSG {
+			size = 4
+		}
+		if loc+size > len(data) || !XoutSegHasData(xf.SegTbl[reloc.SegIdx].Type) {
+			return nil, fmt.Errorf("Relocation at %d:%04x out of segment", reloc.SegIdx, reloc.Location)
+		}
+
+		// the target address at the placed and at the linked address
+		var addr, from uint32
+		switch reloc.Type {
+		case XoutRelocOFF, XoutRelocSSG, XoutRelocLSG:
+			if int(reloc.SymbIdx) >= len(xf.SegTbl) {
+				return nil, fmt.Errorf("Relocation at %d:%04x refers no segment", reloc.SegIdx, reloc.Location)
+			}
+			addr, from = bases[reloc.SymbIdx], linked[reloc.SymbIdx]
+		case XoutRelocXOFF, XoutRelocXSSG, XoutRelocXLSG:
+			var err error
+			addr, from, err = xf.symbAddr(bases, linked, symbs, reloc.SymbIdx)
+			if err != nil {
+				return nil, fmt.Errorf("Relocation at %d:%04x: %v", reloc.SegIdx, reloc.Location, err)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown relocation type %d", reloc.Type)
+		}
+		delta := XoutAddrOff(addr) - XoutAddrOff(from)
+
+		switch reloc.Type {
+		case XoutRelocOFF, XoutRelocXOFF:
+			word := binary.BigEndian.Uint16(data[loc:])
+			binary.BigEndian.PutUint16(data[loc:], word+delta)
+		case XoutRelocSSG, XoutRelocXSSG:
+			word := binary.BigEndian.Uint16(data[loc:])
+			off := word&0xff + delta
+			if off > 0xff {
+				return nil, fmt.Errorf("Short segmented address at %d:%04x out of range",
+					reloc.SegIdx, reloc.Location)
+			}
+			binary.BigEndian.PutUint16(data[loc:], XoutAddrSeg(addr)<<8|off)
+		case XoutRelocLSG, XoutRelocXLSG:
+			word := binary.BigEndian.Uint16(data[loc+2:])
+			binary.BigEndian.PutUint16(data[loc:], 0x8000|XoutAddrSeg(addr)<<8)
+			binary.BigEndian.PutUint16(data[loc+2:], word+delta)
+		}
+	}
+	return segs, nil
+}
@@ -0,0 +1,150 @@
+package binlib_test
+
+import (
+	"testing"
+
+	"binlib"
+	"binlib/xouttest"
+)
+
+func object(magic uint16) *binlib.XoutFile {
+	obj := &xouttest.Object{Magic: magic}
+	obj.Segs = []binlib.XoutSeg{
+		{Number: 3, Type: binlib.XoutSegCODE, Length: 12},
+		{Number: 5, Type: binlib.XoutSegDATA, Length: 4},
+		{Number: 6, Type: binlib.XoutSegBSS, Length: 6},
+	}
+	obj.Code = []byte{
+		0x00, 0x02, // OFF to data + 2
+		0x00, 0x01, // XOFF to _glob + 1
+		0x00, 0x04, // SSG to bss + 4
+		0x80, 0x00, 0x00, 0x02, // LSG to data + 2
+		0x00, 0x00, // XOFF to ABS
+		0x00, 0x00, 0x12, 0x34,
+	}
+	obj.Relocs = []binlib.XoutRelocItem{
+		{SegIdx: 0, Type: binlib.XoutRelocOFF, Location: 0, SymbIdx: 1},
+		{SegIdx: 0, Type: binlib.XoutRelocXOFF, Location: 2, SymbIdx: 0},
+		{SegIdx: 0, Type: binlib.XoutRelocSSG, Location: 4, SymbIdx: 2},
+		{SegIdx: 0, Type: binlib.XoutRelocLSG, Location: 6, SymbIdx: 1},
+		{SegIdx: 0, Type: binlib.XoutRelocXOFF, Location: 10, SymbIdx: 1},
+		{SegIdx: 1, Type: binlib.XoutRelocOFF, Location: 0, SymbIdx: 0},
+	}
+	obj.Symbs = []binlib.XoutSymbEntry{
+		xouttest.Symb(1, binlib.XoutSymbGlobal, 2, "_glob"),
+		xouttest.Symb(0xff, binlib.XoutSymbLocal, 0x0100, "ABS"),
+	}
+	return obj.XoutFile()
+}
+
+/* Relocate the object and join the segments with contents */
+func relocate(xf *binlib.XoutFile, bases []uint32, symbs map[string]uint32) ([]byte, error) {
+	segs, err := xf.Relocate(bases, symbs)
+	if err != nil {
+		return nil, err
+	}
+	var code []byte
+	for _, seg := range segs {
+		if binlib.XoutSegHasData(seg.Type) {
+			code = append(code, seg.Data...)
+		}
+	}
+	return code, nil
+}
+
+func TestRelocateNonSeg(t *testing.T) {
+	xf := object(binlib.XoutMagicNonSeg)
+	bases := xf.DefaultBases()
+	if bases[0] != 0 || bases[1] != 12 || bases[2] != 16 {
+		t.Fatalf("default bases %x", bases)
+	}
+	bases[0], bases[1], bases[2] = 0x1000, 0x2000, 0x0010
+	code, err := relocate(xf, bases, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xouttest.CheckWords(t, xouttest.Words(code), []uint16{0x2002, 0x2003, 0x0014, 0x8000, 0x2002, 0x0100, 0x1000, 0x1234})
+}
+
+func TestRelocateSeg(t *testing.T) {
+	xf := object(binlib.XoutMagicSeg)
+	bases := xf.DefaultBases()
+	if bases[0] != 0x030000 || bases[1] != 0x050000 || bases[2] != 0x060000 {
+		t.Fatalf("default bases %x", bases)
+	}
+	bases[1] = 0x050100
+	code, err := relocate(xf, bases, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xouttest.CheckWords(t, xouttest.Words(code), []uint16{0x0102, 0x0103, 0x0604, 0x8500, 0x0102, 0x0100, 0x0000, 0x1234})
+
+	// a short segmented offset has 8 bits
+	bases[2] = 0x0600fe
+	if _, err = relocate(xf, bases, nil); err == nil {
+		t.Error("no error for a short offset out of range")
+	}
+}
+
+func TestRelocateExecutable(t *testing.T) {
+	xf := object(binlib.XoutMagicNonSegX)
+	// linked at the default addresses, the words hold them
+	copy(xf.CodePart, []byte{0x00, 0x0e, 0x00, 0x0f})
+	bases := xf.DefaultBases()
+	code, err := relocate(xf, bases, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xouttest.CheckWords(t, xouttest.Words(code[:4]), []uint16{0x000e, 0x000f})
+
+	bases[0], bases[1] = 0x1000, 0x2000
+	if code, err = relocate(xf, bases, nil); err != nil {
+		t.Fatal(err)
+	}
+	xouttest.CheckWords(t, xouttest.Words(code[:4]), []uint16{0x2002, 0x2003})
+}
+
+func TestUndefinedSymbol(t *testing.T) {
+	xf := object(binlib.XoutMagicNonSeg)
+	xf.SymbTbl[0] = xouttest.Symb(0xff, binlib.XoutSymbUndefEX, 0, "_glob")
+	if _, err := relocate(xf, nil, nil); err == nil {
+		t.Error("no error for an undefined symbol")
+	}
+	code, err := relocate(xf, nil, map[string]uint32{"_glob": 0x4000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	xouttest.CheckWords(t, xouttest.Words(code[:4]), []uint16{0x000e, 0x4001})
+}
+
+func TestRelocateSegments(t *testing.T) {
+	xf := object(binlib.XoutMagicNonSeg)
+	segs, err := xf.Relocate(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != 3 {
+		t.Fatalf("%d segments", len(segs))
+	}
+	bss := segs[2]
+	if bss.Index != 2 || bss.Type != binlib.XoutSegBSS || bss.Addr != 16 || len(bss.Data) != 6 {
+		t.Errorf("bss segment %+v", bss)
+	}
+	if _, err = xf.Relocate([]uint32{0}, nil); err == nil {
+		t.Error("no error for too few addresses")
+	}
+	if xf.CodePart[1] != 0x02 {
+		t.Error("code part modified")
+	}
+}
+
+func TestMemoryModel(t *testing.T) {
+	xf := object(0xee06)
+	if !binlib.XoutSharedText(xf.Header.Magic) || binlib.XoutExecutable(xf.Header.Magic) ||
+		binlib.XoutModel(xf.Header.Magic) != "non-segmented, relocatable, shared text" {
+		t.Errorf("0xee06: %s", binlib.XoutModel(xf.Header.Magic))
+	}
+	if !binlib.XoutSharedText(0xee07) || binlib.XoutSharedText(0x0006) || binlib.XoutModel(0x0006) != "unknown" {
+		t.Error("shared text by the magic")
+	}
+}
@@ -5,7 +5,7 @@
  *  Released under the MIT license.
  *  See LICENSE.
  *
- *  A packge to import XOUT file.
+ *  A packge to import and export XOUT file.
  */
 
 package binlib
@@ -14,6 +14,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 )
 
@@ -27,7 +29,7 @@ const XoutMagicSeg = 0xee00           /* segmented, non executable */
 const XoutMagicSegX = 0xee01          /* segmented, executable */
 const XoutMagicNonSeg = 0xee02        /* non segmented, non executable */
 const XoutMagicNonSegX = 0xee03       /* non segmented, executable not, shared*/
-const XoutMagicNonSegShared = 0x0006  /* non segmented, non executable, shared */
+const XoutMagicNonSegShared = 0xee06  /* non segmented, non executable, shared */
 const XoutMagicNonSegXShared = 0xee07 /* non segmented, executable, shared */
 const XoutMagicNonSegSplit = 0xee0a   /* non segmented, non executable, split ID */
 const XoutMagicNonSegXSplit = 0xee0b  /* non segmented, executable, split ID */
@@ -41,6 +43,31 @@ const XoutSegCDMIX = byte(6)   /* mixed code and data, not protectable */
 const XoutSegCDMIX_P = byte(7) /* mixed code and data, protectable */
 const XoutSegUNDEF = byte(0)   /* linker assign the address */
 
+// XoutSegHasData reports whether contents of the segment are in the code part
+func XoutSegHasData(segType byte) bool {
+	return segType != XoutSegBSS && segType != XoutSegSTACK
+}
+
+var xoutSegNames = []string{"undef", "bss", "stack", "code", "const", "data", "mix", "mixp"}
+
+// XoutSegName returns a short name of the segment type, such as "code"
+func XoutSegName(segType byte) string {
+	if int(segType) < len(xoutSegNames) {
+		return xoutSegNames[segType]
+	}
+	return fmt.Sprintf("type%d", segType)
+}
+
+// XoutSegType returns the segment type of a name given by XoutSegName
+func XoutSegType(name string) (byte, bool) {
+	for segType, segName := range xoutSegNames {
+		if name == segName {
+			return byte(segType), true
+		}
+	}
+	return 0, false
+}
+
 const XoutRelocOFF = byte(1)  /* 16bit non segmented   */
 const XoutRelocSSG = byte(2)  /* 16bit short segmented */
 const XoutRelocLSG = byte(3)  /* 32bit long segmented  */
@@ -54,7 +81,7 @@ const XoutSymbGlobal = byte(3)  /* global definition */
 const XoutSymbSeg = byte(4)     /* segment name */
 
 type XoutFile struct {
-	Filep       *os.File
+	Filep       io.ReadSeeker
 	Length      int64
 	CodePos     int64
 	RelocTblPos int64
@@ -99,15 +126,46 @@ type XoutSymbEntry struct {
 
 func (xf *XoutFile) ReadHdr() error {
 	xf.Filep.Seek(0, 0)
-	err := binary.Read(xf.Filep, binary.BigEndian, &xf.Header)
+	head := make([]byte, XoutHdrLen)
+	n, err := io.ReadFull(xf.Filep, head)
+	// tell other kinds of files before the short header
+	if n < 2 || !XoutMagicValid(binary.BigEndian.Uint16(head)) {
+		return CheckKind(head[:n], KindXoutObject, KindXoutExec)
+	}
 	if err != nil {
 		return err
 	}
-	xf.CodePos = int64(XoutHdrLen + XoutSegEntryLen*xf.Header.NumSegs)
+	binary.Read(bytes.NewReader(head), binary.BigEndian, &xf.Header)
+	xf.CodePos = XoutHdrLen + XoutSegEntryLen*int64(xf.Header.NumSegs)
 	xf.RelocTblPos = xf.CodePos + int64(xf.Header.CodePartLen)
 	xf.SymbTblPos = xf.RelocTblPos + int64(xf.Header.RelocsLen)
 	xf.NumRelocs = int(xf.Header.RelocsLen / XoutRelocItemLen)
 	xf.NumSymbs = int(xf.Header.SymbsLen / XoutSymbEntryLen)
+	return xf.checkHdr()
+}
+
+/* Check the sizes in the header against the file size before allocating */
+func (xf *XoutFile) checkHdr() error {
+	hdr := &xf.Header
+	if hdr.NumSegs < 0 {
+		return fmt.Errorf("Negative number of segments %d", hdr.NumSegs)
+	}
+	if xf.CodePos > xf.Length {
+		return fmt.Errorf("Segment table of %d entries exceeds the file size %d",
+			hdr.NumSegs, xf.Length)
+	}
+	if hdr.CodePartLen < 0 || xf.RelocTblPos > xf.Length {
+		return fmt.Errorf("Code part of %d bytes at 0x%04x exceeds the file size %d",
+			hdr.CodePartLen, xf.CodePos, xf.Length)
+	}
+	if hdr.RelocsLen < 0 || xf.SymbTblPos > xf.Length {
+		return fmt.Errorf("Relocation table of %d bytes at 0x%04x exceeds the file size %d",
+			hdr.RelocsLen, xf.RelocTblPos, xf.Length)
+	}
+	if hdr.SymbsLen < 0 || xf.SymbTblPos+int64(hdr.SymbsLen) > xf.Length {
+		return fmt.Errorf("Symbol table of %d bytes at 0x%04x exceeds the file size %d",
+			hdr.SymbsLen, xf.SymbTblPos, xf.Length)
+	}
 	return nil
 }
 
@@ -130,7 +188,6 @@ func (xf *XoutFile) ReadCodePart() error {
 	if err != nil {
 		return errors.New("Code part read error")
 	}
-	bytes.NewBuffer(xf.CodePart)
 	return nil
 }
 
@@ -172,22 +229,47 @@ func (xf *XoutFile) ReadSymbTbl() error {
 }
 
 func (xf *XoutFile) Read(file *os.File) error {
-	xf.Filep = file
 	xoutinfo, err := file.Stat()
 	if err != nil {
 		return errors.New("can not get file status")
 	}
-	xf.Length = xoutinfo.Size()
-	res := xf.ReadHdr()
+	return xf.read(file, xoutinfo.Size())
+}
+
+// Parse reads an XOUT file image in memory.
+func (xf *XoutFile) Parse(data []byte) error {
+	return xf.read(bytes.NewReader(data), int64(len(data)))
+}
+
+func (xf *XoutFile) read(r io.ReadSeeker, length int64) error {
+	res := xf.readTables(r, length)
 	if res != nil {
 		return res
 	}
-	res = xf.ReadSegTbl()
+	xf.CodePart = make([]byte, xf.Header.CodePartLen)
+	return xf.ReadCodePart()
+}
+
+// ReadTables reads the file except the code part, which can be read by
+// segments with SegReader.
+func (xf *XoutFile) ReadTables(file *os.File) error {
+	xoutinfo, err := file.Stat()
+	if err != nil {
+		return errors.New("can not get file status")
+	}
+	xf.CodePart = nil
+	return xf.readTables(file, xoutinfo.Size())
+}
+
+func (xf *XoutFile) readTables(r io.ReadSeeker, length int64) error {
+	xf.Filep = r
+	xf.Length = length
+	xf.SegTbl = nil
+	res := xf.ReadHdr()
 	if res != nil {
 		return res
 	}
-	xf.CodePart = make([]byte, xf.Header.CodePartLen)
-	res = xf.ReadCodePart()
+	res = xf.ReadSegTbl()
 	if res != nil {
 		return res
 	}
@@ -204,6 +286,85 @@ func (xf *XoutFile) Read(file *os.File) error {
 	return nil
 }
 
+// SegPos returns the position of a segment's contents in the code part.
+func (xf *XoutFile) SegPos(seg int) (int64, error) {
+	if seg < 0 || seg >= len(xf.SegTbl) {
+		return 0, fmt.Errorf("No segment %d", seg)
+	}
+	if !XoutSegHasData(xf.SegTbl[seg].Type) {
+		return 0, fmt.Errorf("Segment %d has no contents", seg)
+	}
+	pos := int64(0)
+	for idx := 0; idx < seg; idx++ {
+		if XoutSegHasData(xf.SegTbl[idx].Type) {
+			pos += int64(xf.SegTbl[idx].Length)
+		}
+	}
+	if pos+int64(xf.SegTbl[seg].Length) > int64(xf.Header.CodePartLen) {
+		return 0, fmt.Errorf("Segment %d exceeds the code part", seg)
+	}
+	return pos, nil
+}
+
+// SegReader returns a reader of a segment's contents in the file, so that
+// large segments need not be held in memory.
+func (xf *XoutFile) SegReader(seg int) (*io.SectionReader, error) {
+	pos, err := xf.SegPos(seg)
+	if err != nil {
+		return nil, err
+	}
+	ra, ok := xf.Filep.(io.ReaderAt)
+	if !ok {
+		return nil, errors.New("File can not be read at random")
+	}
+	return io.NewSectionReader(ra, xf.CodePos+pos, int64(xf.SegTbl[seg].Length)), nil
+}
+
+// Layout sets the header and the file positions from the tables.
+func (xf *XoutFile) Layout() {
+	xf.Header.NumSegs = int16(len(xf.SegTbl))
+	xf.Header.CodePartLen = int32(len(xf.CodePart))
+	xf.Header.RelocsLen = int32(len(xf.RelocTbl) * XoutRelocItemLen)
+	xf.Header.SymbsLen = int32(len(xf.SymbTbl) * XoutSymbEntryLen)
+	xf.CodePos = int64(XoutHdrLen + XoutSegEntryLen*len(xf.SegTbl))
+	xf.RelocTblPos = xf.CodePos + int64(xf.Header.CodePartLen)
+	xf.SymbTblPos = xf.RelocTblPos + int64(xf.Header.RelocsLen)
+	xf.NumRelocs = len(xf.RelocTbl)
+	xf.NumSymbs = len(xf.SymbTbl)
+	xf.Length = xf.SymbTblPos + int64(xf.Header.SymbsLen)
+}
+
+// WriteTo lays out the file and writes it to w.
+func (xf *XoutFile) WriteTo(w io.Writer) (int64, error) {
+	xf.Layout()
+	cw := &countWriter{w: w}
+	if err := binary.Write(cw, binary.BigEndian, xf.Header); err != nil {
+		return cw.n, errors.New("Header write error")
+	}
+	if err := binary.Write(cw, binary.BigEndian, xf.SegTbl); err != nil {
+		return cw.n, errors.New("Segment table write error")
+	}
+	if _, err := cw.Write(xf.CodePart); err != nil {
+		return cw.n, errors.New("Code part write error")
+	}
+	if err := binary.Write(cw, binary.BigEndian, xf.RelocTbl); err != nil {
+		return cw.n, errors.New("Relocation table write error")
+	}
+	if err := binary.Write(cw, binary.BigEndian, xf.SymbTbl); err != nil {
+		return cw.n, errors.New("Symbol table write error")
+	}
+	return cw.n, nil
+}
+
+// Bytes returns the file image.
+func (xf *XoutFile) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := xf.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func ConvertName(bname [8]byte) string {
 	var i int
 	for i = 0; i < 8; i++ {
@@ -0,0 +1,177 @@
+package binlib_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"binlib"
+	"binlib/xouttest"
+)
+
+func TestParseBounds(t *testing.T) {
+	sample := xouttest.Sample(binlib.XoutMagicNonSeg).Bytes()
+	tests := []struct {
+		field int // offset in the header
+		value int64
+		size  int
+		err   string
+	}{
+		{2, -1, 2, "Negative number of segments"},
+		{2, 0x7fff, 2, "Segment table of 32767 entries"},
+		{4, -1, 4, "Code part of -1 bytes"},
+		{4, 0x7fffffff, 4, "Code part of 2147483647 bytes"},
+		{8, 0x10000, 4, "Relocation table of 65536 bytes"},
+		{12, 0x7ffffff0, 4, "Symbol table of 2147483632 bytes"},
+	}
+	for _, test := range tests {
+		data := append([]byte{}, sample...)
+		if test.size == 2 {
+			binary.BigEndian.PutUint16(data[test.field:], uint16(test.value))
+		} else {
+			binary.BigEndian.PutUint32(data[test.field:], uint32(test.value))
+		}
+		var xf binlib.XoutFile
+		err := xf.Parse(data)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("header +%d = %d: error %v, want %q", test.field, test.value, err, test.err)
+		}
+	}
+}
+
+func TestSegReader(t *testing.T) {
+	obj := xouttest.Sample(binlib.XoutMagicNonSeg)
+	path := filepath.Join(t.TempDir(), "sample.rel")
+	if err := os.WriteFile(path, obj.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var xf binlib.XoutFile
+	if err = xf.ReadTables(file); err != nil {
+		t.Fatal(err)
+	}
+	if xf.CodePart != nil || len(xf.SymbTbl) != len(obj.Symbs) {
+		t.Fatal("tables not read without the code part")
+	}
+	pos := 0
+	for seg := range xf.SegTbl {
+		sr, err := xf.SegReader(seg)
+		if !binlib.XoutSegHasData(xf.SegTbl[seg].Type) {
+			if err == nil {
+				t.Errorf("segment %d: no error for a segment without contents", seg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := obj.Code[pos : pos+int(xf.SegTbl[seg].Length)]
+		if !bytes.Equal(got, want) {
+			t.Errorf("segment %d contents differ", seg)
+		}
+		pos += len(want)
+	}
+}
+
+func TestArMemberExceedsLibrary(t *testing.T) {
+	lib := xouttest.SampleLibrary()
+	// the size of the first member
+	binary.BigEndian.PutUint32(lib[2+22:], 0x7fffffff)
+	ar, err := binlib.NewArReader(bytes.NewReader(lib))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ar.Next()
+	if err == nil || !strings.Contains(err.Error(), "exceeds the library size") {
+		t.Errorf("error %v for a huge member", err)
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	obj := xouttest.Sample(binlib.XoutMagicNonSeg).Bytes()
+	lib := xouttest.Library(xouttest.SampleMembers())
+	coff := []byte{0x80, 0x00, 0, 0}
+	tests := []struct {
+		head []byte
+		kind binlib.FileKind
+	}{
+		{obj, binlib.KindXoutObject},
+		{xouttest.Sample(binlib.XoutMagicNonSegXSplit).Bytes(), binlib.KindXoutExec},
+		{lib, binlib.KindXoutLib},
+		{coff, binlib.KindCoff},
+		{[]byte("!<arch>\nfoo"), binlib.KindGnuAr},
+		{[]byte("!<ar"), binlib.KindUnknown},
+		{[]byte{0xee}, binlib.KindUnknown},
+	}
+	for _, test := range tests {
+		if kind := binlib.Identify(test.head); kind != test.kind {
+			t.Errorf("% x: %v, want %v", test.head[:2], kind, test.kind)
+		}
+	}
+
+	magics := []struct {
+		magic uint16
+		kind  binlib.FileKind
+	}{
+		{0xee00, binlib.KindXoutObject},
+		{0xee01, binlib.KindXoutExec},
+		{0xee02, binlib.KindXoutObject},
+		{0xee03, binlib.KindXoutExec},
+		{0xee06, binlib.KindXoutObject},
+		{0xee07, binlib.KindXoutExec},
+		{0xee0a, binlib.KindXoutObject},
+		{0xee0b, binlib.KindXoutExec},
+	}
+	for _, test := range magics {
+		data := xouttest.Sample(test.magic).Bytes()
+		if kind := binlib.Identify(data); kind != test.kind {
+			t.Errorf("0x%04x: %v, want %v", test.magic, kind, test.kind)
+		}
+		var xf binlib.XoutFile
+		if err := xf.Parse(data); err != nil || xf.Header.Magic != test.magic {
+			t.Errorf("0x%04x: %v", test.magic, err)
+		}
+	}
+
+	var xf binlib.XoutFile
+	err := xf.Parse(append(coff, make([]byte, 16)...))
+	if err == nil || err.Error() != "This is a COFF file, not an XOUT object or an XOUT executable, did you mean z8k-coff-objdump?" {
+		t.Errorf("COFF as XOUT: %v", err)
+	}
+	if err = xf.Parse(make([]byte, 32)); err == nil || !strings.HasPrefix(err.Error(), "Not an XOUT object") {
+		t.Errorf("zeros as XOUT: %v", err)
+	}
+	_, err = binlib.NewArReader(bytes.NewReader([]byte("!<arch>\n")))
+	if err == nil || err.Error() != "This is a GNU ar archive, not an XOUT library, did you mean z8k-coff-ar?" {
+		t.Errorf("GNU ar as library: %v", err)
+	}
+	if _, err = binlib.NewArReader(bytes.NewReader(obj)); err == nil || !strings.Contains(err.Error(), "did you mean xoutdump?") {
+		t.Errorf("object as library: %v", err)
+	}
+	var cf binlib.CoffFile
+	if err = cf.Parse(lib); err == nil || !strings.Contains(err.Error(), "This is an XOUT library, not a COFF file") {
+		t.Errorf("library as COFF: %v", err)
+	}
+}
+
+func TestArTime(t *testing.T) {
+	if date, ok := binlib.ArTime(0x5e0be100); !ok || date.Format(time.RFC3339) != "2020-01-01T00:00:00Z" {
+		t.Errorf("date %v %v", date, ok)
+	}
+	if _, ok := binlib.ArTime(0); ok {
+		t.Error("date 0 decoded")
+	}
+}
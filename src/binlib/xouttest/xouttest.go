@@ -0,0 +1,230 @@
+/*
+ *  xouttest.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Synthetic XOUT objects and libraries for tests.
+ */
+
+package xouttest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"binlib"
+)
+
+// Object is an XOUT file built from its tables, the header is derived.
+type Object struct {
+	Magic  uint16
+	Segs   []binlib.XoutSeg
+	Code   []byte
+	Relocs []binlib.XoutRelocItem
+	Symbs  []binlib.XoutSymbEntry
+}
+
+func (obj *Object) header() binlib.XoutHeader {
+	return binlib.XoutHeader{
+		Magic:       obj.Magic,
+		NumSegs:     int16(len(obj.Segs)),
+		CodePartLen: int32(len(obj.Code)),
+		RelocsLen:   int32(len(obj.Relocs) * binlib.XoutRelocItemLen),
+		SymbsLen:    int32(len(obj.Symbs) * binlib.XoutSymbEntryLen),
+	}
+}
+
+// Bytes returns the file image.
+func (obj *Object) Bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, obj.header())
+	binary.Write(&buf, binary.BigEndian, obj.Segs)
+	buf.Write(obj.Code)
+	binary.Write(&buf, binary.BigEndian, obj.Relocs)
+	binary.Write(&buf, binary.BigEndian, obj.Symbs)
+	return buf.Bytes()
+}
+
+// XoutFile returns the tables as XoutFile.Read would read them.
+func (obj *Object) XoutFile() *binlib.XoutFile {
+	xf := &binlib.XoutFile{}
+	xf.Header = obj.header()
+	xf.Length = int64(len(obj.Bytes()))
+	xf.CodePos = int64(binlib.XoutHdrLen + binlib.XoutSegEntryLen*len(obj.Segs))
+	xf.RelocTblPos = xf.CodePos + int64(len(obj.Code))
+	xf.SymbTblPos = xf.RelocTblPos + int64(xf.Header.RelocsLen)
+	xf.SegTbl = append([]binlib.XoutSeg(nil), obj.Segs...)
+	xf.CodePart = append([]byte{}, obj.Code...)
+	xf.RelocTbl = append([]binlib.XoutRelocItem(nil), obj.Relocs...)
+	xf.SymbTbl = append([]binlib.XoutSymbEntry(nil), obj.Symbs...)
+	xf.NumRelocs = len(xf.RelocTbl)
+	xf.NumSymbs = len(xf.SymbTbl)
+	return xf
+}
+
+// Symb makes a symbol entry.
+func Symb(seg, symbType byte, value uint16, name string) binlib.XoutSymbEntry {
+	symb := binlib.XoutSymbEntry{SegIdx: seg, Type: symbType, Value: value}
+	copy(symb.Name[:], name)
+	return symb
+}
+
+// Sample returns an object with every segment type, every relocation type,
+// local, global and external symbols, and commons.
+func Sample(magic uint16) *Object {
+	obj := &Object{Magic: magic}
+	obj.Segs = []binlib.XoutSeg{
+		{Number: 0, Type: binlib.XoutSegCODE, Length: 32},
+		{Number: 1, Type: binlib.XoutSegCONST, Length: 8},
+		{Number: 2, Type: binlib.XoutSegDATA, Length: 16},
+		{Number: 3, Type: binlib.XoutSegCDMIX, Length: 8},
+		{Number: 4, Type: binlib.XoutSegCDMIX_P, Length: 8},
+		{Number: 5, Type: binlib.XoutSegBSS, Length: 16},
+		{Number: 6, Type: binlib.XoutSegSTACK, Length: 32},
+	}
+	obj.Code = make([]byte, 32+8+16+8+8)
+	for idx := range obj.Code {
+		obj.Code[idx] = byte(0xa0 + idx)
+	}
+	// relocated fields hold the offsets
+	put := func(seg, loc int, words ...uint16) {
+		pos := 0
+		for idx := 0; idx < seg; idx++ {
+			if binlib.XoutSegHasData(obj.Segs[idx].Type) {
+				pos += int(obj.Segs[idx].Length)
+			}
+		}
+		for _, word := range words {
+			binary.BigEndian.PutUint16(obj.Code[pos+loc:], word)
+			loc += 2
+		}
+	}
+	put(0, 0x02, 0x0004)
+	put(0, 0x06, 0x0000)
+	put(0, 0x0a, 0x0102)
+	put(0, 0x0e, 0x0000)
+	put(0, 0x12, 0x8200, 0x0008)
+	put(0, 0x18, 0x8000, 0x0002)
+	put(2, 0x00, 0x0010)
+	put(2, 0x04, 0x0000)
+	put(3, 0x02, 0x0002)
+	put(4, 0x00, 0x0000)
+	obj.Relocs = []binlib.XoutRelocItem{
+		{SegIdx: 0, Type: binlib.XoutRelocOFF, Location: 0x02, SymbIdx: 2},
+		{SegIdx: 0, Type: binlib.XoutRelocXOFF, Location: 0x06, SymbIdx: 8},
+		{SegIdx: 0, Type: binlib.XoutRelocSSG, Location: 0x0a, SymbIdx: 1},
+		{SegIdx: 0, Type: binlib.XoutRelocXSSG, Location: 0x0e, SymbIdx: 9},
+		{SegIdx: 0, Type: binlib.XoutRelocLSG, Location: 0x12, SymbIdx: 2},
+		{SegIdx: 0, Type: binlib.XoutRelocXLSG, Location: 0x18, SymbIdx: 8},
+		{SegIdx: 2, Type: binlib.XoutRelocOFF, Location: 0x00, SymbIdx: 0},
+		{SegIdx: 2, Type: binlib.XoutRelocXOFF, Location: 0x04, SymbIdx: 5},
+		{SegIdx: 3, Type: binlib.XoutRelocOFF, Location: 0x02, SymbIdx: 5},
+		{SegIdx: 4, Type: binlib.XoutRelocXOFF, Location: 0x00, SymbIdx: 2},
+	}
+	obj.Symbs = []binlib.XoutSymbEntry{
+		Symb(0, binlib.XoutSymbSeg, 0, "__text"),
+		Symb(2, binlib.XoutSymbSeg, 0, "__data"),
+		Symb(0, binlib.XoutSymbLocal, 0x0004, "loc"),
+		Symb(2, binlib.XoutSymbLocal, 0x0002, "loc"),
+		Symb(0xff, binlib.XoutSymbLocal, 0x1234, "ABS"),
+		Symb(0, binlib.XoutSymbGlobal, 0x0010, "_glob"),
+		Symb(2, binlib.XoutSymbGlobal, 0x0008, "_gdata"),
+		Symb(5, binlib.XoutSymbGlobal, 0x0000, "_gbss"),
+		Symb(0xff, binlib.XoutSymbUndefEX, 0, "_ext"),
+		Symb(0xff, binlib.XoutSymbUndefEX, 0, "_ext2"),
+		Symb(0xff, binlib.XoutSymbUndefEX, 6, "_comm"),
+		Symb(0xff, binlib.XoutSymbUndefEX, 3, "_comm2"),
+	}
+	return obj
+}
+
+// Member is a file in a library.
+type Member struct {
+	Name string
+	Date uint32
+	UID  byte
+	GID  byte
+	Mode uint16
+	Data []byte
+}
+
+// Library returns the image of a library holding the members.
+func Library(members []Member) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(binlib.ArMagic))
+	for _, member := range members {
+		var arhdr binlib.ArHdr
+		copy(arhdr.Name[:], member.Name)
+		arhdr.Date = member.Date
+		arhdr.UID = member.UID
+		arhdr.GID = member.GID
+		arhdr.Mode = member.Mode
+		arhdr.Size = uint32(len(member.Data))
+		binary.Write(&buf, binary.BigEndian, arhdr)
+		buf.Write(member.Data)
+		if len(member.Data)%2 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+	return buf.Bytes()
+}
+
+// SampleMembers returns members of the sample library, small objects.
+func SampleMembers() []Member {
+	first := &Object{Magic: binlib.XoutMagicNonSeg}
+	first.Segs = []binlib.XoutSeg{{Number: 0, Type: binlib.XoutSegCODE, Length: 4}}
+	first.Code = []byte{0x5f, 0x00, 0x00, 0x00}
+	first.Relocs = []binlib.XoutRelocItem{
+		{SegIdx: 0, Type: binlib.XoutRelocXOFF, Location: 2, SymbIdx: 1},
+	}
+	first.Symbs = []binlib.XoutSymbEntry{
+		Symb(0, binlib.XoutSymbGlobal, 0, "_first"),
+		Symb(0xff, binlib.XoutSymbUndefEX, 0, "_second"),
+	}
+	second := &Object{Magic: binlib.XoutMagicNonSeg}
+	second.Segs = []binlib.XoutSeg{
+		{Number: 0, Type: binlib.XoutSegCODE, Length: 2},
+		{Number: 1, Type: binlib.XoutSegDATA, Length: 2},
+	}
+	second.Code = []byte{0x9e, 0x08, 0x12, 0x34}
+	second.Symbs = []binlib.XoutSymbEntry{
+		Symb(0, binlib.XoutSymbGlobal, 0, "_second"),
+		Symb(1, binlib.XoutSymbGlobal, 0, "_sdata"),
+	}
+	return []Member{
+		{Name: "first.o", Date: 0x5e0be100, Mode: 0644, Data: first.Bytes()},
+		{Name: "second.o", Date: 0x5e0be100, Mode: 0644, Data: second.Bytes()},
+		{Name: "sample.o", Date: 0x5e0be100, Mode: 0644,
+			Data: Sample(binlib.XoutMagicNonSeg).Bytes()},
+	}
+}
+
+// SampleLibrary returns the image of the sample library.
+func SampleLibrary() []byte {
+	return Library(SampleMembers())
+}
+
+// Words splits data into big endian words.
+func Words(data []byte) []uint16 {
+	w := make([]uint16, len(data)/2)
+	for idx := range w {
+		w[idx] = binary.BigEndian.Uint16(data[idx*2:])
+	}
+	return w
+}
+
+// CheckWords compares the words, a length mismatch fails the test.
+func CheckWords(t *testing.T, got, want []uint16) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%d words, want %d", len(got), len(want))
+	}
+	for idx := range want {
+		if got[idx] != want[idx] {
+			t.Errorf("word %d = %04x, want %04x", idx, got[idx], want[idx])
+		}
+	}
+}
@@ -0,0 +1,253 @@
+/*
+ *  addr.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Registers, memory accesses and addressing modes
+ */
+
+package z8k
+
+/* Add to the offset of an address, in its segment */
+func addOff(addr uint32, delta int) uint32 {
+	return addr&0x7f0000 | uint32(uint16(int(addr)+delta))
+}
+
+func (c *CPU) readByte(addr uint32, space Space) byte {
+	c.Cycles += 3
+	return c.Bus.LoadByte(addr&0x7fffff, space)
+}
+
+func (c *CPU) writeByte(addr uint32, val byte, space Space) {
+	c.Cycles += 3
+	c.Bus.StoreByte(addr&0x7fffff, val, space)
+}
+
+/* Words are on even addresses, the lowest address bit is ignored */
+func (c *CPU) readWord(addr uint32, space Space) uint16 {
+	addr &= 0x7ffffe
+	c.Cycles += 3
+	return uint16(c.Bus.LoadByte(addr, space))<<8 | uint16(c.Bus.LoadByte(addr+1, space))
+}
+
+func (c *CPU) writeWord(addr uint32, val uint16, space Space) {
+	addr &= 0x7ffffe
+	c.Cycles += 3
+	c.Bus.StoreByte(addr, byte(val>>8), space)
+	c.Bus.StoreByte(addr+1, byte(val), space)
+}
+
+/* Read 1, 2 or 4 bytes */
+func (c *CPU) readMem(addr uint32, size int, space Space) uint32 {
+	switch size {
+	case 1:
+		return uint32(c.readByte(addr, space))
+	case 2:
+		return uint32(c.readWord(addr, space))
+	}
+	return uint32(c.readWord(addr, space))<<16 | uint32(c.readWord(addOff(addr, 2), space))
+}
+
+func (c *CPU) writeMem(addr uint32, size int, val uint32, space Space) {
+	switch size {
+	case 1:
+		c.writeByte(addr, byte(val), space)
+	case 2:
+		c.writeWord(addr, uint16(val), space)
+	default:
+		c.writeWord(addr, uint16(val>>16), space)
+		c.writeWord(addOff(addr, 2), uint16(val), space)
+	}
+}
+
+/* Fetch an instruction word */
+func (c *CPU) fetch() uint16 {
+	val := c.readWord(c.PC, SpaceProgram)
+	c.PC = addOff(c.PC, 2)
+	return val
+}
+
+/* Byte registers RH0-RH7 are 0-7, RL0-RL7 are 8-15 */
+func (c *CPU) regByte(n int) byte {
+	if n < 8 {
+		return byte(c.R[n] >> 8)
+	}
+	return byte(c.R[n-8])
+}
+
+func (c *CPU) setRegByte(n int, val byte) {
+	if n < 8 {
+		c.R[n] = c.R[n]&0x00ff | uint16(val)<<8
+	} else {
+		c.R[n-8] = c.R[n-8]&0xff00 | uint16(val)
+	}
+}
+
+/* A byte, word or long register, RRn is Rn and Rn+1 */
+func (c *CPU) reg(n int, size int) uint32 {
+	switch size {
+	case 1:
+		return uint32(c.regByte(n))
+	case 2:
+		return uint32(c.R[n])
+	}
+	n &= 0xe
+	return uint32(c.R[n])<<16 | uint32(c.R[n+1])
+}
+
+func (c *CPU) setReg(n int, size int, val uint32) {
+	switch size {
+	case 1:
+		c.setRegByte(n, byte(val))
+	case 2:
+		c.R[n] = uint16(val)
+	default:
+		n &= 0xe
+		c.R[n] = uint16(val >> 16)
+		c.R[n+1] = uint16(val)
+	}
+}
+
+/*
+ * The address in a register, RRn in segmented mode with the segment in
+ * the bits 14-8 of Rn. In non segmented mode, the segment of PC is used.
+ */
+func (c *CPU) regAddr(n int) uint32 {
+	if c.seg() {
+		n &= 0xe
+		return uint32(c.R[n]&0x7f00)<<8 | uint32(c.R[n+1])
+	}
+	return c.PC&0x7f0000 | uint32(c.R[n])
+}
+
+func (c *CPU) setRegAddr(n int, addr uint32) {
+	if c.seg() {
+		n &= 0xe
+		c.R[n] = uint16(addr>>8) & 0x7f00
+		c.R[n+1] = uint16(addr)
+	} else {
+		c.R[n] = uint16(addr)
+	}
+}
+
+/* Add to the offset of the address in a register */
+func (c *CPU) incRegAddr(n int, delta int) {
+	if c.seg() {
+		n = n&0xe + 1
+	}
+	c.R[n] = uint16(int(c.R[n]) + delta)
+}
+
+/* Push and pop words with the stack pointer in register n */
+func (c *CPU) push(n int, val uint16) {
+	c.incRegAddr(n, -2)
+	c.writeWord(c.regAddr(n), val, SpaceStack)
+}
+
+func (c *CPU) pop(n int) uint16 {
+	val := c.readWord(c.regAddr(n), SpaceStack)
+	c.incRegAddr(n, 2)
+	return val
+}
+
+/* The stack pointer, RR14 in segmented mode and R15 otherwise */
+func (c *CPU) sp() int {
+	if c.seg() {
+		return 14
+	}
+	return 15
+}
+
+/* Push the return address, with its segment in segmented mode */
+func (c *CPU) pushPC() {
+	c.push(c.sp(), uint16(c.PC))
+	if c.seg() {
+		c.push(c.sp(), uint16(c.PC>>8)&0x7f00)
+	}
+}
+
+func (c *CPU) popPC() {
+	if c.seg() {
+		seg := c.pop(c.sp())
+		off := c.pop(c.sp())
+		c.PC = uint32(seg&0x7f00)<<8 | uint32(off)
+	} else {
+		c.PC = c.PC&0x7f0000 | uint32(c.pop(c.sp()))
+	}
+}
+
+/*
+ * Fetch a direct address. A segmented address is in the long form
+ * 1sssssss 00000000 oooooooo oooooooo or in the short form 0sssssss
+ * oooooooo.
+ */
+func (c *CPU) fetchAddr() uint32 {
+	if !c.seg() {
+		return c.PC&0x7f0000 | uint32(c.fetch())
+	}
+	word := c.fetch()
+	seg := uint32(word&0x7f00) << 8
+	if word&0x8000 != 0 {
+		return seg | uint32(c.fetch())
+	}
+	return seg | uint32(word&0xff)
+}
+
+/* An operand of an instruction */
+type operand struct {
+	reg   int /* register number, -1 for memory and immediate */
+	addr  uint32
+	imm   uint32
+	isImm bool
+}
+
+/*
+ * The operand of the addressing mode in the bits 15-14 of the first
+ * instruction word and the register field n. Mode 00 is IM for the field
+ * 0 and IR otherwise, mode 01 is DA for the field 0 and X otherwise, and
+ * mode 10 is R.
+ */
+func (c *CPU) operand(n int, size int) operand {
+	switch c.op >> 14 {
+	case 0:
+		if n != 0 {
+			return operand{reg: -1, addr: c.regAddr(n)}
+		}
+		return operand{reg: -1, imm: c.fetchImm(size), isImm: true}
+	case 1:
+		addr := c.fetchAddr()
+		if n != 0 {
+			addr = addOff(addr, int(c.R[n]))
+		}
+		return operand{reg: -1, addr: addr}
+	}
+	return operand{reg: n}
+}
+
+/* The address of the IR, DA and X modes, for jumps and LDA */
+func (c *CPU) operandAddr(n int) uint32 {
+	if c.op>>14 == 0 {
+		return c.regAddr(n)
+	}
+	return c.operand(n, 2).addr
+}
+
+func (c *CPU) load(o operand, size int) uint32 {
+	switch {
+	case o.isImm:
+		return o.imm
+	case o.reg >= 0:
+		return c.reg(o.reg, size)
+	}
+	return c.readMem(o.addr, size, SpaceData)
+}
+
+func (c *CPU) store(o operand, size int, val uint32) {
+	if o.reg >= 0 {
+		c.setReg(o.reg, size, val)
+	} else if !o.isImm {
+		c.writeMem(o.addr, size, val, SpaceData)
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ *  alu.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Arithmetic, logical and shift operations with the flags
+ */
+
+package z8k
+
+func mask(size int) uint32 {
+	return 0xffffffff >> (32 - uint(size)*8)
+}
+
+func signBit(size int) uint32 {
+	return uint32(1) << (uint(size)*8 - 1)
+}
+
+/* Sign extend a byte, word or long */
+func signed(val uint32, size int) int64 {
+	switch size {
+	case 1:
+		return int64(int8(val))
+	case 2:
+		return int64(int16(val))
+	}
+	return int64(int32(val))
+}
+
+func (c *CPU) setFlag(flag uint16, cond bool) {
+	if cond {
+		c.FCW |= flag
+	} else {
+		c.FCW &^= flag
+	}
+}
+
+func (c *CPU) flag(flag uint16) bool {
+	return c.FCW&flag != 0
+}
+
+func parity(val byte) bool {
+	val ^= val >> 4
+	val ^= val >> 2
+	val ^= val >> 1
+	return val&1 == 0
+}
+
+/* Z and S of a result */
+func (c *CPU) setZS(val uint32, size int) {
+	val &= mask(size)
+	c.setFlag(FlagZ, val == 0)
+	c.setFlag(FlagS, val&signBit(size) != 0)
+}
+
+/* Flags of logical operations, P is the parity of bytes */
+func (c *CPU) logic(val uint32, size int) uint32 {
+	c.setZS(val, size)
+	if size == 1 {
+		c.setFlag(FlagPV, parity(byte(val)))
+	}
+	return val & mask(size)
+}
+
+/* a + b + carry, with C, Z, S, V, and DA and H for bytes */
+func (c *CPU) add(a, b, carry uint32, size int) uint32 {
+	m := mask(size)
+	a &= m
+	b &= m
+	sum := uint64(a) + uint64(b) + uint64(carry)
+	res := uint32(sum) & m
+	c.setFlag(FlagC, sum>>(uint(size)*8) != 0)
+	c.setZS(res, size)
+	c.setFlag(FlagPV, (a^res)&(b^res)&signBit(size) != 0)
+	if size == 1 {
+		c.setFlag(FlagDA, false)
+		c.setFlag(FlagH, (a&0xf)+(b&0xf)+carry > 0xf)
+	}
+	return res
+}
+
+/* a - b - borrow, with C as the borrow */
+func (c *CPU) sub(a, b, borrow uint32, size int) uint32 {
+	m := mask(size)
+	a &= m
+	b &= m
+	res := (a - b - borrow) & m
+	c.setFlag(FlagC, uint64(a) < uint64(b)+uint64(borrow))
+	c.setZS(res, size)
+	c.setFlag(FlagPV, (a^b)&(a^res)&signBit(size) != 0)
+	if size == 1 {
+		c.setFlag(FlagDA, true)
+		c.setFlag(FlagH, a&0xf < b&0xf+borrow)
+	}
+	return res
+}
+
+func (c *CPU) carry() uint32 {
+	if c.flag(FlagC) {
+		return 1
+	}
+	return 0
+}
+
+/*
+ * The condition codes
+ * 0 F, 1 LT, 2 LE, 3 ULE, 4 OV, 5 MI, 6 Z, 7 C,
+ * 8 T, 9 GE, A GT, B UGT, C NOV, D PL, E NZ, F NC
+ */
+func (c *CPU) cond(cc int) bool {
+	cf, zf, sf, vf := c.flag(FlagC), c.flag(FlagZ), c.flag(FlagS), c.flag(FlagPV)
+	var res bool
+	switch cc & 7 {
+	case 0:
+		res = false
+	case 1:
+		res = sf != vf
+	case 2:
+		res = zf || sf != vf
+	case 3:
+		res = cf || zf
+	case 4:
+		res = vf
+	case 5:
+		res = sf
+	case 6:
+		res = zf
+	case 7:
+		res = cf
+	}
+	if cc&8 != 0 {
+		return !res
+	}
+	return res
+}
+
+/* Rotate by 1 or 2 bits, left or right, through carry or not */
+func (c *CPU) rotate(val uint32, size int, count int, left, withCarry bool) uint32 {
+	bits := uint(size) * 8
+	m := mask(size)
+	val &= m
+	orig := val
+	for ; count > 0; count-- {
+		var out, in uint32
+		if left {
+			out = val >> (bits - 1) & 1
+			in = out
+		} else {
+			out = val & 1
+			in = out
+		}
+		if withCarry {
+			in = c.carry()
+		}
+		if left {
+			val = (val<<1 | in) & m
+		} else {
+			val = val>>1 | in<<(bits-1)
+		}
+		c.setFlag(FlagC, out != 0)
+	}
+	c.setZS(val, size)
+	c.setFlag(FlagPV, (orig^val)&signBit(size) != 0)
+	return val
+}
+
+/*
+ * Shift by a signed count, left for positive. Arithmetic shifts set V
+ * when the sign changes while shifting left.
+ */
+func (c *CPU) shift(val uint32, size int, count int, arith bool) uint32 {
+	m := mask(size)
+	sign := signBit(size)
+	val &= m
+	overflow := false
+	switch {
+	case count > 0:
+		for ; count > 0; count-- {
+			c.setFlag(FlagC, val&sign != 0)
+			res := val << 1 & m
+			if (res^val)&sign != 0 {
+				overflow = true
+			}
+			val = res
+		}
+	case count < 0:
+		for ; count < 0; count++ {
+			c.setFlag(FlagC, val&1 != 0)
+			if arith {
+				val = val>>1 | val&sign
+			} else {
+				val >>= 1
+			}
+		}
+	default:
+		c.setFlag(FlagC, false)
+	}
+	c.setZS(val, size)
+	if arith {
+		c.setFlag(FlagPV, overflow)
+	} else if size == 1 {
+		c.setFlag(FlagPV, parity(byte(val)))
+	}
+	return val
+}
+
+/* Decimal adjust a byte after ADDB or SUBB */
+func (c *CPU) dab(val byte) byte {
+	var adj byte
+	carry := c.flag(FlagC)
+	if c.flag(FlagDA) {
+		if c.flag(FlagH) {
+			adj |= 0x06
+		}
+		if carry {
+			adj |= 0x60
+		}
+		val -= adj
+	} else {
+		if c.flag(FlagH) || val&0xf > 9 {
+			adj |= 0x06
+		}
+		if carry || val > 0x99 {
+			adj |= 0x60
+			carry = true
+		}
+		val += adj
+	}
+	c.setFlag(FlagC, carry)
+	c.setZS(uint32(val), 1)
+	return val
+}
@@ -0,0 +1,96 @@
+/*
+ *  bus.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Memory and I/O of the emulated CPU
+ */
+
+package z8k
+
+/* Address spaces, as the status lines of the CPU tell */
+type Space int
+
+const (
+	SpaceData    Space = 0
+	SpaceStack   Space = 1
+	SpaceProgram Space = 2
+)
+
+// Bus is the memory and I/O the CPU accesses. Addresses are
+// segment << 16 | offset, word accesses are made by bytes, high first.
+type Bus interface {
+	LoadByte(addr uint32, space Space) byte
+	StoreByte(addr uint32, val byte, space Space)
+	In(port uint16, byteIO bool) uint16
+	Out(port uint16, val uint16, byteIO bool)
+}
+
+// Memory is a Bus of 128 segments of 64K bytes, allocated when written.
+// With Split, the program space is separated from data and stack.
+type Memory struct {
+	Split   bool
+	InPort  func(port uint16, byteIO bool) uint16
+	OutPort func(port uint16, val uint16, byteIO bool)
+
+	data map[uint32][]byte
+	code map[uint32][]byte
+}
+
+func NewMemory() *Memory {
+	return &Memory{data: make(map[uint32][]byte), code: make(map[uint32][]byte)}
+}
+
+func (m *Memory) segment(addr uint32, space Space, alloc bool) []byte {
+	segs := m.data
+	if m.Split && space == SpaceProgram {
+		segs = m.code
+	}
+	seg := addr >> 16 & 0x7f
+	if segs[seg] == nil && alloc {
+		segs[seg] = make([]byte, 0x10000)
+	}
+	return segs[seg]
+}
+
+func (m *Memory) LoadByte(addr uint32, space Space) byte {
+	seg := m.segment(addr, space, false)
+	if seg == nil {
+		return 0
+	}
+	return seg[addr&0xffff]
+}
+
+func (m *Memory) StoreByte(addr uint32, val byte, space Space) {
+	m.segment(addr, space, true)[addr&0xffff] = val
+}
+
+func (m *Memory) Read(addr uint32, size int, space Space) []byte {
+	data := make([]byte, size)
+	for idx := range data {
+		data[idx] = m.LoadByte(addr&0xff0000|(addr+uint32(idx))&0xffff, space)
+	}
+	return data
+}
+
+// Write stores data from addr, the offset wraps around in the segment.
+func (m *Memory) Write(addr uint32, data []byte, space Space) {
+	for idx, val := range data {
+		m.StoreByte(addr&0xff0000|(addr+uint32(idx))&0xffff, val, space)
+	}
+}
+
+func (m *Memory) In(port uint16, byteIO bool) uint16 {
+	if m.InPort == nil {
+		return 0xffff
+	}
+	return m.InPort(port, byteIO)
+}
+
+func (m *Memory) Out(port uint16, val uint16, byteIO bool) {
+	if m.OutPort != nil {
+		m.OutPort(port, val, byteIO)
+	}
+}
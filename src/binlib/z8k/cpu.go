@@ -0,0 +1,271 @@
+/*
+ *  cpu.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  A Z8001/Z8002 CPU emulator
+ *  Cycles are counted roughly, by instruction words and memory accesses.
+ */
+
+package z8k
+
+import (
+	"errors"
+	"fmt"
+)
+
+type Model int
+
+const (
+	Z8001 Model = 1 /* segmented */
+	Z8002 Model = 2 /* non segmented */
+)
+
+/* Bits of the flag and control word */
+const (
+	FlagSEG  = uint16(0x8000) /* segmented mode */
+	FlagSys  = uint16(0x4000) /* system mode */
+	FlagEPA  = uint16(0x2000) /* extended processor architecture */
+	FlagVIE  = uint16(0x1000) /* vectored interrupt enable */
+	FlagNVIE = uint16(0x0800) /* non vectored interrupt enable */
+	FlagC    = uint16(0x0080) /* carry */
+	FlagZ    = uint16(0x0040) /* zero */
+	FlagS    = uint16(0x0020) /* sign */
+	FlagPV   = uint16(0x0010) /* parity or overflow */
+	FlagDA   = uint16(0x0008) /* decimal adjust */
+	FlagH    = uint16(0x0004) /* half carry */
+)
+
+/* Traps and interrupts, by their program status area entries */
+type Trap int
+
+const (
+	TrapExtended   Trap = 1 /* extended instruction */
+	TrapPrivileged Trap = 2 /* privileged instruction in normal mode */
+	TrapSystemCall Trap = 3 /* SC instruction */
+	TrapSegment    Trap = 4 /* segment trap, from the memory management */
+	IntNMI         Trap = 5 /* non maskable interrupt */
+	IntNVI         Trap = 6 /* non vectored interrupt */
+	IntVI          Trap = 7 /* vectored interrupt */
+)
+
+var (
+	ErrHalt       = errors.New("halted")
+	ErrBreakpoint = errors.New("breakpoint")
+)
+
+// Error is an instruction the emulator can not execute.
+type Error struct {
+	PC  uint32
+	Op  uint16
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %04x at %06x", e.Msg, e.Op, e.PC)
+}
+
+type irq struct {
+	kind   Trap
+	vector uint16
+}
+
+type CPU struct {
+	Model   Model
+	Bus     Bus
+	R       [16]uint16 /* R14 and R15 of the current mode */
+	PC      uint32     /* segment << 16 | offset */
+	FCW     uint16
+	PSAP    uint32
+	Refresh uint16
+	Cycles  uint64
+	Halted  bool
+
+	Breakpoints map[uint32]bool               // Run stops before these addresses
+	Trace       func(c *CPU)                  // called before each instruction
+	SystemCall  func(c *CPU, code byte) error // handles SC instead of the trap
+
+	bank    [2]uint16 /* R14 and R15 of the other mode */
+	pending []irq
+	op      uint16 /* first word of the instruction */
+	opPC    uint32 /* address of the instruction */
+}
+
+// New returns a CPU in system mode, segmented for Z8001.
+func New(model Model, bus Bus) *CPU {
+	c := &CPU{Model: model, Bus: bus, FCW: FlagSys, Breakpoints: make(map[uint32]bool)}
+	if model == Z8001 {
+		c.FCW |= FlagSEG
+	}
+	return c
+}
+
+// Reset loads FCW and PC from the reset area at address 0.
+func (c *CPU) Reset() {
+	c.Halted = false
+	c.pending = nil
+	c.setFCW(c.readWord(2, SpaceProgram) | FlagSys)
+	if c.Model == Z8001 {
+		c.PC = uint32(c.readWord(4, SpaceProgram)&0x7f00)<<8 | uint32(c.readWord(6, SpaceProgram))
+	} else {
+		c.PC = uint32(c.readWord(4, SpaceProgram))
+	}
+}
+
+func (c *CPU) seg() bool {
+	return c.Model == Z8001 && c.FCW&FlagSEG != 0
+}
+
+func (c *CPU) system() bool {
+	return c.FCW&FlagSys != 0
+}
+
+/* Change FCW, the stack pointers are switched with the mode */
+func (c *CPU) setFCW(fcw uint16) {
+	if c.Model == Z8002 {
+		fcw &^= FlagSEG
+	}
+	if (fcw^c.FCW)&FlagSys != 0 {
+		c.R[15], c.bank[1] = c.bank[1], c.R[15]
+		if c.Model == Z8001 {
+			c.R[14], c.bank[0] = c.bank[0], c.R[14]
+		}
+	}
+	c.FCW = fcw
+}
+
+// SetSP sets the stack pointer of the current mode, R15 or RR14.
+func (c *CPU) SetSP(addr uint32) {
+	if c.seg() {
+		c.R[14] = uint16(addr>>8) & 0x7f00
+	}
+	c.R[15] = uint16(addr)
+}
+
+// Interrupt requests an interrupt, taken before the next instruction when
+// it is enabled. The vector selects the PC of a vectored interrupt.
+func (c *CPU) Interrupt(kind Trap, vector uint16) {
+	c.pending = append(c.pending, irq{kind, vector})
+}
+
+/* Take a pending interrupt if enabled */
+func (c *CPU) takeInterrupt() bool {
+	for idx, req := range c.pending {
+		enabled := req.kind == IntNMI ||
+			req.kind == IntNVI && c.FCW&FlagNVIE != 0 ||
+			req.kind == IntVI && c.FCW&FlagVIE != 0
+		if !enabled {
+			continue
+		}
+		c.pending = append(c.pending[:idx], c.pending[idx+1:]...)
+		c.Halted = false
+		c.trap(req.kind, req.vector)
+		return true
+	}
+	return false
+}
+
+/*
+ * Save the program status on the system stack and load the new one from
+ * the program status area. The identifier is the instruction word for
+ * traps and the vector for interrupts.
+ */
+func (c *CPU) trap(kind Trap, id uint16) {
+	oldFCW := c.FCW
+	c.setFCW(c.FCW | FlagSys)
+	if c.Model == Z8001 {
+		c.FCW |= FlagSEG
+		c.push(14, uint16(c.PC))
+		c.push(14, uint16(c.PC>>8)&0x7f00)
+		c.push(14, oldFCW)
+		c.push(14, id)
+		entry := c.PSAP + uint32(kind)*8
+		fcw := c.readWord(entry+2, SpaceProgram)
+		pc := uint32(c.readWord(entry+4, SpaceProgram)&0x7f00)<<8 | uint32(c.readWord(entry+6, SpaceProgram))
+		if kind == IntVI {
+			fcw = c.readWord(entry+2, SpaceProgram)
+			vec := entry + 4 + uint32(id&0xff)*4
+			pc = uint32(c.readWord(vec, SpaceProgram)&0x7f00)<<8 | uint32(c.readWord(vec+2, SpaceProgram))
+		}
+		c.setFCW(fcw)
+		c.PC = pc
+	} else {
+		c.push(15, uint16(c.PC))
+		c.push(15, oldFCW)
+		c.push(15, id)
+		entry := c.PSAP + uint32(kind)*4
+		fcw := c.readWord(entry, SpaceProgram)
+		pc := c.readWord(entry+2, SpaceProgram)
+		if kind == IntVI {
+			pc = c.readWord(entry+2+uint32(id&0xff)*2, SpaceProgram)
+		}
+		c.setFCW(fcw)
+		c.PC = c.PSAP&0xff0000 | uint32(pc)
+	}
+	c.Cycles += 33
+}
+
+/* Return from a trap or an interrupt */
+func (c *CPU) iret() {
+	sp := 15
+	if c.Model == Z8001 {
+		sp = 14
+	}
+	c.pop(sp) // identifier
+	fcw := c.pop(sp)
+	if c.Model == Z8001 {
+		seg := c.pop(sp)
+		off := c.pop(sp)
+		c.PC = uint32(seg&0x7f00)<<8 | uint32(off)
+	} else {
+		c.PC = c.PC&0xff0000 | uint32(c.pop(sp))
+	}
+	c.setFCW(fcw)
+}
+
+// Step executes an instruction, or takes an interrupt.
+func (c *CPU) Step() error {
+	if c.takeInterrupt() {
+		return nil
+	}
+	if c.Halted {
+		return ErrHalt
+	}
+	c.opPC = c.PC
+	if c.Trace != nil {
+		c.Trace(c)
+	}
+	c.op = c.fetch()
+	c.Cycles++
+	return c.exec()
+}
+
+// Run executes steps instructions, or until an error if steps is 0. It
+// stops with ErrBreakpoint before a breakpoint other than the first
+// instruction, and with ErrHalt at HALT.
+func (c *CPU) Run(steps int) error {
+	for n := 0; steps <= 0 || n < steps; n++ {
+		if n > 0 && c.Breakpoints[c.PC] {
+			return ErrBreakpoint
+		}
+		if err := c.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *CPU) unimplemented() error {
+	return &Error{PC: c.opPC, Op: c.op, Msg: "unimplemented instruction"}
+}
+
+/* Trap a privileged instruction in normal mode, and return true */
+func (c *CPU) privileged() bool {
+	if c.system() {
+		return false
+	}
+	c.trap(TrapPrivileged, c.op)
+	return true
+}
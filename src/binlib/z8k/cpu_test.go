@@ -0,0 +1,420 @@
+package z8k
+
+import (
+	"testing"
+
+	"binlib"
+	"binlib/xouttest"
+)
+
+const halt = 0x7a00
+
+/* A CPU with the words at addr, PC on them and the stack at 0xf000 */
+func newCPU(model Model, addr uint32, code ...uint16) (*CPU, *Memory) {
+	mem := NewMemory()
+	c := New(model, mem)
+	for idx, word := range code {
+		c.writeWord(addOff(addr, idx*2), word, SpaceProgram)
+	}
+	c.PC = addr
+	c.SetSP(addr&0x7f0000 | 0xf000)
+	c.Cycles = 0
+	return c, mem
+}
+
+func TestInstructions(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    []uint16
+		regs    map[int]uint16
+		mem     map[uint32]uint16
+		want    map[int]uint16
+		wantMem map[uint32]uint16
+		set     uint16 /* flags to be set */
+		clear   uint16 /* flags to be cleared */
+	}{
+		{name: "LD LDK ADD", code: []uint16{0x2101, 0x1234, 0xbd25, 0x8121},
+			want: map[int]uint16{1: 0x1239, 2: 5}, clear: FlagC | FlagZ | FlagS | FlagPV},
+		{name: "ADD overflow", code: []uint16{0x8143}, regs: map[int]uint16{3: 0x7fff, 4: 1},
+			want: map[int]uint16{3: 0x8000}, set: FlagS | FlagPV, clear: FlagC | FlagZ},
+		{name: "ADDB carry", code: []uint16{0x8098}, regs: map[int]uint16{0: 0x00ff, 1: 0x0001},
+			want: map[int]uint16{0: 0x0000}, set: FlagC | FlagZ | FlagH, clear: FlagS | FlagDA},
+		{name: "SUB borrow", code: []uint16{0x8321}, regs: map[int]uint16{1: 1, 2: 2},
+			want: map[int]uint16{1: 0xffff}, set: FlagC | FlagS, clear: FlagZ | FlagPV},
+		{name: "CP immediate", code: []uint16{0x0b01, 0x0005}, regs: map[int]uint16{1: 5},
+			want: map[int]uint16{1: 5}, set: FlagZ, clear: FlagC | FlagS},
+		{name: "AND immediate", code: []uint16{0x0701, 0x0ff0}, regs: map[int]uint16{1: 0xff0f},
+			want: map[int]uint16{1: 0x0f00}, clear: FlagZ | FlagS},
+		{name: "XORB parity", code: []uint16{0x0809, 0x0000}, regs: map[int]uint16{1: 0x0003},
+			want: map[int]uint16{1: 0x0003}, set: FlagPV},
+		{name: "NEG", code: []uint16{0x8d12}, regs: map[int]uint16{1: 1},
+			want: map[int]uint16{1: 0xffff}, set: FlagC | FlagS},
+		{name: "COM", code: []uint16{0x8d10}, regs: map[int]uint16{1: 0x00ff},
+			want: map[int]uint16{1: 0xff00}, set: FlagS},
+		{name: "TSET", code: []uint16{0x8d16}, regs: map[int]uint16{1: 0x8000},
+			want: map[int]uint16{1: 0xffff}, set: FlagS},
+		{name: "INC keeps carry", code: []uint16{0x8d81, 0xa911}, regs: map[int]uint16{1: 0x7fff},
+			want: map[int]uint16{1: 0x8001}, set: FlagC | FlagPV | FlagS},
+		{name: "DEC to zero", code: []uint16{0xab10}, regs: map[int]uint16{1: 1},
+			want: map[int]uint16{1: 0}, set: FlagZ},
+		{name: "MULT", code: []uint16{0x9942}, regs: map[int]uint16{3: 0xfffd, 4: 1000},
+			want: map[int]uint16{2: 0xffff, 3: 0xf448}, set: FlagS, clear: FlagC | FlagZ},
+		{name: "MULT carry", code: []uint16{0x9942}, regs: map[int]uint16{3: 0x4000, 4: 4},
+			want: map[int]uint16{2: 0x0001, 3: 0x0000}, set: FlagC},
+		{name: "MULTL", code: []uint16{0x9840}, regs: map[int]uint16{2: 0, 3: 0x1000, 4: 0, 5: 0x1000},
+			want: map[int]uint16{0: 0, 1: 0, 2: 0x0100, 3: 0}, clear: FlagC},
+		{name: "DIV", code: []uint16{0x9b42}, regs: map[int]uint16{2: 0x0001, 3: 0x86a3, 4: 10},
+			want: map[int]uint16{2: 3, 3: 10000}, clear: FlagPV | FlagZ | FlagS},
+		{name: "DIV negative", code: []uint16{0x9b42}, regs: map[int]uint16{2: 0xffff, 3: 0xfff9, 4: 2},
+			want: map[int]uint16{2: 0xffff, 3: 0xfffd}, set: FlagS},
+		{name: "DIV by zero", code: []uint16{0x9b42}, regs: map[int]uint16{2: 0, 3: 7, 4: 0},
+			want: map[int]uint16{2: 0, 3: 7}, set: FlagPV | FlagZ},
+		{name: "DIV overflow", code: []uint16{0x9b42}, regs: map[int]uint16{2: 0x0010, 3: 0, 4: 2},
+			want: map[int]uint16{2: 0x0010, 3: 0}, set: FlagPV},
+		{name: "DIVL", code: []uint16{0x9a40}, regs: map[int]uint16{0: 0, 1: 0, 2: 0, 3: 100, 4: 0, 5: 7},
+			want: map[int]uint16{0: 0, 1: 2, 2: 0, 3: 14}},
+		{name: "EXTS", code: []uint16{0xb12a}, regs: map[int]uint16{2: 0, 3: 0x8000},
+			want: map[int]uint16{2: 0xffff, 3: 0x8000}},
+		{name: "EXTSB", code: []uint16{0xb110}, regs: map[int]uint16{1: 0x1280},
+			want: map[int]uint16{1: 0xff80}},
+		{name: "EXTSL", code: []uint16{0xb107}, regs: map[int]uint16{0: 0x1234, 1: 0x5678, 2: 0x8000, 3: 0},
+			want: map[int]uint16{0: 0xffff, 1: 0xffff}},
+		{name: "SLA", code: []uint16{0xb319, 0x0001}, regs: map[int]uint16{1: 0x4001},
+			want: map[int]uint16{1: 0x8002}, set: FlagPV | FlagS, clear: FlagC},
+		{name: "SRA", code: []uint16{0xb319, 0xfffe}, regs: map[int]uint16{1: 0x8004},
+			want: map[int]uint16{1: 0xe001}, set: FlagS, clear: FlagC},
+		{name: "SRL", code: []uint16{0xb311, 0xffff}, regs: map[int]uint16{1: 0x8003},
+			want: map[int]uint16{1: 0x4001}, set: FlagC, clear: FlagS},
+		{name: "SRLB", code: []uint16{0xb291, 0x00fe}, regs: map[int]uint16{1: 0x0082},
+			want: map[int]uint16{1: 0x0020}, set: FlagC},
+		{name: "SDL", code: []uint16{0xb313, 0x0200}, regs: map[int]uint16{1: 1, 2: 4},
+			want: map[int]uint16{1: 0x10}},
+		{name: "SLLL", code: []uint16{0xb305, 0x0001}, regs: map[int]uint16{0: 0, 1: 0x8000},
+			want: map[int]uint16{0: 1, 1: 0}},
+		{name: "RL", code: []uint16{0xb310}, regs: map[int]uint16{1: 0x8001},
+			want: map[int]uint16{1: 0x0003}, set: FlagC | FlagPV},
+		{name: "RRC", code: []uint16{0x8d81, 0xb31c}, regs: map[int]uint16{1: 0x0002},
+			want: map[int]uint16{1: 0x8001}, set: FlagS, clear: FlagC},
+		{name: "ADC", code: []uint16{0x8d81, 0xb521}, regs: map[int]uint16{1: 1, 2: 2},
+			want: map[int]uint16{1: 4}, clear: FlagC},
+		{name: "SBC", code: []uint16{0x8d81, 0xb721}, regs: map[int]uint16{1: 5, 2: 2},
+			want: map[int]uint16{1: 2}, clear: FlagC},
+		{name: "DAB add", code: []uint16{0x0008, 0x0028, 0xb080}, regs: map[int]uint16{0: 0x0019},
+			want: map[int]uint16{0: 0x0047}, clear: FlagC},
+		{name: "DAB sub", code: []uint16{0x0208, 0x0019, 0xb080}, regs: map[int]uint16{0: 0x0042},
+			want: map[int]uint16{0: 0x0023}, clear: FlagC},
+		{name: "LDB short", code: []uint16{0xc841, 0xc012},
+			want: map[int]uint16{0: 0x1241}},
+		{name: "BIT", code: []uint16{0xa713}, regs: map[int]uint16{1: 0x0008}, clear: FlagZ},
+		{name: "BIT clear", code: []uint16{0xa712}, regs: map[int]uint16{1: 0x0008}, set: FlagZ},
+		{name: "SET RES", code: []uint16{0xa51f, 0xa310}, regs: map[int]uint16{1: 0x0001},
+			want: map[int]uint16{1: 0x8000}},
+		{name: "SET dynamic", code: []uint16{0x2502, 0x0100}, regs: map[int]uint16{1: 0x0001, 2: 4},
+			want: map[int]uint16{1: 0x0011}},
+		{name: "EX", code: []uint16{0xad21}, regs: map[int]uint16{1: 1, 2: 2},
+			want: map[int]uint16{1: 2, 2: 1}},
+		{name: "TCC", code: []uint16{0x8d41, 0xaf16, 0xaf27}, regs: map[int]uint16{1: 0x10, 2: 0x10},
+			want: map[int]uint16{1: 0x11, 2: 0x10}},
+		{name: "flags", code: []uint16{0x8df1, 0x8d33, 0x8d45}, set: FlagC, clear: FlagZ | FlagS | FlagPV},
+		{name: "LD direct", code: []uint16{0x6101, 0x2000}, mem: map[uint32]uint16{0x2000: 0xbeef},
+			want: map[int]uint16{1: 0xbeef}},
+		{name: "LD indirect store", code: []uint16{0x2f21}, regs: map[int]uint16{1: 0x1234, 2: 0x2000},
+			wantMem: map[uint32]uint16{0x2000: 0x1234}},
+		{name: "LD indexed", code: []uint16{0x6131, 0x2000}, regs: map[int]uint16{3: 4},
+			mem: map[uint32]uint16{0x2004: 0x5555}, want: map[int]uint16{1: 0x5555}},
+		{name: "LD based", code: []uint16{0x3121, 0x0006}, regs: map[int]uint16{2: 0x2000},
+			mem: map[uint32]uint16{0x2006: 0x6666}, want: map[int]uint16{1: 0x6666}},
+		{name: "LD based indexed store", code: []uint16{0x7321, 0x0300}, regs: map[int]uint16{1: 7, 2: 0x2000, 3: 8},
+			wantMem: map[uint32]uint16{0x2008: 7}},
+		{name: "LDR", code: []uint16{0x3101, 0x0002, halt, 0x7777}, want: map[int]uint16{1: 0x7777}},
+		{name: "LDB indirect", code: []uint16{0x2029}, regs: map[int]uint16{2: 0x2001},
+			mem: map[uint32]uint16{0x2000: 0x1234}, want: map[int]uint16{1: 0x0034}},
+		{name: "LD memory immediate", code: []uint16{0x4d05, 0x2000, 0x4321},
+			wantMem: map[uint32]uint16{0x2000: 0x4321}},
+		{name: "CLR indirect", code: []uint16{0x0d28}, regs: map[int]uint16{2: 0x2000},
+			mem: map[uint32]uint16{0x2000: 0x1234}, wantMem: map[uint32]uint16{0x2000: 0}},
+		{name: "INC memory", code: []uint16{0x6900, 0x2000}, mem: map[uint32]uint16{0x2000: 0xffff},
+			wantMem: map[uint32]uint16{0x2000: 0}, set: FlagZ},
+		{name: "LDL", code: []uint16{0x1400, 0x1234, 0x5678},
+			want: map[int]uint16{0: 0x1234, 1: 0x5678}},
+		{name: "LDL store", code: []uint16{0x5d02, 0x2000}, regs: map[int]uint16{2: 0xaaaa, 3: 0xbbbb},
+			wantMem: map[uint32]uint16{0x2000: 0xaaaa, 0x2002: 0xbbbb}},
+		{name: "ADDL", code: []uint16{0x9620}, regs: map[int]uint16{0: 0, 1: 0xffff, 2: 0, 3: 1},
+			want: map[int]uint16{0: 1, 1: 0}, clear: FlagC},
+		{name: "LDA", code: []uint16{0x7602, 0x2000, 0x3423, 0x0010},
+			regs: map[int]uint16{2: 0x1111}, want: map[int]uint16{2: 0x2000, 3: 0x2010}},
+		{name: "LDM", code: []uint16{0x1c21, 0x0402}, regs: map[int]uint16{2: 0x2000},
+			mem:  map[uint32]uint16{0x2000: 1, 0x2002: 2, 0x2004: 3, 0x2006: 4},
+			want: map[int]uint16{4: 1, 5: 2, 6: 3, 7: 0}},
+		{name: "LDM store", code: []uint16{0x5c09, 0x0401, 0x2000}, regs: map[int]uint16{4: 9, 5: 8},
+			wantMem: map[uint32]uint16{0x2000: 9, 0x2002: 8}},
+		{name: "LDIR", code: []uint16{0xbb21, 0x0310}, regs: map[int]uint16{1: 0x3000, 2: 0x2000, 3: 3},
+			mem:     map[uint32]uint16{0x2000: 1, 0x2002: 2, 0x2004: 3, 0x2006: 4},
+			wantMem: map[uint32]uint16{0x3000: 1, 0x3002: 2, 0x3004: 3, 0x3006: 0},
+			want:    map[int]uint16{1: 0x3006, 2: 0x2006, 3: 0}, set: FlagPV},
+		{name: "LDD", code: []uint16{0xbb29, 0x0318}, regs: map[int]uint16{1: 0x3006, 2: 0x2006, 3: 3},
+			mem:     map[uint32]uint16{0x2006: 4},
+			wantMem: map[uint32]uint16{0x3006: 4},
+			want:    map[int]uint16{1: 0x3004, 2: 0x2004, 3: 2}, clear: FlagPV},
+		{name: "CPIRB", code: []uint16{0xba24, 0x0386}, regs: map[int]uint16{0: 0x0033, 2: 0x2000, 3: 4},
+			mem:  map[uint32]uint16{0x2000: 0x1122, 0x2002: 0x3344},
+			want: map[int]uint16{2: 0x2003, 3: 1}, set: FlagZ, clear: FlagPV},
+		{name: "CPIRB not found", code: []uint16{0xba24, 0x0386}, regs: map[int]uint16{0: 0x0044, 2: 0x2000, 3: 2},
+			mem:  map[uint32]uint16{0x2000: 0x1122, 0x2002: 0x3344},
+			want: map[int]uint16{2: 0x2002, 3: 0}, set: FlagPV, clear: FlagZ},
+		{name: "CPSI", code: []uint16{0xbb22, 0x0316}, regs: map[int]uint16{1: 0x3000, 2: 0x2000, 3: 2},
+			mem:  map[uint32]uint16{0x2000: 5, 0x3000: 5},
+			want: map[int]uint16{1: 0x3002, 2: 0x2002, 3: 1}, set: FlagZ},
+		{name: "PUSH POP", code: []uint16{0x93f1, 0x97f2}, regs: map[int]uint16{1: 0xabcd},
+			want: map[int]uint16{2: 0xabcd, 15: 0xf000}, wantMem: map[uint32]uint16{0xeffe: 0xabcd}},
+		{name: "PUSH immediate", code: []uint16{0x0df9, 0x1234, 0x97f2},
+			want: map[int]uint16{2: 0x1234, 15: 0xf000}},
+		{name: "PUSHL", code: []uint16{0x91f2, 0x97f4, 0x97f5}, regs: map[int]uint16{2: 0x1111, 3: 0x2222},
+			want: map[int]uint16{4: 0x1111, 5: 0x2222, 15: 0xf000}},
+	}
+
+	for _, test := range tests {
+		c, mem := newCPU(Z8002, 0x1000, append(test.code, halt)...)
+		for r, val := range test.regs {
+			c.R[r] = val
+		}
+		for addr, val := range test.mem {
+			mem.Write(addr, []byte{byte(val >> 8), byte(val)}, SpaceData)
+		}
+		if err := c.Run(0); err != ErrHalt {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for r, val := range test.want {
+			if c.R[r] != val {
+				t.Errorf("%s: R%d %04x, want %04x", test.name, r, c.R[r], val)
+			}
+		}
+		for addr, val := range test.wantMem {
+			data := mem.Read(addr, 2, SpaceData)
+			if got := uint16(data[0])<<8 | uint16(data[1]); got != val {
+				t.Errorf("%s: memory %04x %04x, want %04x", test.name, addr, got, val)
+			}
+		}
+		if c.FCW&test.set != test.set {
+			t.Errorf("%s: FCW %04x, want %04x set", test.name, c.FCW, test.set)
+		}
+		if c.FCW&test.clear != 0 {
+			t.Errorf("%s: FCW %04x, want %04x cleared", test.name, c.FCW, test.clear)
+		}
+	}
+}
+
+func TestControl(t *testing.T) {
+	// DJNZ loop
+	c, _ := newCPU(Z8002, 0x1000, 0xbd10, 0xbd25, 0xa911, 0xf282, halt)
+	if err := c.Run(0); err != ErrHalt || c.R[1] != 10 || c.R[2] != 0 {
+		t.Errorf("DJNZ: %v R1 %d R2 %d", err, c.R[1], c.R[2])
+	}
+	if c.Cycles == 0 {
+		t.Error("no cycles counted")
+	}
+
+	// CALL, CALR, RET, JR
+	c, _ = newCPU(Z8002, 0x1000,
+		0x5f00, 0x1010, // 1000 CALL 1010
+		0xdff9, // 1004 CALR 1014
+		0xe801, // 1006 JR T,100a
+		0xbd3f, // 1008 LDK R3,#15
+		halt,   // 100a
+		0, 0,
+		0xbd17, 0x9e08, // 1010 LDK R1,#7; RET
+		0xbd28, 0x9e08, // 1014 LDK R2,#8; RET
+	)
+	if err := c.Run(0); err != ErrHalt {
+		t.Fatal(err)
+	}
+	if c.R[1] != 7 || c.R[2] != 8 || c.R[3] != 0 || c.R[15] != 0xf000 || c.PC != 0x100c {
+		t.Errorf("calls: R1 %d R2 %d R3 %d SP %04x PC %04x", c.R[1], c.R[2], c.R[3], c.R[15], c.PC)
+	}
+
+	// JP cc and breakpoints
+	c, _ = newCPU(Z8002, 0x1000, 0x8d41, 0x5e0e, 0x2000, 0x5e06, 0x100c, halt, halt)
+	c.Breakpoints[0x100c] = true
+	steps := 0
+	c.Trace = func(c *CPU) { steps++ }
+	if err := c.Run(0); err != ErrBreakpoint || c.PC != 0x100c || steps != 3 {
+		t.Errorf("breakpoint: %v PC %04x steps %d", err, c.PC, steps)
+	}
+	if err := c.Run(0); err != ErrHalt || c.PC != 0x100e {
+		t.Errorf("resume: %v PC %04x", err, c.PC)
+	}
+	if err := c.Step(); err != ErrHalt {
+		t.Errorf("halted: %v", err)
+	}
+
+	// Unimplemented
+	c, _ = newCPU(Z8002, 0x1000, 0x3800)
+	if err, ok := c.Run(0).(*Error); !ok || err.PC != 0x1000 || err.Op != 0x3800 {
+		t.Errorf("unimplemented: %v", err)
+	}
+}
+
+/* A Z8002 in normal mode, with the program status area at 0x0800 */
+func normalCPU(code ...uint16) (*CPU, *Memory) {
+	c, mem := newCPU(Z8002, 0x1000, code...)
+	c.PSAP = 0x0800
+	for kind, pc := range map[Trap]uint16{TrapPrivileged: 0x2000, TrapSystemCall: 0x2100,
+		IntNVI: 0x2200, IntVI: 0x2300} {
+		c.writeWord(0x0800+uint32(kind)*4, FlagSys, SpaceProgram)
+		c.writeWord(0x0802+uint32(kind)*4, pc, SpaceProgram)
+	}
+	c.writeWord(0x0824, 0x2400, SpaceProgram) // vector 3
+	c.writeWord(0x2100, 0x7b00, SpaceProgram) // IRET
+	c.setFCW(FlagNVIE | FlagVIE)
+	c.SetSP(0xe000)
+	return c, mem
+}
+
+func TestTraps(t *testing.T) {
+	c, _ := normalCPU(0x7f05, 0x7a00)
+	if err := c.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if c.PC != 0x2100 || c.FCW != FlagSys || c.R[15] != 0xeffa {
+		t.Errorf("SC: PC %04x FCW %04x SP %04x", c.PC, c.FCW, c.R[15])
+	}
+	for idx, want := range []uint16{0x7f05, FlagNVIE | FlagVIE, 0x1002} {
+		if got := c.readWord(0xeffa+uint32(idx)*2, SpaceStack); got != want {
+			t.Errorf("SC: stack %d %04x, want %04x", idx, got, want)
+		}
+	}
+	c.Step() // IRET
+	if c.PC != 0x1002 || c.FCW != FlagNVIE|FlagVIE || c.R[15] != 0xe000 {
+		t.Errorf("IRET: PC %04x FCW %04x SP %04x", c.PC, c.FCW, c.R[15])
+	}
+	c.Step() // HALT in normal mode
+	if c.PC != 0x2000 || c.Halted || c.readWord(0xeffa, SpaceStack) != 0x7a00 {
+		t.Errorf("privileged: PC %04x halted %v", c.PC, c.Halted)
+	}
+
+	// Interrupts
+	c, _ = normalCPU(0x8d07, 0x8d07)
+	c.Interrupt(IntVI, 3)
+	c.Step()
+	if c.PC != 0x2400 || c.FCW&FlagSys == 0 {
+		t.Errorf("VI: PC %04x FCW %04x", c.PC, c.FCW)
+	}
+	c, _ = normalCPU(0x8d07, 0x8d07)
+	c.setFCW(0)
+	c.Interrupt(IntNVI, 0)
+	c.Step()
+	if c.PC != 0x1002 {
+		t.Errorf("disabled NVI: PC %04x", c.PC)
+	}
+	c.setFCW(FlagNVIE)
+	c.Step()
+	if c.PC != 0x2200 {
+		t.Errorf("NVI: PC %04x", c.PC)
+	}
+
+	// System call hook
+	c, _ = normalCPU(0x7f02, halt)
+	c.SystemCall = func(c *CPU, code byte) error {
+		c.R[7] = uint16(code) + c.R[5]
+		return nil
+	}
+	c.R[5] = 10
+	c.Step()
+	if c.R[7] != 12 || c.PC != 0x1002 {
+		t.Errorf("hook: R7 %d PC %04x", c.R[7], c.PC)
+	}
+
+	// Control registers, DI and EI
+	c, _ = newCPU(Z8002, 0x1000, 0x7d12, 0x7c03, 0x7d22, 0x7c01, 0x7d32, 0x7d4f, 0x7d47, halt)
+	c.FCW |= FlagVIE | FlagNVIE
+	c.R[4] = 0xd000
+	c.Run(0)
+	if c.R[1] != FlagSys|FlagVIE|FlagNVIE || c.R[2] != FlagSys|FlagVIE|FlagNVIE ||
+		c.R[3] != FlagSys|FlagNVIE || c.bank[1] != 0xd000 {
+		t.Errorf("LDCTL: %04x %04x %04x NSP %04x", c.R[1], c.R[2], c.R[3], c.bank[1])
+	}
+}
+
+func TestSegmented(t *testing.T) {
+	c, mem := newCPU(Z8001, 0x010000,
+		0x6101, 0x8500, 0x1234, // LD R1,<<5>>1234
+		0x6102, 0x0512, // LD R2,<<5>>12
+		0x7604, 0x8300, 0x0010, // LDA RR4,<<3>>0010
+		0x2146,                 // LD R6,@RR4
+		0x5f00, 0x8200, 0x0000, // CALL <<2>>0000
+		halt,
+	)
+	mem.Write(0x051234, []byte{0x11, 0x11}, SpaceData)
+	mem.Write(0x050012, []byte{0x22, 0x22}, SpaceData)
+	mem.Write(0x030010, []byte{0x33, 0x33}, SpaceData)
+	mem.Write(0x020000, []byte{0xbd, 0x79, 0x9e, 0x08}, SpaceProgram) // LDK R7,#9; RET
+	var sp [2]uint16
+	c.Trace = func(c *CPU) {
+		if c.PC == 0x020002 {
+			sp = [2]uint16{c.R[14], c.R[15]}
+		}
+	}
+	if err := c.Run(0); err != ErrHalt {
+		t.Fatal(err)
+	}
+	if c.R[1] != 0x1111 || c.R[2] != 0x2222 || c.R[4] != 0x0300 || c.R[5] != 0x0010 ||
+		c.R[6] != 0x3333 || c.R[7] != 9 || c.PC != 0x01001a {
+		t.Errorf("segmented: R %04x PC %06x", c.R, c.PC)
+	}
+	if sp != [2]uint16{0x0100, 0xeffc} || c.readWord(0x01effc, SpaceStack) != 0x0100 ||
+		c.readWord(0x01effe, SpaceStack) != 0x0018 {
+		t.Errorf("segmented call: SP %04x", sp)
+	}
+
+	// SC trap
+	c, _ = newCPU(Z8001, 0x010000, 0x7f01)
+	c.writeWord(0x001a, FlagSys|FlagSEG, SpaceProgram)
+	c.writeWord(0x001c, 0x0400, SpaceProgram)
+	c.writeWord(0x001e, 0x0100, SpaceProgram)
+	c.Step()
+	if c.PC != 0x040100 || c.R[15] != 0xeff8 {
+		t.Errorf("segmented SC: PC %06x SP %04x", c.PC, c.R[15])
+	}
+	for idx, want := range []uint16{0x7f01, FlagSys | FlagSEG, 0x0100, 0x0002} {
+		if got := c.readWord(0x01eff8+uint32(idx)*2, SpaceStack); got != want {
+			t.Errorf("segmented SC: stack %d %04x, want %04x", idx, got, want)
+		}
+	}
+}
+
+func TestLoadXout(t *testing.T) {
+	obj := &xouttest.Object{Magic: binlib.XoutMagicNonSeg}
+	obj.Segs = []binlib.XoutSeg{
+		{Type: binlib.XoutSegCODE, Length: 6},
+		{Type: binlib.XoutSegDATA, Length: 2},
+	}
+	obj.Code = []byte{0x61, 0x01, 0x00, 0x00, 0x7a, 0x00, 0xbe, 0xef}
+	obj.Relocs = []binlib.XoutRelocItem{{SegIdx: 0, Type: binlib.XoutRelocOFF, Location: 2, SymbIdx: 1}}
+	xf := obj.XoutFile()
+
+	mem := NewMemory()
+	entry, err := mem.LoadXout(xf, []uint32{0x1000, 0x2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(Z8002, mem)
+	c.Start(xf.Header.Magic, entry)
+	if err := c.Run(0); err != ErrHalt || c.R[1] != 0xbeef {
+		t.Errorf("load: %v R1 %04x", err, c.R[1])
+	}
+
+	// Split I/D, code and data at 0
+	obj.Magic = binlib.XoutMagicNonSegXSplit
+	obj.Relocs = nil
+	xf = obj.XoutFile()
+	mem = NewMemory()
+	if entry, err = mem.LoadXout(xf, nil); err != nil || entry != 0 || !mem.Split {
+		t.Fatalf("split: %v entry %04x", err, entry)
+	}
+	c = New(Z8002, mem)
+	c.Start(xf.Header.Magic, entry)
+	if err := c.Run(0); err != ErrHalt || c.R[1] != 0xbeef {
+		t.Errorf("split: %v R1 %04x", err, c.R[1])
+	}
+}
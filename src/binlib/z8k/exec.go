@@ -0,0 +1,669 @@
+/*
+ *  exec.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Decoding and execution of the instructions
+ *  The first instruction word is mmoooooo ssssdddd, mm is the addressing
+ *  mode, oooooo the operation, and ssss and dddd are register fields.
+ *  The field of the addressing mode is ssss except for PUSH and POP.
+ *  Opcodes 0xc0-0xff are LDB Rbd,#data, CALR, JR and DJNZ.
+ */
+
+package z8k
+
+func (c *CPU) exec() error {
+	op := c.op
+	hi := int(op >> 4 & 0xf)
+	lo := int(op & 0xf)
+	switch op >> 12 {
+	case 0xc: /* LDB Rbd,#data */
+		c.setRegByte(int(op>>8&0xf), byte(op))
+		return nil
+	case 0xd: /* CALR disp12 */
+		disp := int(op & 0xfff)
+		if disp&0x800 != 0 {
+			disp -= 0x1000
+		}
+		c.pushPC()
+		c.PC = addOff(c.PC, -2*disp)
+		c.Cycles += 4
+		return nil
+	case 0xe: /* JR cc,disp8 */
+		if c.cond(int(op >> 8 & 0xf)) {
+			c.PC = addOff(c.PC, 2*int(int8(op)))
+		}
+		return nil
+	case 0xf: /* DJNZ and DBJNZ */
+		r := int(op >> 8 & 0xf)
+		var val uint16
+		if op&0x80 != 0 {
+			c.R[r]--
+			val = c.R[r]
+		} else {
+			c.setRegByte(r, c.regByte(r)-1)
+			val = uint16(c.regByte(r))
+		}
+		if val != 0 {
+			c.PC = addOff(c.PC, -2*int(op&0x7f))
+		}
+		return nil
+	}
+
+	mode := int(op >> 14)
+	code := int(op >> 8 & 0x3f)
+	switch {
+	case code <= 0x0b:
+		c.execALU(code, hi, lo)
+	case code == 0x0c || code == 0x0d:
+		return c.execSingle(mode, code, hi, lo)
+	case code == 0x0e || code == 0x0f:
+		c.trap(TrapExtended, op)
+	case code == 0x10 || code == 0x12 || code == 0x16:
+		src := c.load(c.operand(hi, 4), 4)
+		dst := c.reg(lo, 4)
+		switch code {
+		case 0x10:
+			c.sub(dst, src, 0, 4)
+		case 0x12:
+			c.setReg(lo, 4, c.sub(dst, src, 0, 4))
+		default:
+			c.setReg(lo, 4, c.add(dst, src, 0, 4))
+		}
+	case code == 0x11 || code == 0x13: /* PUSHL, PUSH */
+		size := 4
+		if code == 0x13 {
+			size = 2
+		}
+		val := c.load(c.operand(lo, size), size)
+		if size == 4 {
+			c.push(hi, uint16(val))
+			val >>= 16
+		}
+		c.push(hi, uint16(val))
+	case code == 0x15 || code == 0x17: /* POPL, POP */
+		size := 4
+		if code == 0x17 {
+			size = 2
+		}
+		dst := c.operand(lo, size)
+		val := uint32(c.pop(hi))
+		if size == 4 {
+			val = val<<16 | uint32(c.pop(hi))
+		}
+		c.store(dst, size, val)
+	case code == 0x14: /* LDL RRd,src */
+		c.setReg(lo, 4, c.load(c.operand(hi, 4), 4))
+	case code >= 0x18 && code <= 0x1b:
+		return c.execMultDiv(code, hi, lo)
+	case code == 0x1c:
+		return c.execLDM(mode, hi, lo)
+	case code == 0x1d: /* LDL dst,RRs */
+		if mode == 2 {
+			return c.unimplemented()
+		}
+		c.store(c.operand(hi, 4), 4, c.reg(lo, 4))
+	case code == 0x1e:
+		if mode == 2 { /* RET cc */
+			if c.cond(lo) {
+				c.popPC()
+			}
+		} else { /* JP cc,dst */
+			addr := c.operandAddr(hi)
+			if c.cond(lo) {
+				c.PC = addr
+			}
+		}
+	case code == 0x1f: /* CALL dst */
+		if mode == 2 {
+			return c.unimplemented()
+		}
+		addr := c.operandAddr(hi)
+		c.pushPC()
+		c.PC = addr
+		c.Cycles += 4
+	case code == 0x20 || code == 0x21: /* LDB, LD Rd,src */
+		size := 1 + code&1
+		c.setReg(lo, size, c.load(c.operand(hi, size), size))
+	case code >= 0x22 && code <= 0x27:
+		c.execBit(mode, code, hi, lo)
+	case code >= 0x28 && code <= 0x2b: /* INC, DEC */
+		size := 1 + code&1
+		dst := c.operand(hi, size)
+		val := c.load(dst, size)
+		saved := c.FCW & (FlagC | FlagDA | FlagH)
+		if code&2 == 0 {
+			val = c.add(val, uint32(lo+1), 0, size)
+		} else {
+			val = c.sub(val, uint32(lo+1), 0, size)
+		}
+		c.FCW = c.FCW&^(FlagC|FlagDA|FlagH) | saved
+		c.store(dst, size, val)
+	case code == 0x2c || code == 0x2d: /* EXB, EX */
+		size := 1 + code&1
+		src := c.operand(hi, size)
+		val := c.load(src, size)
+		c.store(src, size, c.reg(lo, size))
+		c.setReg(lo, size, val)
+	case code == 0x2e || code == 0x2f:
+		size := 1 + code&1
+		if mode == 2 { /* TCCB, TCC */
+			if c.cond(lo) {
+				c.setReg(hi, size, c.reg(hi, size)|1)
+			}
+		} else { /* LDB, LD dst,Rs */
+			c.store(c.operand(hi, size), size, c.reg(lo, size))
+		}
+	case code >= 0x30 && code <= 0x37:
+		if mode == 2 {
+			return c.execReg(code, hi, lo)
+		}
+		return c.execBased(mode, code, hi, lo)
+	case code == 0x39: /* LDPS src */
+		if mode == 2 {
+			return c.unimplemented()
+		}
+		addr := c.operandAddr(hi)
+		if c.privileged() {
+			return nil
+		}
+		if c.seg() {
+			fcw := c.readWord(addOff(addr, 2), SpaceData)
+			seg := c.readWord(addOff(addr, 4), SpaceData)
+			off := c.readWord(addOff(addr, 6), SpaceData)
+			c.setFCW(fcw)
+			c.PC = uint32(seg&0x7f00)<<8 | uint32(off)
+		} else {
+			fcw := c.readWord(addr, SpaceData)
+			pc := c.readWord(addOff(addr, 2), SpaceData)
+			c.setFCW(fcw)
+			c.PC = c.PC&0x7f0000 | uint32(pc)
+		}
+	case code >= 0x3a:
+		return c.execControl(mode, code, hi, lo)
+	default:
+		return c.unimplemented()
+	}
+	return nil
+}
+
+/* ADD, SUB, OR, AND, XOR and CP, of bytes and words */
+func (c *CPU) execALU(code, hi, lo int) {
+	size := 1 + code&1
+	src := c.load(c.operand(hi, size), size)
+	dst := c.reg(lo, size)
+	switch code >> 1 {
+	case 0:
+		c.setReg(lo, size, c.add(dst, src, 0, size))
+	case 1:
+		c.setReg(lo, size, c.sub(dst, src, 0, size))
+	case 2:
+		c.setReg(lo, size, c.logic(dst|src, size))
+	case 3:
+		c.setReg(lo, size, c.logic(dst&src, size))
+	case 4:
+		c.setReg(lo, size, c.logic(dst^src, size))
+	case 5:
+		c.sub(dst, src, 0, size)
+	}
+}
+
+/* Fetch immediate data, a byte is the low byte of a word */
+func (c *CPU) fetchImm(size int) uint32 {
+	switch size {
+	case 1:
+		return uint32(c.fetch() & 0xff)
+	case 2:
+		return uint32(c.fetch())
+	}
+	val := uint32(c.fetch()) << 16
+	return val | uint32(c.fetch())
+}
+
+/*
+ * COM, CP #data, NEG, TEST, LD #data, TSET, CLR and PUSH #data of the
+ * operand in ssss, and flag operations of the R mode
+ */
+func (c *CPU) execSingle(mode, code, hi, lo int) error {
+	size := 1 + code&1
+	if mode == 2 && lo&1 != 0 {
+		flags := uint16(hi) << 4
+		switch {
+		case code == 0x0c && lo == 1: /* LDCTLB Rbd,FLAGS */
+			c.setRegByte(hi, byte(c.FCW))
+		case code == 0x0c && lo == 9: /* LDCTLB FLAGS,Rbs */
+			c.FCW = c.FCW&0xff00 | uint16(c.regByte(hi))&0xfc
+		case code == 0x0d && lo == 1: /* SETFLG */
+			c.FCW |= flags
+		case code == 0x0d && lo == 3: /* RESFLG */
+			c.FCW &^= flags
+		case code == 0x0d && lo == 5: /* COMFLG */
+			c.FCW ^= flags
+		case code == 0x0d && lo == 7: /* NOP */
+		default:
+			return c.unimplemented()
+		}
+		return nil
+	}
+	if code == 0x0d && mode == 0 && lo == 9 { /* PUSH @Rd,#data */
+		c.push(hi, uint16(c.fetchImm(2)))
+		return nil
+	}
+
+	dst := c.operand(hi, size)
+	switch lo {
+	case 0: /* COM */
+		c.store(dst, size, c.logic(^c.load(dst, size), size))
+	case 1: /* CP dst,#data */
+		val := c.load(dst, size)
+		c.sub(val, c.fetchImm(size), 0, size)
+	case 2: /* NEG */
+		c.store(dst, size, c.sub(0, c.load(dst, size), 0, size))
+	case 4: /* TEST */
+		c.logic(c.load(dst, size), size)
+	case 5: /* LD dst,#data */
+		c.store(dst, size, c.fetchImm(size))
+	case 6: /* TSET */
+		val := c.load(dst, size)
+		c.setFlag(FlagS, val&signBit(size) != 0)
+		c.store(dst, size, mask(size))
+	case 8: /* CLR */
+		c.store(dst, size, 0)
+	default:
+		return c.unimplemented()
+	}
+	return nil
+}
+
+/* MULTL, MULT, DIVL and DIV */
+func (c *CPU) execMultDiv(code, hi, lo int) error {
+	switch code {
+	case 0x19: /* MULT RRd,src */
+		src := int64(int16(c.load(c.operand(hi, 2), 2)))
+		prod := int64(int16(c.R[lo|1])) * src
+		c.setReg(lo, 4, uint32(prod))
+		c.setMultFlags(prod, prod < -0x8000 || prod > 0x7fff)
+		c.Cycles += 60
+	case 0x18: /* MULTL RQd,src */
+		src := int64(int32(c.load(c.operand(hi, 4), 4)))
+		prod := int64(int32(c.reg(lo|2, 4))) * src
+		c.setReg(lo&0xc, 4, uint32(uint64(prod)>>32))
+		c.setReg(lo&0xc|2, 4, uint32(prod))
+		c.setMultFlags(prod, prod < -0x80000000 || prod > 0x7fffffff)
+		c.Cycles += 270
+	case 0x1b: /* DIV RRd,src */
+		src := int64(int16(c.load(c.operand(hi, 2), 2)))
+		c.Cycles += 100
+		if c.divide(int64(int32(c.reg(lo, 4))), src, 2) {
+			quot := int64(int32(c.reg(lo, 4))) / src
+			rem := int64(int32(c.reg(lo, 4))) % src
+			c.R[lo|1] = uint16(quot)
+			c.R[lo&0xe] = uint16(rem)
+		}
+	case 0x1a: /* DIVL RQd,src */
+		src := int64(int32(c.load(c.operand(hi, 4), 4)))
+		n := lo & 0xc
+		dividend := int64(uint64(c.reg(n, 4))<<32 | uint64(c.reg(n|2, 4)))
+		c.Cycles += 730
+		if c.divide(dividend, src, 4) {
+			c.setReg(n|2, 4, uint32(dividend/src))
+			c.setReg(n, 4, uint32(dividend%src))
+		}
+	}
+	return nil
+}
+
+func (c *CPU) setMultFlags(prod int64, carry bool) {
+	c.setFlag(FlagC, carry)
+	c.setFlag(FlagZ, prod == 0)
+	c.setFlag(FlagS, prod < 0)
+	c.setFlag(FlagPV, false)
+}
+
+/*
+ * Set the flags of a division, and return true when the quotient fits.
+ * Division by zero sets V and Z, an overflow sets V, the registers are
+ * unchanged then.
+ */
+func (c *CPU) divide(dividend, divisor int64, size int) bool {
+	c.setFlag(FlagC, false)
+	if divisor == 0 {
+		c.setFlag(FlagPV, true)
+		c.setFlag(FlagZ, true)
+		c.setFlag(FlagS, false)
+		return false
+	}
+	quot := dividend / divisor
+	if quot != signed(uint32(quot), size) {
+		c.setFlag(FlagPV, true)
+		c.setFlag(FlagZ, false)
+		c.setFlag(FlagS, quot < 0)
+		return false
+	}
+	c.setFlag(FlagPV, false)
+	c.setFlag(FlagZ, quot == 0)
+	c.setFlag(FlagS, quot < 0)
+	return true
+}
+
+/* TESTL and LDM */
+func (c *CPU) execLDM(mode, hi, lo int) error {
+	switch lo {
+	case 8: /* TESTL dst */
+		c.setZS(c.load(c.operand(hi, 4), 4), 4)
+	case 1, 9: /* LDM Rd,src,#n and LDM dst,Rs,#n */
+		if mode == 2 {
+			return c.unimplemented()
+		}
+		word := c.fetch()
+		r := int(word >> 8 & 0xf)
+		n := int(word&0xf) + 1
+		addr := c.operandAddr(hi)
+		for idx := 0; idx < n; idx++ {
+			reg := (r + idx) & 0xf
+			if lo == 1 {
+				c.R[reg] = c.readWord(addr, SpaceData)
+			} else {
+				c.writeWord(addr, c.R[reg], SpaceData)
+			}
+			addr = addOff(addr, 2)
+		}
+	default:
+		return c.unimplemented()
+	}
+	return nil
+}
+
+/* RESB, RES, SETB, SET, BITB and BIT, static or dynamic */
+func (c *CPU) execBit(mode, code, hi, lo int) {
+	size := 1 + code&1
+	var dst operand
+	var bit uint
+	if mode == 0 && hi == 0 {
+		word := c.fetch()
+		dst = operand{reg: int(word >> 8 & 0xf)}
+		bit = uint(c.R[lo]) & uint(size*8-1)
+	} else {
+		dst = c.operand(hi, size)
+		bit = uint(lo) & uint(size*8-1)
+	}
+	val := c.load(dst, size)
+	switch (code - 0x22) >> 1 {
+	case 0:
+		c.store(dst, size, val&^(1<<bit))
+	case 1:
+		c.store(dst, size, val|1<<bit)
+	case 2:
+		c.setFlag(FlagZ, val&(1<<bit) == 0)
+	}
+}
+
+/* Relative, based and based indexed loads and stores, and LDA */
+func (c *CPU) execBased(mode, code, hi, lo int) error {
+	if code == 0x36 {
+		if mode == 0 {
+			return c.unimplemented()
+		}
+		c.setRegAddr(lo, c.operandAddr(hi)) /* LDA Rd,address */
+		return nil
+	}
+	var addr uint32
+	space := SpaceData
+	switch {
+	case mode == 0 && hi == 0: /* relative */
+		disp := int(int16(c.fetch()))
+		addr = addOff(c.PC, disp)
+		space = SpaceProgram
+	case mode == 0: /* based */
+		disp := int(int16(c.fetch()))
+		addr = addOff(c.regAddr(hi), disp)
+	default: /* based indexed */
+		word := c.fetch()
+		addr = addOff(c.regAddr(hi), int(c.R[word>>8&0xf]))
+	}
+	switch code {
+	case 0x30, 0x31, 0x35:
+		size := [...]int{1, 2, 0, 0, 0, 4}[code-0x30]
+		c.setReg(lo, size, c.readMem(addr, size, space))
+	case 0x32, 0x33, 0x37:
+		size := [...]int{0, 0, 1, 2, 0, 0, 0, 4}[code-0x30]
+		c.writeMem(addr, size, c.reg(lo, size), space)
+	case 0x34:
+		c.setRegAddr(lo, addr)
+	}
+	return nil
+}
+
+/* DAB, EXTS, rotates and shifts, ADC and SBC, on registers */
+func (c *CPU) execReg(code, hi, lo int) error {
+	switch code {
+	case 0x30: /* DAB Rbd */
+		c.setRegByte(hi, c.dab(c.regByte(hi)))
+	case 0x31:
+		switch lo {
+		case 0x0: /* EXTSB Rd */
+			c.R[hi] = uint16(int8(c.R[hi]))
+		case 0xa: /* EXTS RRd */
+			c.setReg(hi, 4, uint32(int32(int16(c.R[hi|1]))))
+		case 0x7: /* EXTSL RQd */
+			var ext uint32
+			if c.reg(hi|2, 4)&0x80000000 != 0 {
+				ext = 0xffffffff
+			}
+			c.setReg(hi&0xc, 4, ext)
+		default:
+			return c.unimplemented()
+		}
+	case 0x32, 0x33:
+		size := 1 + code&1
+		if lo&1 == 0 { /* RL, RLC, RR, RRC by 1 or 2 */
+			count := 1 + lo>>1&1
+			val := c.rotate(c.reg(hi, size), size, count, lo&4 == 0, lo&8 != 0)
+			c.setReg(hi, size, val)
+			c.Cycles += uint64(2 * count)
+			return nil
+		}
+		if lo&4 != 0 {
+			if size == 1 {
+				return c.unimplemented()
+			}
+			size = 4
+		}
+		word := c.fetch()
+		count := int(int16(word))
+		if lo&2 != 0 { /* SDL, SDA, by a register */
+			count = int(int16(c.R[word>>8&0xf]))
+		} else if size == 1 {
+			count = int(int8(word))
+		}
+		c.setReg(hi, size, c.shift(c.reg(hi, size), size, count, lo&8 != 0))
+		if count < 0 {
+			count = -count
+		}
+		c.Cycles += uint64(2 * count)
+	case 0x34, 0x35: /* ADCB, ADC */
+		size := 1 + code&1
+		c.setReg(lo, size, c.add(c.reg(lo, size), c.reg(hi, size), c.carry(), size))
+	case 0x36, 0x37: /* SBCB, SBC */
+		size := 1 + code&1
+		c.setReg(lo, size, c.sub(c.reg(lo, size), c.reg(hi, size), c.carry(), size))
+	}
+	return nil
+}
+
+/* I/O, block transfers and compares, and the CPU control instructions */
+func (c *CPU) execControl(mode, code, hi, lo int) error {
+	size := 1 + code&1
+	byteIO := size == 1
+	switch {
+	case mode == 2 && (code == 0x3a || code == 0x3b):
+		return c.execBlock(size, hi, lo)
+	case mode == 0 && (code == 0x3a || code == 0x3b) && (lo == 4 || lo == 6):
+		port := c.fetch()
+		if c.privileged() {
+			return nil
+		}
+		if lo == 4 { /* IN Rd,#port */
+			c.setReg(hi, size, uint32(c.Bus.In(port, byteIO)))
+		} else { /* OUT #port,Rs */
+			c.Bus.Out(port, uint16(c.reg(hi, size)), byteIO)
+		}
+	case mode == 0 && (code == 0x3c || code == 0x3d): /* IN Rd,@Rs */
+		if c.privileged() {
+			return nil
+		}
+		c.setReg(lo, size, uint32(c.Bus.In(c.R[hi], byteIO)))
+	case mode == 0 && (code == 0x3e || code == 0x3f): /* OUT @Rd,Rs */
+		if c.privileged() {
+			return nil
+		}
+		c.Bus.Out(c.R[hi], uint16(c.reg(lo, size)), byteIO)
+	case mode == 1 && code == 0x3a && hi == 0 && lo == 0: /* HALT */
+		if c.privileged() {
+			return nil
+		}
+		c.Halted = true
+		return ErrHalt
+	case mode == 1 && code == 0x3b && hi == 0:
+		if c.privileged() {
+			return nil
+		}
+		switch lo {
+		case 0x0: /* IRET */
+			c.iret()
+		case 0x8, 0x9: /* MSET, MRES */
+		case 0xa: /* MBIT, no other CPU */
+			c.setFlag(FlagS, false)
+		default:
+			return c.unimplemented()
+		}
+	case mode == 1 && code == 0x3b && lo == 0xd: /* MREQ Rd */
+		if c.privileged() {
+			return nil
+		}
+		c.setFlag(FlagZ, false)
+		c.setFlag(FlagS, false)
+	case mode == 1 && code == 0x3c && hi == 0 && lo&8 == 0:
+		/* DI and EI, the VI and NVI bits are 0 for the affected ones */
+		if c.privileged() {
+			return nil
+		}
+		var bits uint16
+		if lo&2 == 0 {
+			bits |= FlagVIE
+		}
+		if lo&1 == 0 {
+			bits |= FlagNVIE
+		}
+		if lo&4 != 0 {
+			c.FCW |= bits
+		} else {
+			c.FCW &^= bits
+		}
+	case mode == 1 && code == 0x3d:
+		return c.execLDCTL(hi, lo)
+	case mode == 2 && code == 0x3d: /* LDK Rd,#n */
+		c.R[hi] = uint16(lo)
+	case mode == 1 && code == 0x3f: /* SC #n */
+		if c.SystemCall != nil {
+			return c.SystemCall(c, byte(c.op))
+		}
+		c.trap(TrapSystemCall, c.op)
+	default:
+		return c.unimplemented()
+	}
+	return nil
+}
+
+/* LDCTL Rd,ctl and LDCTL ctl,Rs */
+func (c *CPU) execLDCTL(hi, lo int) error {
+	if lo&7 < 2 {
+		return c.unimplemented()
+	}
+	if c.privileged() {
+		return nil
+	}
+	var ctl *uint16
+	psapSeg := uint16(c.PSAP>>8) & 0x7f00
+	psapOff := uint16(c.PSAP)
+	switch lo & 7 {
+	case 3:
+		ctl = &c.Refresh
+	case 4:
+		ctl = &psapSeg
+	case 5:
+		ctl = &psapOff
+	case 6:
+		ctl = &c.bank[0]
+	case 7:
+		ctl = &c.bank[1]
+	}
+	if lo&8 == 0 {
+		if ctl == nil {
+			c.R[hi] = c.FCW
+		} else {
+			c.R[hi] = *ctl
+		}
+		return nil
+	}
+	if ctl == nil {
+		c.setFCW(c.R[hi])
+		return nil
+	}
+	*ctl = c.R[hi]
+	c.PSAP = uint32(psapSeg&0x7f00)<<8 | uint32(psapOff)
+	return nil
+}
+
+/*
+ * LDI, LDIR, LDD, LDDR, CPI, CPIR, CPD, CPDR, CPSI, CPSIR, CPSD and CPSDR
+ * The second word is 0000 rrrr dddd cccc, the counter, the destination
+ * and the condition. The repeated ones run to the end in a step.
+ */
+func (c *CPU) execBlock(size, s, sub int) error {
+	word := c.fetch()
+	r := int(word >> 8 & 0xf)
+	d := int(word >> 4 & 0xf)
+	cc := int(word & 0xf)
+	step := size
+	if sub&8 != 0 {
+		step = -size
+	}
+	switch sub {
+	case 0x1, 0x9:
+		for {
+			val := c.readMem(c.regAddr(s), size, SpaceData)
+			c.writeMem(c.regAddr(d), size, val, SpaceData)
+			c.incRegAddr(s, step)
+			c.incRegAddr(d, step)
+			c.R[r]--
+			if cc != 0 || c.R[r] == 0 {
+				break
+			}
+		}
+	case 0x0, 0x4, 0x8, 0xc, 0x2, 0x6, 0xa, 0xe:
+		for {
+			var dst uint32
+			if sub&2 != 0 {
+				dst = c.readMem(c.regAddr(d), size, SpaceData)
+				c.incRegAddr(d, step)
+			} else {
+				dst = c.reg(d, size)
+			}
+			c.sub(dst, c.readMem(c.regAddr(s), size, SpaceData), 0, size)
+			met := c.cond(cc)
+			c.setFlag(FlagZ, met)
+			c.incRegAddr(s, step)
+			c.R[r]--
+			if sub&4 == 0 || met || c.R[r] == 0 {
+				break
+			}
+		}
+	default:
+		return c.unimplemented()
+	}
+	c.setFlag(FlagPV, c.R[r] == 0)
+	return nil
+}
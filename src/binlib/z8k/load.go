@@ -0,0 +1,60 @@
+/*
+ *  load.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Loading XOUT files into the memory
+ */
+
+package z8k
+
+import (
+	"binlib"
+)
+
+// LoadSegs stores relocated segments, code goes to the program space.
+// It returns the address of the first code segment as the entry.
+func (m *Memory) LoadSegs(segs []binlib.XoutLoadSeg) uint32 {
+	var entry uint32
+	found := false
+	for _, seg := range segs {
+		space := SpaceData
+		switch seg.Type {
+		case binlib.XoutSegCODE, binlib.XoutSegCDMIX, binlib.XoutSegCDMIX_P:
+			space = SpaceProgram
+			if !found {
+				entry, found = seg.Addr, true
+			}
+		}
+		m.Write(seg.Addr, seg.Data, space)
+	}
+	return entry
+}
+
+// LoadXout relocates an executable or relocatable file to bases, or the
+// default addresses for nil, and loads it. The memory is made split for
+// split I/D files. It returns the entry address.
+func (m *Memory) LoadXout(xf *binlib.XoutFile, bases []uint32) (uint32, error) {
+	segs, err := xf.Relocate(bases, nil)
+	if err != nil {
+		return 0, err
+	}
+	if binlib.XoutSplitID(xf.Header.Magic) {
+		m.Split = true
+	}
+	return m.LoadSegs(segs), nil
+}
+
+// Start sets the mode for the magic number of an XOUT file and jumps to
+// the entry address.
+func (c *CPU) Start(magic uint16, entry uint32) {
+	if binlib.XoutSegmented(magic) {
+		c.setFCW(c.FCW | FlagSEG)
+	} else {
+		c.setFCW(c.FCW &^ FlagSEG)
+	}
+	c.PC = entry
+	c.Halted = false
+}
@@ -0,0 +1,193 @@
+/*
+ *  cpmdisk.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  List, get, put and remove files in CP/M disk images
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"binlib"
+)
+
+/* List the files with their sizes and the free space */
+func list(d *disk, user int, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		args = []string{"*.*"}
+	}
+	count := 0
+	for _, arg := range args {
+		files, err := d.match(user, arg)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			fmt.Fprintf(w, "%2d: %-12s %8d\n", f.user, displayName(f.name), d.size(f))
+			count++
+		}
+	}
+	fmt.Fprintf(w, "%d files, %dK free\n", count, d.free()/1024)
+	return nil
+}
+
+/*
+ * Copy the files to a host directory, in lower case names. The names are
+ * checked before any copy, a name can not be in two user areas.
+ */
+func get(d *disk, user int, args []string, dir string) error {
+	var files []*file
+	users := make(map[string]byte)
+	for _, arg := range args {
+		matched, err := d.match(user, arg)
+		if err != nil {
+			return err
+		}
+		for _, f := range matched {
+			name, ok := hostName(f.name)
+			if !ok {
+				return fmt.Errorf("%q: not a host file name", displayName(f.name))
+			}
+			if fuser, dup := users[name]; dup {
+				if fuser != f.user {
+					return fmt.Errorf("%s: in user areas %d and %d, choose one with -u", name, fuser, f.user)
+				}
+				continue
+			}
+			users[name] = f.user
+			files = append(files, f)
+		}
+	}
+	for _, f := range files {
+		name, _ := hostName(f.name)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), d.read(f), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* The lower case host name of a file, false for bytes unsafe in a path */
+func hostName(name [11]byte) (string, bool) {
+	base := strings.TrimRight(string(name[:8]), " ")
+	ext := strings.TrimRight(string(name[8:]), " ")
+	if base == "" || strings.ContainsAny(base+ext, "/\\.") {
+		return "", false
+	}
+	for _, ch := range []byte(base + ext) {
+		if ch <= ' ' || ch >= 0x7f {
+			return "", false
+		}
+	}
+	return strings.ToLower(displayName(name)), true
+}
+
+/* Copy host files to the disk, by their base names */
+func put(d *disk, user int, args []string) error {
+	if user < 0 {
+		user = 0
+	}
+	for _, arg := range args {
+		fuser, name, err := parseName(filepath.Base(arg))
+		if err != nil || fuser >= 0 || hasWildcard(name) {
+			return fmt.Errorf("%s: not a CP/M file name", arg)
+		}
+		data, err := ioutil.ReadFile(arg)
+		if err != nil {
+			return err
+		}
+		if err = d.write(byte(user), name, data); err != nil {
+			return fmt.Errorf("%s: %v", arg, err)
+		}
+	}
+	return nil
+}
+
+func remove(d *disk, user int, args []string) error {
+	for _, arg := range args {
+		files, err := d.match(user, arg)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			d.remove(f)
+		}
+	}
+	return nil
+}
+
+/*
+ * The files of [u:]name.typ, the prefix overrides the user. A name without
+ * wildcards has to exist.
+ */
+func (d *disk) match(user int, arg string) ([]*file, error) {
+	fuser, name, err := parseName(arg)
+	if err != nil {
+		return nil, err
+	}
+	if fuser >= 0 {
+		user = fuser
+	}
+	files := d.files(user, name)
+	if len(files) == 0 && !hasWildcard(name) {
+		return nil, fmt.Errorf("%s: not found", arg)
+	}
+	return files, nil
+}
+
+func main() {
+	spec := flag.String("f", "ibm-3740", "disk format, "+strings.Join(formatNames(), ", ")+
+		" or key=value pairs")
+	user := flag.Int("u", -1, "user area, all users for ls, get and rm and 0 for put by default")
+	dir := flag.String("d", ".", "directory to get files to")
+	flag.Parse()
+	if flag.NArg() < 2 {
+		log.Fatalln("Usage: cpmdisk [options] image ls|get|put|rm [files...]")
+	}
+	if *user > maxUser {
+		log.Fatalf("bad user %d\n", *user)
+	}
+	f, err := parseFormat(*spec)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	imgpath, cmd, args := flag.Arg(0), flag.Arg(1), flag.Args()[2:]
+	data, err := ioutil.ReadFile(imgpath)
+	if err != nil && !(os.IsNotExist(err) && cmd == "put") {
+		log.Fatalf("can not open %s\n", imgpath)
+	}
+	d := newDisk(f, data)
+	switch cmd {
+	case "ls":
+		err = list(d, *user, args, os.Stdout)
+	case "get":
+		err = get(d, *user, args, *dir)
+	case "put":
+		err = put(d, *user, args)
+	case "rm":
+		err = remove(d, *user, args)
+	default:
+		log.Fatalf("unknown command %s\n", cmd)
+	}
+	if err != nil {
+		log.Fatalf("%s: %v\n", imgpath, err)
+	}
+	if cmd == "put" || cmd == "rm" {
+		if err = binlib.WriteFile(imgpath, d.bytes(), 0644); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
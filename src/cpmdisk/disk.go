@@ -0,0 +1,356 @@
+/*
+ *  disk.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  CP/M 2.2 and 3 file systems in disk images
+ *  The directory starts at block 0 of the first track after the reserved
+ *  tracks. Each 32 bytes entry holds the user code, the name, the extent
+ *  number and the block pointers of up to 16K bytes times EXM + 1.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	recLen    = 128
+	entryLen  = 32
+	emptyUser = 0xe5 /* unused directory entry */
+	maxUser   = 15
+)
+
+var (
+	errDiskFull = errors.New("disk full")
+	errDirFull  = errors.New("directory full")
+)
+
+type disk struct {
+	f    format
+	data []byte
+	skew []int
+	dir  []byte /* the directory blocks */
+}
+
+/* A directory entry of a file */
+type entry struct {
+	slot   int /* index in the directory */
+	user   byte
+	name   [11]byte
+	extent int /* logical extent of the last record, S2 * 32 + EX */
+	rc     int
+	s1     int
+	blocks []int
+}
+
+type file struct {
+	user    byte
+	name    [11]byte
+	entries []*entry /* sorted by the extent */
+}
+
+/* A disk of an image, a short image is filled with E5 */
+func newDisk(f format, data []byte) *disk {
+	for len(data) < f.size() {
+		data = append(data, 0xe5)
+	}
+	d := &disk{f: f, data: data, skew: f.skewTable()}
+	for blk := 0; blk < f.dirBlocks(); blk++ {
+		d.dir = append(d.dir, d.block(blk)...)
+	}
+	d.dir = d.dir[:f.maxDir*entryLen]
+	return d
+}
+
+/* The bytes of a sector, counted from the first data track */
+func (d *disk) sector(ls int) []byte {
+	track := d.f.bootTrk + ls/d.f.secTrk
+	off := (track*d.f.secTrk + d.skew[ls%d.f.secTrk]) * d.f.secLen
+	return d.data[off : off+d.f.secLen]
+}
+
+func (d *disk) block(blk int) []byte {
+	secs := d.f.blockSize / d.f.secLen
+	var data []byte
+	for idx := 0; idx < secs; idx++ {
+		data = append(data, d.sector(blk*secs+idx)...)
+	}
+	return data
+}
+
+func (d *disk) writeBlock(blk int, data []byte) {
+	secs := d.f.blockSize / d.f.secLen
+	for idx := 0; idx < secs; idx++ {
+		copy(d.sector(blk*secs+idx), data[idx*d.f.secLen:])
+	}
+}
+
+/* The image with the directory written back */
+func (d *disk) bytes() []byte {
+	dir := make([]byte, d.f.dirBlocks()*d.f.blockSize)
+	for idx := range dir {
+		dir[idx] = 0xe5
+	}
+	copy(dir, d.dir)
+	for blk := 0; blk < d.f.dirBlocks(); blk++ {
+		d.writeBlock(blk, dir[blk*d.f.blockSize:])
+	}
+	return d.data
+}
+
+/* The file entries, labels and time stamps of CP/M 3 are skipped */
+func (d *disk) entries() []*entry {
+	var ents []*entry
+	for slot := 0; slot < d.f.maxDir; slot++ {
+		raw := d.dir[slot*entryLen : (slot+1)*entryLen]
+		if raw[0] > maxUser {
+			continue
+		}
+		e := &entry{slot: slot, user: raw[0], extent: int(raw[14]&0x3f)*32 + int(raw[12]&0x1f),
+			rc: int(raw[15]), s1: int(raw[13])}
+		for idx := range e.name {
+			e.name[idx] = raw[1+idx] & 0x7f
+		}
+		for idx := 0; idx < d.f.pointers(); idx++ {
+			blk := int(raw[16+idx])
+			if d.f.pointers() == 8 {
+				blk = int(raw[16+idx*2]) | int(raw[17+idx*2])<<8
+			}
+			if blk != 0 {
+				e.blocks = append(e.blocks, blk)
+			}
+		}
+		ents = append(ents, e)
+	}
+	return ents
+}
+
+/* The files matching a pattern, user -1 matches all users */
+func (d *disk) files(user int, pattern [11]byte) []*file {
+	byName := make(map[string]*file)
+	var files []*file
+	for _, e := range d.entries() {
+		if user >= 0 && int(e.user) != user || !matchName(pattern, e.name) {
+			continue
+		}
+		key := string(append([]byte{e.user}, e.name[:]...))
+		f := byName[key]
+		if f == nil {
+			f = &file{user: e.user, name: e.name}
+			byName[key] = f
+			files = append(files, f)
+		}
+		f.entries = append(f.entries, e)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].user != files[j].user {
+			return files[i].user < files[j].user
+		}
+		return string(files[i].name[:]) < string(files[j].name[:])
+	})
+	for _, f := range files {
+		sort.SliceStable(f.entries, func(i, j int) bool { return f.entries[i].extent < f.entries[j].extent })
+	}
+	return files
+}
+
+/* The size in bytes, to the last record or the last byte on CP/M 3 */
+func (d *disk) size(f *file) int {
+	last := f.entries[len(f.entries)-1]
+	size := (last.extent*recLen + last.rc) * recLen
+	if d.f.cpm3 && last.s1 != 0 && size > 0 {
+		size -= recLen - last.s1
+	}
+	return size
+}
+
+func (d *disk) read(f *file) []byte {
+	var data []byte
+	for _, e := range f.entries {
+		for _, blk := range e.blocks {
+			if blk <= d.f.dsm() {
+				data = append(data, d.block(blk)...)
+			}
+		}
+	}
+	if size := d.size(f); len(data) > size {
+		data = data[:size]
+	}
+	return data
+}
+
+func (d *disk) remove(f *file) {
+	for _, e := range f.entries {
+		d.dir[e.slot*entryLen] = emptyUser
+	}
+}
+
+/* The used blocks, the directory and the blocks of the entries */
+func (d *disk) allocated() []bool {
+	used := make([]bool, d.f.dsm()+1)
+	for blk := 0; blk < d.f.dirBlocks(); blk++ {
+		used[blk] = true
+	}
+	for _, e := range d.entries() {
+		for _, blk := range e.blocks {
+			if blk < len(used) {
+				used[blk] = true
+			}
+		}
+	}
+	return used
+}
+
+/* The free bytes */
+func (d *disk) free() int {
+	free := 0
+	for _, used := range d.allocated() {
+		if !used {
+			free += d.f.blockSize
+		}
+	}
+	return free
+}
+
+/* Write a file replacing the old one, the last record is filled with ^Z */
+func (d *disk) write(user byte, name [11]byte, data []byte) error {
+	for _, f := range d.files(int(user), name) {
+		d.remove(f)
+	}
+	recs := (len(data) + recLen - 1) / recLen
+	padded := make([]byte, recs*recLen)
+	copy(padded, data)
+	for idx := len(data); idx < len(padded); idx++ {
+		padded[idx] = 0x1a
+	}
+
+	var slots, blocks []int
+	for slot := 0; slot < d.f.maxDir; slot++ {
+		if d.dir[slot*entryLen] == emptyUser {
+			slots = append(slots, slot)
+		}
+	}
+	for blk, used := range d.allocated() {
+		if !used {
+			blocks = append(blocks, blk)
+		}
+	}
+	capacity := d.f.pointers() * d.f.blockSize
+	nents := (len(padded) + capacity - 1) / capacity
+	if nents == 0 {
+		nents = 1
+	}
+	switch {
+	case nents > len(slots):
+		return errDirFull
+	case (len(padded)+d.f.blockSize-1)/d.f.blockSize > len(blocks):
+		return errDiskFull
+	}
+
+	for idx := 0; idx < nents; idx++ {
+		chunk := padded[idx*capacity:]
+		if len(chunk) > capacity {
+			chunk = chunk[:capacity]
+		}
+		raw := d.dir[slots[idx]*entryLen : (slots[idx]+1)*entryLen]
+		for pos := range raw {
+			raw[pos] = 0
+		}
+		raw[0] = user
+		copy(raw[1:12], name[:])
+		crecs := len(chunk) / recLen
+		extent := idx * (d.f.exm() + 1)
+		if crecs > 0 {
+			extent += (crecs - 1) / recLen
+		}
+		raw[12], raw[14] = byte(extent%32), byte(extent/32)
+		raw[15] = byte(crecs - (extent-idx*(d.f.exm()+1))*recLen)
+		if d.f.cpm3 && idx == nents-1 {
+			raw[13] = byte(len(data) % recLen)
+		}
+		for pos := 0; pos*d.f.blockSize < len(chunk); pos++ {
+			blk := blocks[0]
+			blocks = blocks[1:]
+			buf := make([]byte, d.f.blockSize)
+			copy(buf, chunk[pos*d.f.blockSize:])
+			d.writeBlock(blk, buf)
+			if d.f.pointers() == 8 {
+				raw[16+pos*2], raw[17+pos*2] = byte(blk), byte(blk>>8)
+			} else {
+				raw[16+pos] = byte(blk)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * The user and the name of [u:]name.typ, * fills the rest with ?.
+ * The user is -1 without the prefix.
+ */
+func parseName(arg string) (int, [11]byte, error) {
+	var name [11]byte
+	user := -1
+	if colon := strings.IndexByte(arg, ':'); colon >= 0 {
+		if _, err := fmt.Sscanf(arg[:colon], "%d", &user); err != nil || user < 0 || user > maxUser {
+			return 0, name, fmt.Errorf("bad user %s", arg[:colon])
+		}
+		arg = arg[colon+1:]
+	}
+	base, ext := strings.ToUpper(arg), ""
+	if dot := strings.IndexByte(base, '.'); dot >= 0 {
+		base, ext = base[:dot], base[dot+1:]
+	}
+	if base == "" || len(base) > 8 && !strings.Contains(base[:8], "*") || len(ext) > 3 && !strings.Contains(ext[:3], "*") ||
+		strings.ContainsAny(base+ext, " .:") {
+		return 0, name, fmt.Errorf("bad file name %s", arg)
+	}
+	fill := func(field []byte, part string) {
+		for idx := range field {
+			switch {
+			case idx >= len(part):
+				field[idx] = ' '
+			case part[idx] == '*':
+				for ; idx < len(field); idx++ {
+					field[idx] = '?'
+				}
+				return
+			default:
+				field[idx] = part[idx]
+			}
+		}
+	}
+	fill(name[:8], base)
+	fill(name[8:], ext)
+	return user, name, nil
+}
+
+/* Match a name against a pattern with ? */
+func matchName(pattern, name [11]byte) bool {
+	for idx := range pattern {
+		if pattern[idx] != '?' && pattern[idx] != name[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+func hasWildcard(name [11]byte) bool {
+	return strings.IndexByte(string(name[:]), '?') >= 0
+}
+
+/* The name as NAME.TYP */
+func displayName(name [11]byte) string {
+	base := strings.TrimRight(string(name[:8]), " ")
+	if ext := strings.TrimRight(string(name[8:]), " "); ext != "" {
+		base += "." + ext
+	}
+	return base
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mustFormat(t *testing.T, spec string) format {
+	t.Helper()
+	f, err := parseFormat(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func mustName(t *testing.T, arg string) [11]byte {
+	t.Helper()
+	_, name, err := parseName(arg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func content(size int) []byte {
+	data := make([]byte, size)
+	for idx := range data {
+		data[idx] = byte(idx*7 + idx>>8)
+	}
+	return data
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		spec                      string
+		dsm, exm, ptrs, dirBlocks int
+	}{
+		{"ibm-3740", 242, 0, 16, 2},
+		{"m20", 135, 1, 16, 2},
+		{"4mb-hd", 2047, 0, 8, 4},
+		{"seclen=512,tracks=80,sectrk=9,blocksize=4096,maxdir=256,boottrk=1,os=3", 87, 3, 16, 2},
+	}
+	for _, tt := range tests {
+		f := mustFormat(t, tt.spec)
+		if f.dsm() != tt.dsm || f.exm() != tt.exm || f.pointers() != tt.ptrs || f.dirBlocks() != tt.dirBlocks {
+			t.Errorf("%s: dsm %d exm %d pointers %d directory %d", tt.spec,
+				f.dsm(), f.exm(), f.pointers(), f.dirBlocks())
+		}
+	}
+	if f := mustFormat(t, "m20,os=3,maxdir=64"); !f.cpm3 || f.maxDir != 64 || f.secLen != 256 {
+		t.Errorf("modified m20 %+v", f)
+	}
+	if skew := mustFormat(t, "ibm-3740").skewTable(); skew[1] != 6 || skew[4] != 24 || skew[5] != 4 || skew[13] != 1 {
+		t.Errorf("skew table %v", skew)
+	}
+	for _, spec := range []string{"ibm-3741", "seclen=100,tracks=10,sectrk=10,blocksize=1024,maxdir=64",
+		"ibm-3740,os=4", "ibm-3740,tracks=2", "4mb-hd,blocksize=1024"} {
+		if _, err := parseFormat(spec); err == nil {
+			t.Errorf("%s: no error", spec)
+		}
+	}
+}
+
+func TestName(t *testing.T) {
+	tests := []struct {
+		arg  string
+		user int
+		name string
+	}{
+		{"cpmsys.rel", -1, "CPMSYS  REL"},
+		{"3:Libcpm.a", 3, "LIBCPM  A  "},
+		{"*.*", -1, "???????????"},
+		{"x*.c", -1, "X???????C  "},
+		{"README", -1, "README     "},
+	}
+	for _, tt := range tests {
+		user, name, err := parseName(tt.arg)
+		if err != nil || user != tt.user || string(name[:]) != tt.name {
+			t.Errorf("%s: %v %d %q", tt.arg, err, user, name)
+		}
+	}
+	for _, arg := range []string{"toolongname.c", "a.text", "16:a.c", "x:a.c", ".profile", "a b"} {
+		if _, _, err := parseName(arg); err == nil {
+			t.Errorf("%s: no error", arg)
+		}
+	}
+}
+
+func TestLayout(t *testing.T) {
+	f := mustFormat(t, "ibm-3740")
+	d := newDisk(f, nil)
+	data := content(300)
+	if err := d.write(0, mustName(t, "a.txt"), data); err != nil {
+		t.Fatal(err)
+	}
+	img := d.bytes()
+	dir := img[2*26*128:]
+	want := append([]byte{0, 'A', ' ', ' ', ' ', ' ', ' ', ' ', ' ', 'T', 'X', 'T', 0, 0, 0, 3, 2}, make([]byte, 15)...)
+	if !bytes.Equal(dir[:32], want) || dir[32] != emptyUser {
+		t.Errorf("directory % x", dir[:33])
+	}
+	/* block 2 starts at logical sector 16 of track 2 */
+	off := (2*26 + f.skewTable()[16]) * 128
+	if !bytes.Equal(img[off:off+128], data[:128]) {
+		t.Errorf("block 2 is not at sector %d", f.skewTable()[16])
+	}
+	if last := d.read(d.files(0, mustName(t, "a.txt"))[0]); !bytes.Equal(last[:300], data) ||
+		len(last) != 384 || last[300] != 0x1a {
+		t.Errorf("read %d bytes", len(last))
+	}
+}
+
+func TestFiles(t *testing.T) {
+	for _, spec := range []string{"ibm-3740", "m20", "4mb-hd", "m20,os=3"} {
+		f := mustFormat(t, spec)
+		d := newDisk(f, nil)
+		free := d.free()
+		files := map[string][]byte{
+			"empty":     {},
+			"small.txt": content(100),
+			"big.rel":   content(70000),
+		}
+		for name, data := range files {
+			if err := d.write(0, mustName(t, name), data); err != nil {
+				t.Fatalf("%s: %v", spec, err)
+			}
+		}
+		if err := d.write(3, mustName(t, "small.txt"), content(10)); err != nil {
+			t.Fatal(err)
+		}
+		d.write(0, mustName(t, "big.rel"), content(40000))
+		files["big.rel"] = content(40000)
+
+		d = newDisk(f, d.bytes())
+		all := d.files(-1, mustName(t, "*.*"))
+		if len(all) != 4 || all[3].user != 3 {
+			t.Errorf("%s: %d files", spec, len(all))
+		}
+		for name, data := range files {
+			got := d.files(0, mustName(t, name))
+			if len(got) != 1 {
+				t.Errorf("%s: %s not found", spec, name)
+				continue
+			}
+			read := d.read(got[0])
+			if !f.cpm3 {
+				data = append(data, bytes.Repeat([]byte{0x1a}, (recLen-len(data)%recLen)%recLen)...)
+			}
+			if !bytes.Equal(read, data) {
+				t.Errorf("%s: %s read %d bytes, want %d", spec, name, len(read), len(data))
+			}
+		}
+		for _, f := range all {
+			d.remove(f)
+		}
+		if d.free() != free || len(d.files(-1, mustName(t, "*.*"))) != 0 {
+			t.Errorf("%s: %d bytes free after remove, want %d", spec, d.free(), free)
+		}
+	}
+}
+
+func TestFull(t *testing.T) {
+	d := newDisk(mustFormat(t, "ibm-3740"), nil)
+	if err := d.write(0, mustName(t, "huge"), content(d.free()+1)); err != errDiskFull {
+		t.Errorf("disk full: %v", err)
+	}
+	if err := d.write(0, mustName(t, "fits"), content(d.free())); err != nil {
+		t.Errorf("all blocks: %v", err)
+	}
+	d = newDisk(mustFormat(t, "ibm-3740,maxdir=2"), nil)
+	d.write(0, mustName(t, "a"), nil)
+	d.write(0, mustName(t, "b"), nil)
+	if err := d.write(0, mustName(t, "c"), nil); err != errDirFull {
+		t.Errorf("directory full: %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	d := newDisk(mustFormat(t, "ibm-3740"), nil)
+	d.write(0, mustName(t, "cpmsys.rel"), content(1000))
+	d.write(1, mustName(t, "libcpm.a"), content(10))
+	var out strings.Builder
+	if err := list(d, -1, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	want := " 0: CPMSYS.REL       1024\n 1: LIBCPM.A          128\n2 files, 239K free\n"
+	if out.String() != want {
+		t.Errorf("list\n%s", out.String())
+	}
+	if err := remove(d, 0, []string{"libcpm.a"}); err == nil {
+		t.Error("no error for a file of another user")
+	}
+	if err := remove(d, -1, []string{"1:*.a"}); err != nil || len(d.files(1, mustName(t, "*.*"))) != 0 {
+		t.Errorf("remove: %v", err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cpmdisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := newDisk(mustFormat(t, "ibm-3740"), nil)
+	d.write(0, mustName(t, "a.txt"), content(10))
+	d.write(1, mustName(t, "b.txt"), content(10))
+	if err := get(d, -1, []string{"*.txt"}, dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	d.write(2, mustName(t, "a.txt"), content(20))
+	if err := get(d, -1, []string{"*.txt"}, dir); err == nil {
+		t.Error("no error for a name in two user areas")
+	}
+	if err := get(d, 2, []string{"a.txt"}, dir); err != nil {
+		t.Error(err)
+	}
+
+	for _, raw := range []string{"..      /AB", "A\\B        ", "A\x01      TXT", "A\x7fB        "} {
+		var name [11]byte
+		copy(name[:], raw)
+		d := newDisk(mustFormat(t, "ibm-3740"), nil)
+		d.write(0, name, content(10))
+		if err := get(d, -1, []string{"*.*"}, dir); err == nil {
+			t.Errorf("no error for %q", raw)
+		}
+	}
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 2 {
+		t.Errorf("%d host files", len(infos))
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ *  format.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Disk formats and the disk parameter blocks derived from them
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* The geometry of a disk image, as the diskdefs of cpmtools */
+type format struct {
+	secLen    int  /* bytes per sector */
+	tracks    int  /* tracks of both sides */
+	secTrk    int  /* sectors per track */
+	blockSize int  /* allocation block size */
+	maxDir    int  /* directory entries */
+	skew      int  /* sector skew, 0 for none */
+	bootTrk   int  /* reserved tracks, OFF of the DPB */
+	cpm3      bool /* CP/M 3 byte counts of the last records */
+}
+
+var formats = map[string]format{
+	/* 8" single sided single density */
+	"ibm-3740": {secLen: 128, tracks: 77, secTrk: 26, blockSize: 1024, maxDir: 64, skew: 6, bootTrk: 2},
+	/* Olivetti M20 5.25" double sided, running CP/M-8000 */
+	"m20": {secLen: 256, tracks: 70, secTrk: 16, blockSize: 2048, maxDir: 128, bootTrk: 2},
+	/* 4MB hard disk of emulators */
+	"4mb-hd": {secLen: 128, tracks: 1024, secTrk: 32, blockSize: 2048, maxDir: 256},
+}
+
+/* The names of the known formats */
+func formatNames() []string {
+	var names []string
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+ * A known format, or a format given by key=value pairs such as
+ * seclen=128,tracks=77,sectrk=26,blocksize=1024,maxdir=64,skew=6,boottrk=2,os=3.
+ * The pairs after a known name change its values.
+ */
+func parseFormat(spec string) (format, error) {
+	var f format
+	for idx, item := range strings.Split(spec, ",") {
+		if idx == 0 {
+			if known, ok := formats[item]; ok {
+				f = known
+				continue
+			}
+		}
+		pair := strings.SplitN(item, "=", 2)
+		if len(pair) != 2 {
+			return f, fmt.Errorf("unknown format %s", item)
+		}
+		if pair[0] == "os" {
+			switch pair[1] {
+			case "2.2":
+				f.cpm3 = false
+			case "3":
+				f.cpm3 = true
+			default:
+				return f, fmt.Errorf("bad os %s", pair[1])
+			}
+			continue
+		}
+		val, err := strconv.Atoi(pair[1])
+		if err != nil || val < 0 {
+			return f, fmt.Errorf("bad value %s", item)
+		}
+		switch pair[0] {
+		case "seclen":
+			f.secLen = val
+		case "tracks":
+			f.tracks = val
+		case "sectrk":
+			f.secTrk = val
+		case "blocksize":
+			f.blockSize = val
+		case "maxdir":
+			f.maxDir = val
+		case "skew":
+			f.skew = val
+		case "boottrk":
+			f.bootTrk = val
+		default:
+			return f, fmt.Errorf("unknown format key %s", pair[0])
+		}
+	}
+	return f, f.check()
+}
+
+func (f format) check() error {
+	switch {
+	case f.secLen < 128 || f.secLen&(f.secLen-1) != 0:
+		return fmt.Errorf("bad sector length %d", f.secLen)
+	case f.blockSize < 1024 || f.blockSize&(f.blockSize-1) != 0 || f.blockSize < f.secLen:
+		return fmt.Errorf("bad block size %d", f.blockSize)
+	case f.secTrk == 0 || f.tracks <= f.bootTrk:
+		return fmt.Errorf("no data tracks")
+	case f.maxDir == 0 || f.maxDir*32 > 16*f.blockSize:
+		return fmt.Errorf("bad directory entries %d", f.maxDir)
+	case f.dsm() < f.dirBlocks():
+		return fmt.Errorf("no data blocks")
+	case f.dsm() >= 256 && f.blockSize == 1024:
+		return fmt.Errorf("block size 1024 with more than 256 blocks")
+	case f.dsm() >= 0x10000:
+		return fmt.Errorf("too many blocks")
+	}
+	return nil
+}
+
+/* The image size in bytes */
+func (f format) size() int {
+	return f.tracks * f.secTrk * f.secLen
+}
+
+/* The last block number, DSM of the DPB */
+func (f format) dsm() int {
+	return (f.tracks-f.bootTrk)*f.secTrk*f.secLen/f.blockSize - 1
+}
+
+/* The blocks of the directory, from block 0 */
+func (f format) dirBlocks() int {
+	return (f.maxDir*32 + f.blockSize - 1) / f.blockSize
+}
+
+/* The block pointers in a directory entry, 16 of 8 bits or 8 of 16 bits */
+func (f format) pointers() int {
+	if f.dsm() < 256 {
+		return 16
+	}
+	return 8
+}
+
+/* The extent mask, EXM of the DPB */
+func (f format) exm() int {
+	return f.pointers()*f.blockSize/0x4000 - 1
+}
+
+/* The physical sectors of the logical sectors in a track */
+func (f format) skewTable() []int {
+	table := make([]int, f.secTrk)
+	used := make([]bool, f.secTrk)
+	for idx, sect := 0, 0; idx < f.secTrk; idx++ {
+		for used[sect] {
+			sect = (sect + 1) % f.secTrk
+		}
+		table[idx], used[sect] = sect, true
+		sect = (sect + f.skew) % f.secTrk
+	}
+	return table
+}
@@ -0,0 +1,422 @@
+/*
+ *  bdos.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  CP/M-8000 BDOS functions on host directories
+ *  A BDOS call is SC #2 with the function in R5 and the parameter in RR6,
+ *  the result is returned in R7. Each drive is a host directory, files
+ *  are opened by their names at each access and user areas are shared.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"binlib/z8k"
+)
+
+const bdosVersion = 0x3022 /* CP/M 2.2 on Z8000 */
+
+var errExit = errors.New("exit")
+
+type bdos struct {
+	mem    *z8k.Memory
+	seg    bool          // parameters are segmented addresses
+	drives [16]string    // host directories of A: to P:
+	drive  int           // current drive
+	user   byte          // user code, kept for function 32 only
+	dma    uint32        // DMA address
+	in     *bufio.Reader // console input
+	out    *bufio.Writer // console output
+	crlf   bool          // output CR as is, otherwise it is dropped
+
+	defDMA uint32   /* DMA address after a reset */
+	found  [][]byte /* directory entries of search first */
+}
+
+/* The SC handler of the CPU */
+func (b *bdos) call(c *z8k.CPU, code byte) error {
+	if code != 2 {
+		return fmt.Errorf("unsupported system call %d", code)
+	}
+	param := uint32(c.R[6])<<16 | uint32(c.R[7])
+	ret, err := b.function(c.R[5], param)
+	c.R[7] = ret
+	return err
+}
+
+/* The memory address of a parameter */
+func (b *bdos) addr(param uint32) uint32 {
+	if b.seg {
+		return (param>>24&0x7f)<<16 | param&0xffff
+	}
+	return param & 0xffff
+}
+
+func (b *bdos) read(addr uint32, size int) []byte {
+	return b.mem.Read(addr, size, z8k.SpaceData)
+}
+
+func (b *bdos) write(addr uint32, data []byte) {
+	b.mem.Write(addr, data, z8k.SpaceData)
+}
+
+func (b *bdos) function(fn uint16, param uint32) (uint16, error) {
+	addr := b.addr(param)
+	switch fn {
+	case 0: /* system reset */
+		return 0, errExit
+	case 1: /* console input */
+		return uint16(b.getc()), nil
+	case 2: /* console output */
+		b.putc(byte(param))
+	case 6: /* direct console I/O */
+		switch byte(param) {
+		case 0xff, 0xfd:
+			return uint16(b.getc()), nil
+		case 0xfe:
+			return b.status(), nil
+		}
+		b.putc(byte(param))
+	case 9: /* print string */
+		for idx := 0; idx < 0x10000; idx++ {
+			ch := b.read(addr&0x7f0000|(addr+uint32(idx))&0xffff, 1)[0]
+			if ch == '$' {
+				break
+			}
+			b.putc(ch)
+		}
+	case 10: /* read console buffer */
+		b.readLine(addr)
+	case 11: /* console status */
+		return b.status(), nil
+	case 12: /* version number */
+		return bdosVersion, nil
+	case 13: /* reset disk system */
+		b.drive = 0
+		b.dma = b.defDMA
+	case 14: /* select disk */
+		if int(param&0xff) >= len(b.drives) || b.drives[param&0xff] == "" {
+			return 0xff, nil
+		}
+		b.drive = int(param & 0xff)
+	case 15, 16: /* open and close file */
+		return b.open(addr), nil
+	case 17: /* search first */
+		return b.searchFirst(addr), nil
+	case 18: /* search next */
+		return b.searchNext(), nil
+	case 19: /* delete file */
+		return b.delete(addr), nil
+	case 20, 33: /* read sequential and random */
+		return b.readRecord(addr, fn == 33), nil
+	case 21, 34, 40: /* write sequential, random and random with zero fill */
+		return b.writeRecord(addr, fn != 21), nil
+	case 22: /* make file */
+		return b.make(addr), nil
+	case 23: /* rename file */
+		return b.rename(addr), nil
+	case 24: /* login vector */
+		var vec uint16
+		for idx, dir := range b.drives {
+			if dir != "" {
+				vec |= 1 << uint(idx)
+			}
+		}
+		return vec, nil
+	case 25: /* current disk */
+		return uint16(b.drive), nil
+	case 26: /* set DMA address */
+		b.dma = addr
+	case 32: /* get or set user code */
+		if byte(param) == 0xff {
+			return uint16(b.user), nil
+		}
+		b.user = byte(param) & 0x0f
+	case 35: /* compute file size */
+		return b.fileSize(addr), nil
+	case 36: /* set random record */
+		fcb := b.read(addr, fcbLen)
+		setRandRecord(fcb, seqRecord(fcb))
+		b.write(addr, fcb)
+	case 37: /* reset drive */
+	default:
+		return 0xffff, fmt.Errorf("unsupported BDOS function %d", fn)
+	}
+	return 0, nil
+}
+
+/* Read a console character, a new line is CR and the end is ^Z */
+func (b *bdos) getc() byte {
+	b.out.Flush()
+	ch, err := b.in.ReadByte()
+	switch {
+	case err != nil:
+		return 0x1a
+	case ch == '\n':
+		return '\r'
+	}
+	return ch
+}
+
+func (b *bdos) putc(ch byte) {
+	if ch != '\r' || b.crlf {
+		b.out.WriteByte(ch)
+	}
+}
+
+/* 0xff while input is left */
+func (b *bdos) status() uint16 {
+	b.out.Flush()
+	if _, err := b.in.Peek(1); err != nil {
+		return 0
+	}
+	return 0xff
+}
+
+/* Read a line into the buffer of the maximum length and the count */
+func (b *bdos) readLine(addr uint32) {
+	b.out.Flush()
+	max := int(b.read(addr, 1)[0])
+	line, err := b.in.ReadString('\n')
+	if err != nil && line == "" {
+		line = "\x1a"
+	}
+	for len(line) > 0 && (line[len(line)-1] == '\n' || line[len(line)-1] == '\r') {
+		line = line[:len(line)-1]
+	}
+	if len(line) > max {
+		line = line[:max]
+	}
+	b.write(addr+1, append([]byte{byte(len(line))}, line...))
+}
+
+/* The host directory of the drive in a FCB */
+func (b *bdos) dir(fcb []byte) string {
+	drive := b.drive
+	if fcb[fcbDrive] != 0 && fcb[fcbDrive] != '?' {
+		drive = int(fcb[fcbDrive]&0x1f) - 1
+	}
+	if drive < 0 || drive >= len(b.drives) {
+		return ""
+	}
+	return b.drives[drive]
+}
+
+/* The host files of a drive matching the name in a FCB, sorted */
+func (b *bdos) match(fcb []byte) []string {
+	dir := b.dir(fcb)
+	if dir == "" {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	pattern := fcbFileName(fcb)
+	var files []string
+	for _, info := range infos {
+		name, ok := cpmName(info.Name())
+		if ok && info.Mode().IsRegular() && matchName(pattern, name) {
+			files = append(files, filepath.Join(dir, info.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+/* The host file of a FCB, or "" */
+func (b *bdos) path(fcb []byte) string {
+	files := b.match(fcb)
+	if len(files) == 0 {
+		return ""
+	}
+	return files[0]
+}
+
+func (b *bdos) open(addr uint32) uint16 {
+	fcb := b.read(addr, fcbLen)
+	info, err := os.Stat(b.path(fcb))
+	if err != nil {
+		return 0xff
+	}
+	setRecordCount(fcb, info.Size())
+	b.write(addr, fcb)
+	return 0
+}
+
+func (b *bdos) searchFirst(addr uint32) uint16 {
+	fcb := b.read(addr, fcbLen)
+	b.found = nil
+	for _, file := range b.match(fcb) {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		name, _ := cpmName(filepath.Base(file))
+		entry := make([]byte, 32)
+		entry[0] = b.user
+		copy(entry[fcbName:], name[:])
+		recs := int((info.Size() + recLen - 1) / recLen)
+		ext := 0
+		if recs > 0 {
+			ext = (recs - 1) / recLen
+		}
+		entry[fcbEX] = byte(ext % 32)
+		entry[fcbS2] = byte(ext / 32)
+		entry[fcbRC] = byte(recs - ext*recLen)
+		b.found = append(b.found, entry)
+	}
+	return b.searchNext()
+}
+
+/* The next entry goes to the start of the DMA buffer */
+func (b *bdos) searchNext() uint16 {
+	if len(b.found) == 0 {
+		return 0xff
+	}
+	b.write(b.dma, b.found[0])
+	b.found = b.found[1:]
+	return 0
+}
+
+func (b *bdos) delete(addr uint32) uint16 {
+	ret := uint16(0xff)
+	for _, file := range b.match(b.read(addr, fcbLen)) {
+		if os.Remove(file) == nil {
+			ret = 0
+		}
+	}
+	return ret
+}
+
+func (b *bdos) make(addr uint32) uint16 {
+	fcb := b.read(addr, fcbLen)
+	dir := b.dir(fcb)
+	if dir == "" {
+		return 0xff
+	}
+	host, ok := newHostName(fcbFileName(fcb))
+	if !ok {
+		return 0xff
+	}
+	path := b.path(fcb)
+	if path == "" {
+		path = filepath.Join(dir, host)
+	}
+	flags := os.O_WRONLY | os.O_CREATE
+	if seqRecord(fcb)/recLen == 0 {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return 0xff
+	}
+	file.Close()
+	fcb[fcbRC] = 0
+	b.write(addr, fcb)
+	return 0
+}
+
+/* The new name is at FCB + 16 */
+func (b *bdos) rename(addr uint32) uint16 {
+	fcb := b.read(addr, fcbLen)
+	path := b.path(fcb)
+	newName := fcbFileName(fcb[16:])
+	host, ok := newHostName(newName)
+	if !ok || path == "" || b.path(append([]byte{fcb[fcbDrive]}, newName[:]...)) != "" {
+		return 0xff
+	}
+	if os.Rename(path, filepath.Join(filepath.Dir(path), host)) != nil {
+		return 0xff
+	}
+	return 0
+}
+
+/*
+ * Read a record to the DMA buffer, a short last record is filled with ^Z.
+ * A random read sets the sequential position to the record. It returns 1
+ * at the end of the file.
+ */
+func (b *bdos) readRecord(addr uint32, random bool) uint16 {
+	fcb := b.read(addr, fcbLen)
+	rec := seqRecord(fcb)
+	if random {
+		rec = randRecord(fcb)
+		setSeqRecord(fcb, rec)
+	}
+	file, err := os.Open(b.path(fcb))
+	if err != nil {
+		return 9 /* invalid FCB */
+	}
+	defer file.Close()
+	buf := make([]byte, recLen)
+	n, err := file.ReadAt(buf, int64(rec)*recLen)
+	if n == 0 {
+		if err != io.EOF {
+			return 0xff
+		}
+		return 1
+	}
+	for idx := n; idx < recLen; idx++ {
+		buf[idx] = 0x1a
+	}
+	b.write(b.dma, buf)
+	if !random {
+		setSeqRecord(fcb, rec+1)
+	}
+	if info, err := file.Stat(); err == nil {
+		setRecordCount(fcb, info.Size())
+	}
+	b.write(addr, fcb)
+	return 0
+}
+
+/* Write the DMA buffer to a record */
+func (b *bdos) writeRecord(addr uint32, random bool) uint16 {
+	fcb := b.read(addr, fcbLen)
+	rec := seqRecord(fcb)
+	if random {
+		rec = randRecord(fcb)
+		setSeqRecord(fcb, rec)
+	}
+	file, err := os.OpenFile(b.path(fcb), os.O_WRONLY, 0)
+	if err != nil {
+		return 9
+	}
+	defer file.Close()
+	if _, err = file.WriteAt(b.read(b.dma, recLen), int64(rec)*recLen); err != nil {
+		return 2 /* disk full */
+	}
+	if !random {
+		setSeqRecord(fcb, rec+1)
+	}
+	if info, err := file.Stat(); err == nil {
+		setRecordCount(fcb, info.Size())
+	}
+	b.write(addr, fcb)
+	return 0
+}
+
+/* Set the random record to the number of records */
+func (b *bdos) fileSize(addr uint32) uint16 {
+	fcb := b.read(addr, fcbLen)
+	info, err := os.Stat(b.path(fcb))
+	if err != nil {
+		return 0xff
+	}
+	setRandRecord(fcb, int((info.Size()+recLen-1)/recLen))
+	b.write(addr, fcb)
+	return 0
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"binlib"
+	"binlib/xouttest"
+	"binlib/z8k"
+)
+
+func newBdos(input string, out *bytes.Buffer) *bdos {
+	return &bdos{in: bufio.NewReader(strings.NewReader(input)), out: bufio.NewWriter(out)}
+}
+
+/* A program printing HI with function 9 and returning */
+func program() *binlib.XoutFile {
+	obj := &xouttest.Object{Magic: binlib.XoutMagicNonSegX}
+	obj.Segs = []binlib.XoutSeg{
+		{Type: binlib.XoutSegCODE, Length: 10},
+		{Type: binlib.XoutSegDATA, Length: 6},
+	}
+	obj.Code = []byte{
+		0xbd, 0x59, // LDK R5,#9
+		0x21, 0x07, 0x00, 0x0a, // LD R7,#msg
+		0x7f, 0x02, // SC #2
+		0x9e, 0x08, // RET
+		'H', 'I', '\r', '\n', '$', 0,
+	}
+	return obj.XoutFile()
+}
+
+func TestRun(t *testing.T) {
+	var out bytes.Buffer
+	m, err := newMachine(program(), []string{"b:foo.txt", "*.c"}, newBdos("", &out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp := m.mem.Read(basePage, 0x100, z8k.SpaceData)
+	if tail := string(bp[bpCmdTail+1 : bpCmdTail+1+int(bp[bpCmdTail])]); tail != " B:FOO.TXT *.C" {
+		t.Errorf("command tail %q", tail)
+	}
+	if bp[bpFCB1] != 2 || string(bp[bpFCB1+1:bpFCB1+12]) != "FOO     TXT" ||
+		bp[bpFCB2] != 0 || string(bp[bpFCB2+1:bpFCB2+12]) != "????????C  " {
+		t.Errorf("FCBs %q %q", bp[bpFCB1:bpFCB1+12], bp[bpFCB2:bpFCB2+12])
+	}
+	if want := []byte{0, 0, 0, 0x0a, 0, 0, 0, 6}; !bytes.Equal(bp[0x10:0x18], want) {
+		t.Errorf("data % x, want % x", bp[0x10:0x18], want)
+	}
+	if stack := m.mem.Read(uint32(m.cpu.R[15]), 4, z8k.SpaceData); !bytes.Equal(stack, []byte{0xff, 0x00, 0xfe, 0x00}) {
+		t.Errorf("stack % x", stack)
+	}
+	if err = m.run(0); err != nil || out.String() != "HI\n" {
+		t.Errorf("run: %v %q", err, out.String())
+	}
+
+	m, _ = newMachine(program(), nil, newBdos("", &out))
+	if err = m.run(2); err == nil {
+		t.Error("no error after 2 steps")
+	}
+	obj := &xouttest.Object{Magic: binlib.XoutMagicNonSeg}
+	if _, err = newMachine(obj.XoutFile(), nil, newBdos("", &out)); err == nil {
+		t.Error("no error for a relocatable file")
+	}
+}
+
+func TestConsole(t *testing.T) {
+	var out bytes.Buffer
+	b := newBdos("ab\nline one\n", &out)
+	b.mem = z8k.NewMemory()
+	b.crlf = true
+	for _, want := range []uint16{'a', 'b', '\r'} {
+		if ch, _ := b.function(1, 0); ch != want {
+			t.Errorf("console input %02x, want %02x", ch, want)
+		}
+	}
+	if st, _ := b.function(11, 0); st != 0xff {
+		t.Errorf("status %02x", st)
+	}
+	b.mem.Write(0x1000, []byte{4}, z8k.SpaceData)
+	b.function(10, 0x1000)
+	if buf := b.mem.Read(0x1000, 6, z8k.SpaceData); string(buf[2:]) != "line" || buf[1] != 4 {
+		t.Errorf("read buffer %q", buf)
+	}
+	if ch, _ := b.function(1, 0); ch != 0x1a {
+		t.Errorf("end of input %02x", ch)
+	}
+	b.function(2, '\r')
+	b.function(6, 'x')
+	b.out.Flush()
+	if out.String() != "\rx" {
+		t.Errorf("output %q", out.String())
+	}
+	if _, err := b.function(99, 0); err == nil {
+		t.Error("no error for an unsupported function")
+	}
+	if _, err := b.function(0, 0); err != errExit {
+		t.Errorf("system reset %v", err)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cpmrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var out bytes.Buffer
+	b := newBdos("", &out)
+	b.mem = z8k.NewMemory()
+	b.drives[0] = dir
+	const fcbAddr, dma = 0x1000, 0x2000
+
+	fcb := func(name string) []byte {
+		data := make([]byte, fcbLen)
+		parseFCB(data, name)
+		b.mem.Write(fcbAddr, data, z8k.SpaceData)
+		return data
+	}
+	call := func(fn uint16, want uint16) {
+		t.Helper()
+		if ret, err := b.function(fn, fcbAddr); err != nil || ret != want {
+			t.Errorf("function %d: %v %02x, want %02x", fn, err, ret, want)
+		}
+	}
+
+	fcb("test.txt")
+	call(15, 0xff)
+	b.function(26, dma)
+	call(22, 0)
+	b.mem.Write(dma, bytes.Repeat([]byte{'A'}, recLen), z8k.SpaceData)
+	call(21, 0)
+	b.mem.Write(dma, bytes.Repeat([]byte{'B'}, recLen), z8k.SpaceData)
+	call(21, 0)
+	call(16, 0)
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "test.txt")); len(data) != 2*recLen || data[recLen] != 'B' {
+		t.Errorf("host file %d bytes", len(data))
+	}
+
+	fcb("TEST.TXT")
+	call(15, 0)
+	if rc := b.mem.Read(fcbAddr+fcbRC, 1, z8k.SpaceData)[0]; rc != 2 {
+		t.Errorf("record count %d", rc)
+	}
+	for _, want := range []byte{'A', 'B'} {
+		call(20, 0)
+		if got := b.mem.Read(dma, 1, z8k.SpaceData)[0]; got != want {
+			t.Errorf("read %c, want %c", got, want)
+		}
+	}
+	call(20, 1)
+
+	data := fcb("test.txt")
+	setRandRecord(data, 1)
+	b.mem.Write(fcbAddr, data, z8k.SpaceData)
+	call(33, 0)
+	if got := b.mem.Read(dma, 1, z8k.SpaceData)[0]; got != 'B' {
+		t.Errorf("random read %c", got)
+	}
+	call(35, 0)
+	if got := randRecord(b.mem.Read(fcbAddr, fcbLen, z8k.SpaceData)); got != 2 {
+		t.Errorf("file size %d records", got)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "other.c"), []byte("x"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "long-name.text"), []byte("x"), 0644)
+	fcb("*.*")
+	var names []string
+	for ret, _ := b.function(17, fcbAddr); ret == 0; ret, _ = b.function(18, 0) {
+		names = append(names, string(b.mem.Read(dma+1, 11, z8k.SpaceData)))
+	}
+	if strings.Join(names, ",") != "OTHER   C  ,TEST    TXT" {
+		t.Errorf("search %q", names)
+	}
+
+	data = fcb("test.txt")
+	parseFCB(data[16:], "new.txt")
+	b.mem.Write(fcbAddr, data, z8k.SpaceData)
+	call(23, 0)
+	if _, err := os.Stat(filepath.Join(dir, "new.txt")); err != nil {
+		t.Error(err)
+	}
+	fcb("*.txt")
+	call(19, 0)
+	call(19, 0xff)
+	fcb("b:other.c")
+	call(15, 0xff)
+
+	// names leaving the drive directory or with wildcards are refused
+	data = fcb("other.c")
+	copy(data[fcbName:], "../OTHER   ")
+	b.mem.Write(fcbAddr, data, z8k.SpaceData)
+	call(22, 0xff)
+	fcb("new?.c")
+	call(22, 0xff)
+	data = fcb("other.c")
+	copy(data[16+fcbName:], "..      /AB")
+	b.mem.Write(fcbAddr, data, z8k.SpaceData)
+	call(23, 0xff)
+	data = fcb("other.c")
+	parseFCB(data[16:], "*.c")
+	b.mem.Write(fcbAddr, data, z8k.SpaceData)
+	call(23, 0xff)
+	if _, err := os.Stat(filepath.Join(dir, "other.c")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFCB(t *testing.T) {
+	if name, ok := cpmName("Foo.c"); !ok || string(name[:]) != "FOO     C  " {
+		t.Errorf("cpmName %q", name)
+	}
+	for _, host := range []string{"toolongname.c", "a.text", ".profile", "a b.c"} {
+		if _, ok := cpmName(host); ok {
+			t.Errorf("cpmName %s accepted", host)
+		}
+	}
+	for _, name := range []string{"FOO     C  ", "../FOO  C  ", "A?      C  ", "a       c  ", "A B     C  "} {
+		var fname [11]byte
+		copy(fname[:], name)
+		if _, ok := newHostName(fname); ok != (name == "FOO     C  ") {
+			t.Errorf("newHostName %q: %v", name, ok)
+		}
+	}
+	data := make([]byte, fcbLen)
+	setSeqRecord(data, 300)
+	if data[fcbEX] != 2 || data[fcbCR] != 44 || seqRecord(data) != 300 {
+		t.Errorf("record 300: ex %d cr %d", data[fcbEX], data[fcbCR])
+	}
+	setRecordCount(data, 300*recLen+1)
+	if data[fcbRC] != 45 {
+		t.Errorf("record count %d", data[fcbRC])
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ *  cpmrun.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Run a CP/M-8000 program on the Z8000 emulator
+ *  The base page is under the top of the program space, as CP/M-68K. At
+ *  the entry the stack holds the return address and the base page address,
+ *  and returning from the program ends it as BDOS function 0.
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"binlib"
+	"binlib/z8k"
+)
+
+const (
+	basePage  = 0xfe00 /* offset of the base page */
+	exitStub  = 0xff00 /* LDK R5,#0; SC #2 */
+	stackSeg  = 0x7f   /* segment of the base page and the stack, segmented */
+	bpCmdTail = 0x80   /* command tail and the default DMA buffer */
+	bpFCB1    = 0x5c
+	bpFCB2    = 0x38
+)
+
+type machine struct {
+	cpu  *z8k.CPU
+	mem  *z8k.Memory
+	bdos *bdos
+}
+
+/* A flag of drive=directory pairs */
+type driveFlag map[int]string
+
+func (d driveFlag) String() string { return fmt.Sprint(map[int]string(d)) }
+
+func (d driveFlag) Set(value string) error {
+	pair := strings.SplitN(value, "=", 2)
+	if len(pair) != 2 || len(pair[0]) != 1 {
+		return fmt.Errorf("bad drive %s", value)
+	}
+	drive := int(strings.ToUpper(pair[0])[0]) - 'A'
+	if drive < 0 || drive >= 16 {
+		return fmt.Errorf("bad drive %s", pair[0])
+	}
+	d[drive] = pair[1]
+	return nil
+}
+
+/*
+ * Load an executable, and set up the base page with the command tail and
+ * the FCBs of the first two arguments.
+ */
+func newMachine(xf *binlib.XoutFile, args []string, b *bdos) (*machine, error) {
+	if !binlib.XoutExecutable(xf.Header.Magic) {
+		return nil, fmt.Errorf("not an executable, magic 0x%04x", xf.Header.Magic)
+	}
+	segs, err := xf.Relocate(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	mem := z8k.NewMemory()
+	mem.Split = binlib.XoutSplitID(xf.Header.Magic)
+	entry := mem.LoadSegs(segs)
+
+	model := z8k.Z8002
+	var seg uint32
+	if binlib.XoutSegmented(xf.Header.Magic) {
+		model = z8k.Z8001
+		seg = stackSeg << 16
+	}
+	m := &machine{cpu: z8k.New(model, mem), mem: mem, bdos: b}
+	b.mem = mem
+	b.seg = model == z8k.Z8001
+	b.defDMA = seg | basePage + bpCmdTail
+	b.dma = b.defDMA
+
+	bp := make([]byte, 0x100)
+	put := func(off int, val uint32) {
+		if b.seg {
+			val = val&0x7f0000<<8 | val&0xffff
+		}
+		bp[off], bp[off+1], bp[off+2], bp[off+3] = byte(val>>24), byte(val>>16), byte(val>>8), byte(val)
+	}
+	low, end := seg|basePage, seg
+	set := make(map[int]bool)
+	for _, ls := range segs {
+		off := 0
+		switch ls.Type {
+		case binlib.XoutSegCODE, binlib.XoutSegCDMIX, binlib.XoutSegCDMIX_P:
+			off = 0x08
+		case binlib.XoutSegDATA, binlib.XoutSegCONST:
+			off = 0x10
+		case binlib.XoutSegBSS:
+			off = 0x18
+		}
+		if off != 0 && !set[off] {
+			put(off, ls.Addr)
+			put(off+4, uint32(len(ls.Data)))
+			set[off] = true
+		}
+		if ls.Addr&0x7f0000 != seg {
+			continue
+		}
+		if ls.Addr < low {
+			low = ls.Addr
+		}
+		if last := ls.Addr + uint32(len(ls.Data)); last > end {
+			end = last
+		}
+	}
+	put(0x00, low)
+	put(0x04, seg|basePage)
+	if end < seg|basePage {
+		put(0x20, seg|basePage-end)
+	}
+	bp[0x24] = byte(b.drive + 1)
+	for idx, off := range []int{bpFCB1, bpFCB2} {
+		name := ""
+		if idx < len(args) {
+			name = args[idx]
+		}
+		parseFCB(bp[off:], name)
+	}
+	tail := strings.ToUpper(strings.Join(args, " "))
+	if tail != "" {
+		tail = " " + tail
+	}
+	if len(tail) > 126 {
+		tail = tail[:126]
+	}
+	bp[bpCmdTail] = byte(len(tail))
+	copy(bp[bpCmdTail+1:], tail)
+	mem.Write(seg|basePage, bp, z8k.SpaceData)
+	mem.Write(seg|exitStub, []byte{0xbd, 0x50, 0x7f, 0x02}, z8k.SpaceProgram)
+
+	c := m.cpu
+	c.SystemCall = b.call
+	c.Start(xf.Header.Magic, entry)
+	var stack []byte
+	if b.seg {
+		stack = []byte{stackSeg, 0, exitStub >> 8, exitStub & 0xff, stackSeg, 0, basePage >> 8, basePage & 0xff}
+	} else {
+		stack = []byte{exitStub >> 8, exitStub & 0xff, basePage >> 8, basePage & 0xff}
+	}
+	sp := seg | basePage - uint32(len(stack))
+	mem.Write(sp, stack, z8k.SpaceData)
+	c.SetSP(sp)
+	return m, nil
+}
+
+/* Run until the program ends, or for steps instructions */
+func (m *machine) run(steps int) error {
+	err := m.cpu.Run(steps)
+	m.bdos.out.Flush()
+	switch {
+	case err == errExit:
+		return nil
+	case err == nil:
+		return fmt.Errorf("stopped after %d instructions at %06x", steps, m.cpu.PC)
+	}
+	return err
+}
+
+func main() {
+	drives := driveFlag{}
+	flag.Var(drives, "drive", "host directory of a drive, B=dir, A is . by default")
+	crlf := flag.Bool("crlf", false, "output CR of the console as is")
+	trace := flag.Bool("trace", false, "trace instructions to the standard error")
+	steps := flag.Int("n", 0, "stop after n instructions, 0 for no limit")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		log.Fatalln("Usage: cpmrun [options] prog.z8k [args...]")
+	}
+
+	b := &bdos{in: bufio.NewReader(os.Stdin), out: bufio.NewWriter(os.Stdout), crlf: *crlf}
+	b.drives[0] = "."
+	for drive, dir := range drives {
+		b.drives[drive] = dir
+	}
+
+	infpath := flag.Arg(0)
+	infile, err := os.Open(infpath)
+	if err != nil {
+		log.Fatalf("can not open %s\n", infpath)
+	}
+	xf := binlib.XoutFile{}
+	err = xf.Read(infile)
+	infile.Close()
+	if err != nil {
+		log.Fatalf("%s: %v\n", infpath, err)
+	}
+	m, err := newMachine(&xf, flag.Args()[1:], b)
+	if err != nil {
+		log.Fatalf("%s: %v\n", infpath, err)
+	}
+	if *trace {
+		m.cpu.Trace = func(c *z8k.CPU) {
+			fmt.Fprintf(os.Stderr, "%06x %04x\n", c.PC, c.R)
+		}
+	}
+	if err = m.run(*steps); err != nil {
+		log.Fatalf("%s: %v\n", infpath, err)
+	}
+}
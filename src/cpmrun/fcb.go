@@ -0,0 +1,164 @@
+/*
+ *  fcb.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  File control blocks and CP/M file names
+ */
+
+package main
+
+import (
+	"strings"
+)
+
+const fcbLen = 36 /* with the random record number */
+
+/* Offsets in a FCB */
+const (
+	fcbDrive = 0
+	fcbName  = 1  /* 8 bytes name and 3 bytes type */
+	fcbEX    = 12 /* extent */
+	fcbS2    = 14 /* extent high */
+	fcbRC    = 15 /* records in the extent */
+	fcbCR    = 32 /* current record */
+	fcbR0    = 33 /* random record, 3 bytes */
+)
+
+const recLen = 128
+
+/*
+ * The 11 bytes of a host file name, upper case and padded with spaces.
+ * False for names which are not 8.3.
+ */
+func cpmName(host string) ([11]byte, bool) {
+	var name [11]byte
+	for idx := range name {
+		name[idx] = ' '
+	}
+	base, ext := host, ""
+	if dot := strings.LastIndexByte(host, '.'); dot >= 0 {
+		base, ext = host[:dot], host[dot+1:]
+	}
+	if base == "" || len(base) > 8 || len(ext) > 3 || strings.ContainsAny(host, "?* ") {
+		return name, false
+	}
+	for _, ch := range base + ext {
+		if ch <= ' ' || ch >= 0x7f || ch == '.' {
+			return name, false
+		}
+	}
+	copy(name[:], strings.ToUpper(base))
+	copy(name[8:], strings.ToUpper(ext))
+	return name, true
+}
+
+/* The name in a FCB with the attribute bits masked */
+func fcbFileName(fcb []byte) [11]byte {
+	var name [11]byte
+	for idx := range name {
+		name[idx] = fcb[fcbName+idx] & 0x7f
+	}
+	return name
+}
+
+/* The host file name to create, in lower case */
+func hostName(name [11]byte) string {
+	base := strings.TrimRight(string(name[:8]), " ")
+	ext := strings.TrimRight(string(name[8:]), " ")
+	if ext != "" {
+		base += "." + ext
+	}
+	return strings.ToLower(base)
+}
+
+/* Match a name against a pattern with ? */
+func matchName(pattern, name [11]byte) bool {
+	for idx := range pattern {
+		if pattern[idx] != '?' && pattern[idx] != name[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Parse d:name.typ into a FCB as the CCP does, * fills the rest with ?.
+ * The drive is 0 for the default one.
+ */
+func parseFCB(fcb []byte, arg string) {
+	for idx := 0; idx < 11; idx++ {
+		fcb[fcbName+idx] = ' '
+	}
+	arg = strings.ToUpper(arg)
+	if len(arg) >= 2 && arg[1] == ':' && arg[0] >= 'A' && arg[0] <= 'P' {
+		fcb[fcbDrive] = arg[0] - 'A' + 1
+		arg = arg[2:]
+	}
+	base, ext := arg, ""
+	if dot := strings.IndexByte(arg, '.'); dot >= 0 {
+		base, ext = arg[:dot], arg[dot+1:]
+	}
+	fill := func(field []byte, part string) {
+		for idx := range field {
+			switch {
+			case idx >= len(part):
+				return
+			case part[idx] == '*':
+				for ; idx < len(field); idx++ {
+					field[idx] = '?'
+				}
+				return
+			}
+			field[idx] = part[idx]
+		}
+	}
+	fill(fcb[fcbName:fcbName+8], base)
+	fill(fcb[fcbName+8:fcbName+11], ext)
+}
+
+/* The sequential record number of the extent and the current record */
+func seqRecord(fcb []byte) int {
+	return (int(fcb[fcbS2]&0x3f)*32+int(fcb[fcbEX]&0x1f))*recLen + int(fcb[fcbCR])
+}
+
+func setSeqRecord(fcb []byte, rec int) {
+	fcb[fcbCR] = byte(rec % recLen)
+	fcb[fcbEX] = byte(rec / recLen % 32)
+	fcb[fcbS2] = byte(rec / recLen / 32)
+}
+
+func randRecord(fcb []byte) int {
+	return int(fcb[fcbR0]) | int(fcb[fcbR0+1])<<8 | int(fcb[fcbR0+2])<<16
+}
+
+func setRandRecord(fcb []byte, rec int) {
+	fcb[fcbR0] = byte(rec)
+	fcb[fcbR0+1] = byte(rec >> 8)
+	fcb[fcbR0+2] = byte(rec >> 16)
+}
+
+/* Set the record count of the current extent for a file of size bytes */
+func setRecordCount(fcb []byte, size int64) {
+	recs := int((size+recLen-1)/recLen) - seqRecord(fcb)/recLen*recLen
+	switch {
+	case recs < 0:
+		recs = 0
+	case recs > recLen:
+		recs = recLen
+	}
+	fcb[fcbRC] = byte(recs)
+}
+
+/*
+ * The host file name to create from a FCB name, which must be a 8.3 name
+ * without wildcards giving the same name back. False for others, so that
+ * no path leaves the drive directory.
+ */
+func newHostName(name [11]byte) (string, bool) {
+	host := hostName(name)
+	back, ok := cpmName(host)
+	return host, ok && back == name
+}
@@ -7,84 +7,116 @@
  *
  *  A De-archiver of XOUT Library
  *  XOUT files are extracted from lib file.
+ *  The files get the dates and the modes of the members.
  */
 
 package main
 
 import (
-	"encoding/binary"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
-)
-
-const ArHdrLen = 26
-const ArFnameLen = 14
-const ArMagic = 0xff65
+	"path/filepath"
+	"strings"
 
-type ArHdr struct {
-	Name [ArFnameLen]byte
-	Date uint32
-	UID  byte
-	GID  byte
-	Mode uint16
-	Size uint32
-}
+	"binlib"
+)
 
 func main() {
-	if len(os.Args) == 1 {
+	plain := flag.Bool("m", false, "do not restore the modification times and modes")
+	flag.Parse()
+	if flag.NArg() == 0 {
 		log.Fatalln("No input file")
 	}
-	infpath := os.Args[1]
+	infpath := flag.Arg(0)
 	infile, err := os.Open(infpath)
 	if err != nil {
 		log.Fatalf("can not open %s\n", infpath)
 	}
+	defer infile.Close()
 
-	/* check the Magic of the input file */
-	var magic uint16
-	infile.Seek(0, 0)
-	binary.Read(infile, binary.BigEndian, &magic)
-	if magic != ArMagic {
-		log.Fatalln("not library file", magic)
+	if err = extract(infile, ".", os.Stdout, !*plain); err != nil {
+		log.Fatalf("%s: %v\n", infpath, err)
 	}
+}
 
-	var arhdr ArHdr
+/*
+ * Extract all members of a library into dir, and list their names on w.
+ * With restore, the files get the modes and the dates of the members.
+ */
+func extract(infile io.Reader, dir string, w io.Writer, restore bool) error {
+	ar, err := binlib.NewArReader(infile)
+	if err != nil {
+		return err
+	}
 	for {
 		/* read an ar header */
-		err3 := binary.Read(infile, binary.BigEndian, &arhdr)
-		if err3 != nil {
+		arhdr, err := ar.Next()
+		if err == io.EOF {
 			break
 		}
-		if arhdr.Name[0] == 0 || arhdr.Size == 0 {
-			break
+		if err != nil {
+			return err
 		}
 
 		/* get a file name */
-		var objpath string
-		for _, c := range arhdr.Name {
-			if c == 0 {
-				break
-			}
-			objpath += string(c)
+		objpath := safeName(binlib.ConvertArName(arhdr.Name))
+		fmt.Fprintln(w, objpath)
+		objpath = filepath.Join(dir, objpath)
+		objfile, err := os.Create(objpath)
+		if err != nil {
+			return err
 		}
-		fmt.Println(objpath)
-		objfile, err4 := os.Create(objpath)
-		if err4 != nil {
-			log.Fatalln(err4)
+		/* copy an object file */
+		if _, err = io.Copy(objfile, ar); err != nil {
+			objfile.Close()
+			return err
 		}
-		/* read and write an object file */
-		var obj []byte
-		obj = make([]byte, arhdr.Size)
-		err5 := binary.Read(infile, binary.BigEndian, &obj)
-		if err5 != nil {
-			log.Fatalln(err4)
+		if err = objfile.Close(); err != nil {
+			return err
 		}
-		err6 := binary.Write(objfile, binary.BigEndian, &obj)
-		if err6 != nil {
-			log.Fatalln(err4)
+		if restore {
+			if err = restoreMeta(objpath, arhdr); err != nil {
+				return err
+			}
 		}
+	}
+	return nil
+}
 
-		objfile.Close()
+/* Set the mode and the date of the member, members without them keep the defaults */
+func restoreMeta(path string, arhdr *binlib.ArHdr) error {
+	if mode := os.FileMode(arhdr.Mode & 0777); mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if date, ok := binlib.ArTime(arhdr.Date); ok {
+		return os.Chtimes(path, date, date)
+	}
+	return nil
+}
+
+/*
+ * A file name in the directory. Path separators, control characters and
+ * non-ASCII bytes are replaced with '_', and so are "." and "..". An empty
+ * name becomes "_", not the directory itself.
+ */
+func safeName(name string) string {
+	mapped := []byte(name)
+	for idx, c := range mapped {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("/\\:", c) >= 0 {
+			mapped[idx] = '_'
+		}
+	}
+	name = string(mapped)
+	switch name {
+	case "":
+		name = "_"
+	case ".", "..":
+		name = strings.Repeat("_", len(name))
 	}
+	return name
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"binlib/xouttest"
+)
+
+func TestExtract(t *testing.T) {
+	dir := t.TempDir()
+	var list bytes.Buffer
+	lib := bytes.NewReader(xouttest.SampleLibrary())
+	if err := extract(lib, dir, &list, true); err != nil {
+		t.Fatal(err)
+	}
+	var names string
+	for _, member := range xouttest.SampleMembers() {
+		names += member.Name + "\n"
+		got, err := os.ReadFile(filepath.Join(dir, member.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, member.Data) {
+			t.Errorf("%s differs from the member", member.Name)
+		}
+	}
+	if list.String() != names {
+		t.Errorf("listed\n%s\nwant\n%s", list.String(), names)
+	}
+}
+
+func TestExtractNotLibrary(t *testing.T) {
+	obj := bytes.NewReader(xouttest.Sample(0xee00).Bytes())
+	if err := extract(obj, t.TempDir(), &bytes.Buffer{}, true); err == nil {
+		t.Error("no error for an object file")
+	}
+}
+
+func TestExtractMeta(t *testing.T) {
+	members := []xouttest.Member{
+		{Name: "ro.o", Date: 0x5e0be100, Mode: 0444, Data: []byte{1}},
+		{Name: "nodate.o", Data: []byte{2}},
+		{Name: "../up.o", Date: 0x5e0be100, Mode: 0644, Data: []byte{3}},
+		{Name: "a/b\\c:d", Mode: 0644, Data: []byte{4}},
+		{Name: "\xe9t\x01.o", Mode: 0644, Data: []byte{5}},
+		{Name: "..", Mode: 0644, Data: []byte{6}},
+	}
+	lib := xouttest.Library(members)
+	date := time.Unix(0x5e0be100, 0)
+
+	dir := filepath.Join(t.TempDir(), "lib")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var list bytes.Buffer
+	if err := extract(bytes.NewReader(lib), dir, &list, true); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ro.o\nnodate.o\n.._up.o\na_b_c_d\n_t_.o\n__\n"; list.String() != want {
+		t.Errorf("listed %q, want %q", list.String(), want)
+	}
+	entries, err := os.ReadDir(filepath.Dir(dir))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("files outside the directory %v", entries)
+	}
+	info, err := os.Stat(filepath.Join(dir, "ro.o"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0444 || !info.ModTime().Equal(date) {
+		t.Errorf("ro.o mode %v time %v", info.Mode(), info.ModTime())
+	}
+	if info, err = os.Stat(filepath.Join(dir, "nodate.o")); err != nil || info.ModTime().Equal(date) ||
+		info.Mode().Perm() == 0 {
+		t.Errorf("nodate.o %v %v", info, err)
+	}
+
+	dir = t.TempDir()
+	if err := extract(bytes.NewReader(lib), dir, &list, false); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = os.Stat(filepath.Join(dir, "ro.o")); err != nil || info.ModTime().Equal(date) ||
+		info.Mode().Perm()&0200 == 0 {
+		t.Errorf("ro.o without restoring %v %v", info, err)
+	}
+}
+
+func TestSafeName(t *testing.T) {
+	for name, want := range map[string]string{
+		"printf.o": "printf.o",
+		"":         "_",
+		".":        "_",
+		"..":       "__",
+		"../a.o":   ".._a.o",
+		"\x7f\xff": "__",
+	} {
+		if got := safeName(name); got != want {
+			t.Errorf("safeName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
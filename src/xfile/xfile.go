@@ -0,0 +1,77 @@
+/*
+ *  xfile.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Tell the kinds of files by their magic numbers, as file(1) does
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"binlib"
+)
+
+func main() {
+	if len(os.Args) == 1 {
+		log.Fatalln("No input file")
+	}
+	status := 0
+	for _, infpath := range os.Args[1:] {
+		data, err := os.ReadFile(infpath)
+		if err != nil {
+			log.Printf("can not open %s\n", infpath)
+			status = 1
+			continue
+		}
+		fmt.Printf("%s: %s\n", infpath, describe(data))
+	}
+	os.Exit(status)
+}
+
+/* The kind of a file with the details of its header */
+func describe(data []byte) string {
+	kind := binlib.Identify(data)
+	switch kind {
+	case binlib.KindXoutObject, binlib.KindXoutExec:
+		return fmt.Sprintf("%s, %s", kind, binlib.XoutModel(binary.BigEndian.Uint16(data)))
+	case binlib.KindXoutLib:
+		ar, _ := binlib.NewArReader(bytes.NewReader(data))
+		members := 0
+		for {
+			_, err := ar.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Sprintf("%s, damaged after %d members", kind, members)
+			}
+			members++
+		}
+		return fmt.Sprintf("%s, %d members", kind, members)
+	case binlib.KindCoff:
+		var hdr binlib.CoffHdr
+		if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &hdr); err != nil {
+			return fmt.Sprintf("%s, short header", kind)
+		}
+		cpu := "Z8002"
+		if hdr.Flags&binlib.CoffFlagZ8001 != 0 {
+			cpu = "Z8001"
+		}
+		exec := "relocatable"
+		if hdr.Flags&binlib.CoffFlagExec != 0 {
+			exec = "executable"
+		}
+		return fmt.Sprintf("%s, %s, %s, %d sections", kind, cpu, exec, hdr.NumSects)
+	}
+	return kind.String()
+}
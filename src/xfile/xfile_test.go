@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"binlib"
+	"binlib/convert"
+	"binlib/xouttest"
+)
+
+func TestDescribe(t *testing.T) {
+	cf, err := convert.Convert(xouttest.Sample(binlib.XoutMagicSeg).XoutFile(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coff, err := cf.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		data []byte
+		want string
+	}{
+		{xouttest.Sample(binlib.XoutMagicNonSeg).Bytes(), "XOUT object, non-segmented, relocatable"},
+		{xouttest.Sample(binlib.XoutMagicSegX).Bytes(), "XOUT executable, segmented, executable, each segment at its number"},
+		{xouttest.Library(xouttest.SampleMembers()), "XOUT library, 3 members"},
+		{xouttest.Library(xouttest.SampleMembers())[:40], "XOUT library, damaged after 0 members"},
+		{coff, "COFF file, Z8001, relocatable, 7 sections"},
+		{[]byte("!<arch>\n"), "GNU ar archive"},
+		{[]byte("#!/bin/sh\n"), "unknown file"},
+		{nil, "unknown file"},
+	}
+	for _, test := range tests {
+		if got := describe(test.data); got != test.want {
+			t.Errorf("%q, want %q", got, test.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ *  xlink.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  A linker of XOUT relocatable files and libraries
+ *  The output is an executable XOUT file for CP/M-8000, or a relocatable
+ *  file for a partial link.
+ */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"binlib"
+	"binlib/link"
+)
+
+func main() {
+	output := flag.String("o", "", "output file, the first input with .z8k by default")
+	mapfile := flag.String("M", "", "write a link map, - for the standard output")
+	baseOpt := flag.String("b", "", "segment addresses by type, such as code=0x1000,data=0x8000")
+	orderOpt := flag.String("order", "", "segment types placed first, such as data,code")
+	split := flag.Bool("i", false, "split code and data into separate address spaces")
+	strip := flag.Bool("s", false, "strip symbols and relocations")
+	discard := flag.Bool("x", false, "discard local symbols")
+	partial := flag.Bool("r", false, "partial link into a relocatable file")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		log.Fatalln("No input file")
+	}
+
+	if *partial && *output == "" {
+		log.Fatalln("-r needs an output file")
+	}
+	opts := link.Options{SplitID: *split, Strip: *strip, DiscardLocals: *discard, Relocatable: *partial}
+	var err error
+	if opts.Order, err = link.ParseOrder(*orderOpt); err != nil {
+		log.Fatalln(err)
+	}
+	if opts.Bases, err = link.ParseBases(*baseOpt); err != nil {
+		log.Fatalln(err)
+	}
+
+	var inputs []link.Input
+	for _, infpath := range flag.Args() {
+		in, err := link.ReadInput(infpath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		inputs = append(inputs, in)
+	}
+	res, err := link.Link(inputs, &opts)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	outfpath := *output
+	if outfpath == "" {
+		infname := filepath.Base(flag.Arg(0))
+		outfpath = infname[:len(infname)-len(filepath.Ext(infname))] + ".z8k"
+	}
+	exe, err := res.Xout.Bytes()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = binlib.WriteFile(outfpath, exe, 0644); err != nil {
+		log.Fatalln(err)
+	}
+
+	if *mapfile == "" {
+		return
+	}
+	var buf bytes.Buffer
+	if err = res.WriteMap(&buf); err != nil {
+		log.Fatalln(err)
+	}
+	if *mapfile == "-" {
+		_, err = os.Stdout.Write(buf.Bytes())
+	} else {
+		err = binlib.WriteFile(*mapfile, buf.Bytes(), 0644)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
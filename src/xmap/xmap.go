@@ -0,0 +1,96 @@
+/*
+ *  xmap.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  A link map and cross reference of XOUT files
+ *  Addresses can be taken from the COFF executable linked by GNU ld.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"binlib"
+	"binlib/link"
+)
+
+func main() {
+	jsonOut := flag.Bool("json", false, "write JSON")
+	coffpath := flag.String("coff", "", "COFF executable to take the addresses from")
+	output := flag.String("o", "-", "output file, - for the standard output")
+	baseOpt := flag.String("b", "", "segment addresses by type, such as code=0x1000,data=0x8000")
+	orderOpt := flag.String("order", "", "segment types placed first, such as data,code")
+	split := flag.Bool("i", false, "split code and data into separate address spaces")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		log.Fatalln("No input file")
+	}
+
+	opts := link.Options{SplitID: *split}
+	var err error
+	if opts.Order, err = link.ParseOrder(*orderOpt); err != nil {
+		log.Fatalln(err)
+	}
+	if opts.Bases, err = link.ParseBases(*baseOpt); err != nil {
+		log.Fatalln(err)
+	}
+	var inputs []link.Input
+	for _, infpath := range flag.Args() {
+		in, err := link.ReadInput(infpath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		inputs = append(inputs, in)
+	}
+	res, err := link.Link(inputs, &opts)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *coffpath != "" {
+		data, err := os.ReadFile(*coffpath)
+		if err != nil {
+			log.Fatalf("can not open %s\n", *coffpath)
+		}
+		var cf binlib.CoffFile
+		if err = cf.Parse(data); err != nil {
+			log.Fatalf("%s: %v\n", *coffpath, err)
+		}
+		res.SetAddrs(cf.GlobalSymbs())
+	}
+
+	var buf bytes.Buffer
+	if err = report(&buf, res, *jsonOut); err != nil {
+		log.Fatalln(err)
+	}
+	if *output == "-" {
+		_, err = os.Stdout.Write(buf.Bytes())
+	} else {
+		err = binlib.WriteFile(*output, buf.Bytes(), 0644)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func report(w io.Writer, res *link.Result, jsonOut bool) error {
+	if jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res.Report())
+	}
+	if err := res.WriteMap(w); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+	return res.WriteXref(w)
+}
@@ -12,73 +12,115 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 
 	"binlib"
+	"binlib/convert"
 )
 
 func main() {
-	if len(os.Args) == 1 {
+	cpu := flag.String("cpu", "auto", "CPU variant, z8001, z8002 or auto")
+	bss := flag.String("bss", "alloc", "undefined externals with a size, alloc, common or extern")
+	discard := flag.Bool("x", false, "discard local symbols")
+	file := flag.String("file", "", "source file name of the .file symbol, the input name by default")
+	lines := flag.String("lines", "", "line map for the line number tables")
+	date := flag.String("date", "", "time stamp, now or seconds since 1970, SOURCE_DATE_EPOCH or 0 by default")
+	magic := flag.String("magic", "0x8000", "COFF magic number")
+	output := flag.String("o", "", "output file, - for the standard output")
+	flag.Parse()
+	if flag.NArg() == 0 {
 		log.Fatalln("No input file")
 	}
-	infpath := os.Args[1]
+
+	opts, err := convert.ParseOptions(*cpu, *bss, *discard)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if opts.Date, err = timeStamp(*date); err != nil {
+		log.Fatalln(err)
+	}
+	mag, err := strconv.ParseUint(*magic, 0, 16)
+	if err != nil || mag == 0 {
+		log.Fatalf("bad magic number %s\n", *magic)
+	}
+	opts.Magic = uint16(mag)
+
+	infpath := flag.Arg(0)
+	if *lines != "" {
+		mapfile, err := os.Open(*lines)
+		if err != nil {
+			log.Fatalf("can not open %s\n", err)
+		}
+		opts.File, opts.Lines, err = convert.ReadLines(mapfile)
+		mapfile.Close()
+		if err != nil {
+			log.Fatalf("%s: %v\n", *lines, err)
+		}
+	}
+	if *file != "" {
+		opts.File = *file
+	}
+	if opts.File == "" {
+		opts.File = filepath.Base(infpath)
+	}
+
 	infile, err := os.Open(infpath)
 	if err != nil {
 		log.Fatalf("can not open %s\n", err)
 	}
 	defer infile.Close()
 
-	infname := filepath.Base(infpath)
-	outfpath := infname[:len(infname)-len(filepath.Ext(infname))] + ".o"
-	outfile, err1 := os.Create(outfpath)
-	if err1 != nil {
-		fmt.Fprintf(os.Stderr, "can not create %s \n", outfpath)
-		return
-	}
-	defer outfile.Close()
-
 	xf := binlib.XoutFile{}
-	err = xf.Read(infile)
-	cf := binlib.CoffFile{}
-	cf.Open(outfile)
-
-	// prepare
-	assignBSS(&xf)
-	//addLocalSymb(&xf)
-	addSegSymb(&xf)
-	addSegTopSymb(&xf)
-	// convert
-	convSectHdrs(&xf, &cf)
-	cf.CodePart = &xf.CodePart
-	convSymbTbl(&xf, &cf)
-	convRelocTbl(&xf, &cf)
-	finalize(&xf, &cf)
-	convHdr(&cf)
-
-	// CoffPrintHdr()
-	// CoffPrintSectTbl()
-	// CoffPrintRelocTbl()
-	// CoffPrintSymbTbl()
+	if err = xf.Read(infile); err != nil {
+		log.Fatalf("%s: %v\n", infpath, err)
+	}
+	cf, err := convert.Convert(&xf, &opts)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-	if err = cf.WriteHdr(); err != nil {
-		goto errhandle
+	outfpath := *output
+	if outfpath == "" {
+		infname := filepath.Base(infpath)
+		outfpath = infname[:len(infname)-len(filepath.Ext(infname))] + ".o"
+	}
+	obj, err := cf.Bytes()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if outfpath == "-" {
+		_, err = os.Stdout.Write(obj)
+	} else {
+		err = binlib.WriteFile(outfpath, obj, 0644)
 	}
-	if err = cf.WriteSectTbl(); err != nil {
-		goto errhandle
+	if err != nil {
+		log.Fatalf("can not write %s\n", err)
 	}
-	if err = cf.WriteCodePart(); err != nil {
-		goto errhandle
+}
+
+/*
+ * The time stamp of the header. Outputs are reproducible without the
+ * current time, SOURCE_DATE_EPOCH gives the time of the build.
+ */
+func timeStamp(spec string) (uint32, error) {
+	if spec == "" {
+		spec = os.Getenv("SOURCE_DATE_EPOCH")
+		if spec == "" {
+			return 0, nil
+		}
 	}
-	if err = cf.WriteRelocTbl(); err != nil {
-		goto errhandle
+	if spec == "now" {
+		return uint32(time.Now().Unix()), nil
 	}
-	if err = cf.WriteSymbTbl(); err != nil {
-		goto errhandle
+	sec, err := strconv.ParseUint(spec, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad time stamp %s", spec)
 	}
-        return
-errhandle:
-	log.Fatalln(err)
+	return uint32(sec), nil
 }
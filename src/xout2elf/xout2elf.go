@@ -0,0 +1,78 @@
+/*
+ *  xout2elf.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  A converter from XOUT to ELF32 big endian
+ */
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"binlib"
+	"binlib/convert"
+)
+
+func main() {
+	cpu := flag.String("cpu", "auto", "CPU variant, z8001, z8002 or auto")
+	bss := flag.String("bss", "alloc", "undefined externals with a size, alloc, common or extern")
+	discard := flag.Bool("x", false, "discard local symbols")
+	machine := flag.String("machine", "0x8000", "ELF machine number")
+	output := flag.String("o", "", "output file, - for the standard output, name.elf by default")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		log.Fatalln("No input file")
+	}
+
+	opts, err := convert.ParseOptions(*cpu, *bss, *discard)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	em, err := strconv.ParseUint(*machine, 0, 16)
+	if err != nil || em == 0 {
+		log.Fatalf("bad machine number %s\n", *machine)
+	}
+	opts.Machine = uint16(em)
+
+	infpath := flag.Arg(0)
+	infile, err := os.Open(infpath)
+	if err != nil {
+		log.Fatalf("can not open %s\n", err)
+	}
+	defer infile.Close()
+
+	xf := binlib.XoutFile{}
+	if err = xf.Read(infile); err != nil {
+		log.Fatalf("%s: %v\n", infpath, err)
+	}
+	ef, err := convert.ConvertELF(&xf, &opts)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	outfpath := *output
+	if outfpath == "" {
+		infname := filepath.Base(infpath)
+		outfpath = infname[:len(infname)-len(filepath.Ext(infname))] + ".elf"
+	}
+	obj, err := ef.Bytes()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if outfpath == "-" {
+		_, err = os.Stdout.Write(obj)
+	} else {
+		err = binlib.WriteFile(outfpath, obj, 0644)
+	}
+	if err != nil {
+		log.Fatalf("can not write %s\n", err)
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ *  hex.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Intel HEX, Motorola S-record and raw binary writers
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const recLen = 16 /* data bytes per record */
+
+/* A contiguous block of the image */
+type block struct {
+	addr uint32
+	data []byte
+}
+
+func sortBlocks(blocks []block) error {
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].addr < blocks[j].addr })
+	for idx := 1; idx < len(blocks); idx++ {
+		prev := blocks[idx-1]
+		if prev.addr+uint32(len(prev.data)) > blocks[idx].addr {
+			return fmt.Errorf("segments overlap at %06x", blocks[idx].addr)
+		}
+	}
+	return nil
+}
+
+func writeIHex(w io.Writer, blocks []block, start uint32) error {
+	if err := sortBlocks(blocks); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	record := func(recType byte, addr uint16, data []byte) {
+		sum := byte(len(data)) + byte(addr>>8) + byte(addr) + recType
+		fmt.Fprintf(bw, ":%02X%04X%02X", len(data), addr, recType)
+		for _, b := range data {
+			fmt.Fprintf(bw, "%02X", b)
+			sum += b
+		}
+		fmt.Fprintf(bw, "%02X\n", -sum)
+	}
+	upper := uint32(0)
+	for _, blk := range blocks {
+		for pos := 0; pos < len(blk.data); {
+			addr := blk.addr + uint32(pos)
+			if addr>>16 != upper {
+				upper = addr >> 16
+				record(0x04, 0, []byte{byte(upper >> 8), byte(upper)})
+			}
+			// a record does not cross a 64K boundary
+			n := len(blk.data) - pos
+			if n > recLen {
+				n = recLen
+			}
+			if rest := 0x10000 - int(addr&0xffff); n > rest {
+				n = rest
+			}
+			record(0x00, uint16(addr), blk.data[pos:pos+n])
+			pos += n
+		}
+	}
+	if start > 0xffff {
+		record(0x05, 0, []byte{byte(start >> 24), byte(start >> 16), byte(start >> 8), byte(start)})
+	}
+	record(0x01, 0, nil)
+	return bw.Flush()
+}
+
+func writeSRec(w io.Writer, blocks []block, start uint32, name string) error {
+	if err := sortBlocks(blocks); err != nil {
+		return err
+	}
+	// S1 records for 16 bit addresses, S2 for 24 bit
+	addrLen := 2
+	for _, blk := range blocks {
+		if blk.addr+uint32(len(blk.data)) > 0x10000 || start > 0xffff {
+			addrLen = 3
+		}
+	}
+	bw := bufio.NewWriter(w)
+	record := func(recType int, addrLen int, addr uint32, data []byte) {
+		count := addrLen + len(data) + 1
+		sum := byte(count)
+		fmt.Fprintf(bw, "S%d%02X", recType, count)
+		for idx := addrLen - 1; idx >= 0; idx-- {
+			b := byte(addr >> (8 * idx))
+			fmt.Fprintf(bw, "%02X", b)
+			sum += b
+		}
+		for _, b := range data {
+			fmt.Fprintf(bw, "%02X", b)
+			sum += b
+		}
+		fmt.Fprintf(bw, "%02X\n", ^sum)
+	}
+	record(0, 2, 0, []byte(name))
+	count := 0
+	for _, blk := range blocks {
+		for pos := 0; pos < len(blk.data); pos += recLen {
+			end := pos + recLen
+			if end > len(blk.data) {
+				end = len(blk.data)
+			}
+			record(addrLen-1, addrLen, blk.addr+uint32(pos), blk.data[pos:end])
+			count++
+		}
+	}
+	if count <= 0xffff {
+		record(5, 2, uint32(count), nil)
+	}
+	if addrLen == 2 {
+		record(9, 2, start, nil)
+	} else {
+		record(8, 3, start, nil)
+	}
+	return bw.Flush()
+}
+
+/* Raw binary from the lowest address, gaps are filled */
+func writeBin(w io.Writer, blocks []block, fill byte) error {
+	if err := sortBlocks(blocks); err != nil {
+		return err
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+	last := blocks[len(blocks)-1]
+	size := last.addr + uint32(len(last.data)) - blocks[0].addr
+	if size > 1<<24 {
+		return errors.New("image too large")
+	}
+	image := make([]byte, size)
+	for idx := range image {
+		image[idx] = fill
+	}
+	for _, blk := range blocks {
+		copy(image[blk.addr-blocks[0].addr:], blk.data)
+	}
+	_, err := w.Write(image)
+	return err
+}
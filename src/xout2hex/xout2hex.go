@@ -0,0 +1,183 @@
+/*
+ *  xout2hex.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  An exporter from XOUT to Intel HEX, Motorola S-record and raw binary
+ *  Relocations are applied for the given segment addresses.
+ */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"binlib"
+)
+
+func main() {
+	format := flag.String("f", "ihex", "output format, ihex, srec or bin")
+	output := flag.String("o", "", "output file, - for the standard output")
+	baseOpt := flag.String("b", "", "segment addresses, such as 0=0x1000,1=0x050000")
+	segOpt := flag.String("seg", "linear", "segmented addresses, linear for 24 bit or split for a file per segment")
+	fill := flag.Uint("fill", 0xff, "byte to fill gaps of raw binary")
+	startOpt := flag.String("start", "", "start address, the first code segment by default")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		log.Fatalln("No input file")
+	}
+	var ext string
+	switch *format {
+	case "ihex":
+		ext = ".hex"
+	case "srec":
+		ext = ".s19"
+	case "bin":
+		ext = ".bin"
+	default:
+		log.Fatalf("unknown format %s\n", *format)
+	}
+	if *segOpt != "linear" && *segOpt != "split" {
+		log.Fatalf("unknown segment output %s\n", *segOpt)
+	}
+
+	infpath := flag.Arg(0)
+	infile, err := os.Open(infpath)
+	if err != nil {
+		log.Fatalf("can not open %s\n", err)
+	}
+	defer infile.Close()
+	xf := binlib.XoutFile{}
+	if err = xf.Read(infile); err != nil {
+		log.Fatalf("%s: %v\n", infpath, err)
+	}
+
+	bases := xf.DefaultBases()
+	if err = parseBases(*baseOpt, bases, binlib.XoutSegmented(xf.Header.Magic)); err != nil {
+		log.Fatalln(err)
+	}
+	segs, err := xf.Relocate(bases, nil)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	start := startAddr(&xf, bases)
+	if *startOpt != "" {
+		if start, err = parseAddr(*startOpt); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// blocks of the segments with contents
+	var blocks []block
+	var segIdxs []int
+	for _, seg := range segs {
+		if !binlib.XoutSegHasData(seg.Type) || len(seg.Data) == 0 {
+			continue
+		}
+		blocks = append(blocks, block{seg.Addr, seg.Data})
+		segIdxs = append(segIdxs, seg.Index)
+	}
+
+	infname := filepath.Base(infpath)
+	outfpath := *output
+	if outfpath == "" {
+		outfpath = infname[:len(infname)-len(filepath.Ext(infname))] + ext
+	}
+	if *segOpt == "linear" {
+		if err = export(outfpath, *format, blocks, start, infname, byte(*fill)); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if outfpath == "-" {
+		log.Fatalln("split output needs file names")
+	}
+	// a file per segment, addressed by the offsets
+	outExt := filepath.Ext(outfpath)
+	for idx, blk := range blocks {
+		segfpath := fmt.Sprintf("%s.seg%d%s", outfpath[:len(outfpath)-len(outExt)], segIdxs[idx], outExt)
+		segStart := uint32(0)
+		if binlib.XoutAddrSeg(start) == binlib.XoutAddrSeg(blk.addr) {
+			segStart = uint32(binlib.XoutAddrOff(start))
+		}
+		blk.addr = uint32(binlib.XoutAddrOff(blk.addr))
+		if err = export(segfpath, *format, []block{blk}, segStart, infname, byte(*fill)); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func export(outfpath, format string, blocks []block, start uint32, name string, fill byte) error {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "ihex":
+		err = writeIHex(&buf, blocks, start)
+	case "srec":
+		err = writeSRec(&buf, blocks, start, name)
+	case "bin":
+		err = writeBin(&buf, blocks, fill)
+	}
+	if err != nil {
+		return err
+	}
+	if outfpath == "-" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return binlib.WriteFile(outfpath, buf.Bytes(), 0644)
+}
+
+func parseAddr(str string) (uint32, error) {
+	addr, err := strconv.ParseUint(str, 0, 32)
+	if err != nil || addr > 0x7fffff {
+		return 0, fmt.Errorf("bad address %s", str)
+	}
+	return uint32(addr), nil
+}
+
+/* Parse "seg=addr,..." into bases */
+func parseBases(opt string, bases []uint32, seg bool) error {
+	if opt == "" {
+		return nil
+	}
+	for _, item := range strings.Split(opt, ",") {
+		pair := strings.SplitN(item, "=", 2)
+		if len(pair) != 2 {
+			return fmt.Errorf("bad segment address %s", item)
+		}
+		idx, err := strconv.Atoi(pair[0])
+		if err != nil || idx < 0 || idx >= len(bases) {
+			return fmt.Errorf("bad segment %s", pair[0])
+		}
+		addr, err := parseAddr(pair[1])
+		if err != nil {
+			return err
+		}
+		if !seg && addr > 0xffff {
+			return fmt.Errorf("address %s out of non segmented space", pair[1])
+		}
+		bases[idx] = addr
+	}
+	return nil
+}
+
+/* The address of the first code segment, mixed code and data is code too */
+func startAddr(xf *binlib.XoutFile, bases []uint32) uint32 {
+	for idx, seg := range xf.SegTbl {
+		switch seg.Type {
+		case binlib.XoutSegCODE, binlib.XoutSegCDMIX, binlib.XoutSegCDMIX_P:
+			return bases[idx]
+		}
+	}
+	return 0
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"binlib"
+	"binlib/xouttest"
+)
+
+func TestParseBases(t *testing.T) {
+	bases := make([]uint32, 3)
+	if err := parseBases("0=0x1000,2=0x0010", bases, false); err != nil {
+		t.Fatal(err)
+	}
+	if bases[0] != 0x1000 || bases[1] != 0 || bases[2] != 0x10 {
+		t.Errorf("bases %x", bases)
+	}
+	for _, opt := range []string{"3=0", "0", "0=0x10000", "x=1"} {
+		if err := parseBases(opt, bases, false); err == nil {
+			t.Errorf("no error for %s", opt)
+		}
+	}
+	if err := parseBases("1=0x050000", bases, true); err != nil || bases[1] != 0x050000 {
+		t.Errorf("segmented address %x, %v", bases[1], err)
+	}
+}
+
+func TestIHex(t *testing.T) {
+	var buf bytes.Buffer
+	blocks := []block{
+		{0x01fff8, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{0x0100, []byte{0xde, 0xad}},
+	}
+	if err := writeIHex(&buf, blocks, 0x0100); err != nil {
+		t.Fatal(err)
+	}
+	want := ":02010000DEAD72\n" +
+		":020000040001F9\n" +
+		":08FFF8000001020304050607E5\n" +
+		":020000040002F8\n" +
+		":020000000809ED\n" +
+		":00000001FF\n"
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestSRec(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeSRec(&buf, []block{{0x1000, []byte{0xde, 0xad}}}, 0x1000, "a"); err != nil {
+		t.Fatal(err)
+	}
+	want := "S0040000619A\n" +
+		"S1051000DEAD5F\n" +
+		"S5030001FB\n" +
+		"S9031000EC\n"
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestBin(t *testing.T) {
+	var buf bytes.Buffer
+	blocks := []block{{0x1004, []byte{3}}, {0x1000, []byte{1, 2}}}
+	if err := writeBin(&buf, blocks, 0xff); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{1, 2, 0xff, 0xff, 3}; !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("got % x, want % x", buf.Bytes(), want)
+	}
+	if err := writeBin(&buf, []block{{0, []byte{1, 2}}, {1, []byte{3}}}, 0); err == nil {
+		t.Error("no error for overlapping segments")
+	}
+}
+
+func TestStartAddr(t *testing.T) {
+	obj := &xouttest.Object{Magic: binlib.XoutMagicNonSegX}
+	obj.Segs = []binlib.XoutSeg{
+		{Type: binlib.XoutSegDATA, Length: 2},
+		{Type: binlib.XoutSegCDMIX, Length: 4},
+	}
+	obj.Code = make([]byte, 6)
+	xf := obj.XoutFile()
+	if start := startAddr(xf, []uint32{0x0100, 0x1000}); start != 0x1000 {
+		t.Errorf("start %x of mixed code and data", start)
+	}
+	xf.SegTbl[1].Type = binlib.XoutSegCDMIX_P
+	if start := startAddr(xf, []uint32{0x0100, 0x2000}); start != 0x2000 {
+		t.Errorf("start %x of protectable mixed code and data", start)
+	}
+	xf.SegTbl[1].Type = binlib.XoutSegCONST
+	if start := startAddr(xf, []uint32{0x0100, 0x2000}); start != 0 {
+		t.Errorf("start %x without code", start)
+	}
+}
@@ -0,0 +1,409 @@
+/*
+ *  diff.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Structural comparison of two XOUT files
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"binlib"
+)
+
+var relocNames = map[byte]string{
+	binlib.XoutRelocOFF:  "OFF",
+	binlib.XoutRelocSSG:  "SSG",
+	binlib.XoutRelocLSG:  "LSG",
+	binlib.XoutRelocXOFF: "XOFF",
+	binlib.XoutRelocXSSG: "XSSG",
+	binlib.XoutRelocXLSG: "XLSG",
+}
+
+var symbTypeNames = map[byte]string{
+	binlib.XoutSymbLocal:   "local",
+	binlib.XoutSymbUndefEX: "extern",
+	binlib.XoutSymbGlobal:  "global",
+	binlib.XoutSymbSeg:     "segment",
+}
+
+func relocName(relocType byte) string {
+	if name, ok := relocNames[relocType]; ok {
+		return name
+	}
+	return fmt.Sprintf("type%d", relocType)
+}
+
+func symbTypeName(symbType byte) string {
+	if name, ok := symbTypeNames[symbType]; ok {
+		return name
+	}
+	return fmt.Sprintf("type%d", symbType)
+}
+
+type differ struct {
+	w     io.Writer
+	a, b  *binlib.XoutFile
+	count int // number of differences
+}
+
+/* Compare two files and write the differences, returns the number of them */
+func diff(w io.Writer, a, b *binlib.XoutFile) int {
+	d := &differ{w: w, a: a, b: b}
+	d.diffHeader()
+	d.diffSegs()
+	d.diffSymbs()
+	d.diffRelocs()
+	d.diffCode()
+	return d.count
+}
+
+func (d *differ) section(name string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	fmt.Fprintln(d.w, name)
+	for _, line := range lines {
+		fmt.Fprintln(d.w, " ", line)
+	}
+	d.count += len(lines)
+}
+
+func (d *differ) diffHeader() {
+	var lines []string
+	if d.a.Header.Magic != d.b.Header.Magic {
+		lines = append(lines, fmt.Sprintf("~ magic 0x%04x -> 0x%04x", d.a.Header.Magic, d.b.Header.Magic))
+	}
+	d.section("header", lines)
+}
+
+func segDesc(seg binlib.XoutSeg) string {
+	return fmt.Sprintf("No. %d %s 0x%04x", seg.Number, binlib.XoutSegName(seg.Type), seg.Length)
+}
+
+func (d *differ) diffSegs() {
+	var lines []string
+	for idx := 0; idx < len(d.a.SegTbl) || idx < len(d.b.SegTbl); idx++ {
+		switch {
+		case idx >= len(d.b.SegTbl):
+			lines = append(lines, fmt.Sprintf("- %d: %s", idx, segDesc(d.a.SegTbl[idx])))
+		case idx >= len(d.a.SegTbl):
+			lines = append(lines, fmt.Sprintf("+ %d: %s", idx, segDesc(d.b.SegTbl[idx])))
+		case d.a.SegTbl[idx] != d.b.SegTbl[idx]:
+			lines = append(lines, fmt.Sprintf("~ %d: %s -> %s", idx,
+				segDesc(d.a.SegTbl[idx]), segDesc(d.b.SegTbl[idx])))
+		}
+	}
+	d.section("segments", lines)
+}
+
+func symbPlace(symb binlib.XoutSymbEntry) string {
+	if symb.SegIdx == 0xff {
+		return fmt.Sprintf("abs 0x%04x", symb.Value)
+	}
+	return fmt.Sprintf("%d:0x%04x", symb.SegIdx, symb.Value)
+}
+
+/*
+ * Symbols keyed by name and type, the same local name can appear more than
+ * once, so the occurrence is counted.
+ */
+func symbKeys(xf *binlib.XoutFile) ([]string, map[string]binlib.XoutSymbEntry) {
+	var keys []string
+	symbs := make(map[string]binlib.XoutSymbEntry)
+	for _, symb := range xf.SymbTbl {
+		base := binlib.ConvertName(symb.Name) + " " + symbTypeName(symb.Type)
+		key := base
+		for n := 2; ; n++ {
+			if _, ok := symbs[key]; !ok {
+				break
+			}
+			key = fmt.Sprintf("%s #%d", base, n)
+		}
+		keys = append(keys, key)
+		symbs[key] = symb
+	}
+	return keys, symbs
+}
+
+func (d *differ) diffSymbs() {
+	var lines []string
+	keysA, symbsA := symbKeys(d.a)
+	keysB, symbsB := symbKeys(d.b)
+	for _, key := range keysA {
+		symbA := symbsA[key]
+		symbB, ok := symbsB[key]
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf("- %s %s", key, symbPlace(symbA)))
+		case symbA.SegIdx != symbB.SegIdx || symbA.Value != symbB.Value:
+			lines = append(lines, fmt.Sprintf("~ %s %s -> %s", key, symbPlace(symbA), symbPlace(symbB)))
+		}
+	}
+	for _, key := range keysB {
+		if _, ok := symbsA[key]; !ok {
+			lines = append(lines, fmt.Sprintf("+ %s %s", key, symbPlace(symbsB[key])))
+		}
+	}
+	d.section("symbols", lines)
+}
+
+/* Symbols defined in a segment, sorted by value, globals first at a value */
+func segSymbs(xf *binlib.XoutFile, seg int) []binlib.XoutSymbEntry {
+	var symbs []binlib.XoutSymbEntry
+	for _, symb := range xf.SymbTbl {
+		if int(symb.SegIdx) == seg &&
+			(symb.Type == binlib.XoutSymbLocal || symb.Type == binlib.XoutSymbGlobal) {
+			symbs = append(symbs, symb)
+		}
+	}
+	sort.SliceStable(symbs, func(i, j int) bool {
+		if symbs[i].Value != symbs[j].Value {
+			return symbs[i].Value < symbs[j].Value
+		}
+		return symbs[i].Type == binlib.XoutSymbGlobal && symbs[j].Type != binlib.XoutSymbGlobal
+	})
+	return symbs
+}
+
+/* The symbol a location belongs to, and the offset from it */
+func enclosing(symbs []binlib.XoutSymbEntry, loc uint16) (string, uint16) {
+	name, base := "", uint16(0)
+	for idx, symb := range symbs {
+		if symb.Value > loc {
+			break
+		}
+		if idx == 0 || symb.Value != symbs[idx-1].Value {
+			name, base = binlib.ConvertName(symb.Name), symb.Value
+		}
+	}
+	return name, loc - base
+}
+
+type relocDesc struct {
+	key  string // segment, type, target and enclosing symbol
+	off  uint16 // offset from the enclosing symbol
+	desc string
+}
+
+func relocDescs(xf *binlib.XoutFile) []relocDesc {
+	symbsBySeg := make([][]binlib.XoutSymbEntry, len(xf.SegTbl))
+	for idx := range xf.SegTbl {
+		symbsBySeg[idx] = segSymbs(xf, idx)
+	}
+	var descs []relocDesc
+	for _, reloc := range xf.RelocTbl {
+		var target string
+		switch reloc.Type {
+		case binlib.XoutRelocOFF, binlib.XoutRelocSSG, binlib.XoutRelocLSG:
+			target = fmt.Sprintf("segment %d", reloc.SymbIdx)
+		default:
+			if int(reloc.SymbIdx) < len(xf.SymbTbl) {
+				target = binlib.ConvertName(xf.SymbTbl[reloc.SymbIdx].Name)
+			} else {
+				target = fmt.Sprintf("symbol %d", reloc.SymbIdx)
+			}
+		}
+		var name string
+		var off uint16
+		if int(reloc.SegIdx) < len(symbsBySeg) {
+			name, off = enclosing(symbsBySeg[reloc.SegIdx], reloc.Location)
+		}
+		key := fmt.Sprintf("%d:%s %s %s", reloc.SegIdx, name, relocName(reloc.Type), target)
+		descs = append(descs, relocDesc{key, off, fmt.Sprintf("%d:%s+0x%04x %s %s",
+			reloc.SegIdx, name, off, relocName(reloc.Type), target)})
+	}
+	return descs
+}
+
+/*
+ * Relocations are matched in the order by the segment, the type, the target
+ * and the enclosing symbol. A matched pair at different offsets from the
+ * symbol has moved.
+ */
+func (d *differ) diffRelocs() {
+	var lines []string
+	descsA, descsB := relocDescs(d.a), relocDescs(d.b)
+	pending := make(map[string][]relocDesc)
+	for _, desc := range descsB {
+		pending[desc.key] = append(pending[desc.key], desc)
+	}
+	matched := make(map[string]int)
+	for _, descA := range descsA {
+		list := pending[descA.key]
+		if len(list) == 0 {
+			lines = append(lines, "- "+descA.desc)
+			continue
+		}
+		descB := list[0]
+		pending[descA.key] = list[1:]
+		matched[descA.key]++
+		if descA.off != descB.off {
+			lines = append(lines, fmt.Sprintf("~ %s moved to +0x%04x", descA.desc, descB.off))
+		}
+	}
+	for _, desc := range descsB {
+		if matched[desc.key] > 0 {
+			matched[desc.key]--
+			continue
+		}
+		lines = append(lines, "+ "+desc.desc)
+	}
+	d.section("relocations", lines)
+}
+
+type codeRange struct {
+	start, end int
+}
+
+/* Ranges of a segment from each symbol to the next, the first is unnamed */
+func symbRanges(xf *binlib.XoutFile, seg int) map[string]codeRange {
+	ranges := make(map[string]codeRange)
+	length := int(xf.SegTbl[seg].Length)
+	symbs := segSymbs(xf, seg)
+	var names []string
+	var starts []int
+	names, starts = append(names, ""), append(starts, 0)
+	for _, symb := range symbs {
+		start := int(symb.Value)
+		if start > length {
+			continue
+		}
+		if start == starts[len(starts)-1] {
+			if names[len(names)-1] == "" {
+				names[len(names)-1] = binlib.ConvertName(symb.Name)
+			}
+			continue
+		}
+		names, starts = append(names, binlib.ConvertName(symb.Name)), append(starts, start)
+	}
+	for idx, name := range names {
+		end := length
+		if idx+1 < len(starts) {
+			end = starts[idx+1]
+		}
+		if _, ok := ranges[name]; !ok {
+			ranges[name] = codeRange{starts[idx], end}
+		}
+	}
+	return ranges
+}
+
+/* Contents of a segment with the relocated bytes masked */
+func segContents(xf *binlib.XoutFile, seg int) ([]byte, []bool) {
+	pos, err := xf.SegPos(seg)
+	if err != nil || xf.CodePart == nil {
+		return nil, nil
+	}
+	data := xf.CodePart[pos : pos+int64(xf.SegTbl[seg].Length)]
+	mask := make([]bool, len(data))
+	for _, reloc := range xf.RelocTbl {
+		if int(reloc.SegIdx) != seg {
+			continue
+		}
+		size := 2
+		if reloc.Type == binlib.XoutRelocLSG || reloc.Type == binlib.XoutRelocXLSG {
+			size = 4
+		}
+		for idx := int(reloc.Location); idx < int(reloc.Location)+size && idx < len(mask); idx++ {
+			mask[idx] = true
+		}
+	}
+	return data, mask
+}
+
+func hexWords(data []byte) string {
+	var words []string
+	for idx := 0; idx < len(data); idx += 2 {
+		if idx+1 < len(data) {
+			words = append(words, fmt.Sprintf("%04x", binary.BigEndian.Uint16(data[idx:])))
+		} else {
+			words = append(words, fmt.Sprintf("%02x", data[idx]))
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+/*
+ * Code is compared by symbol ranges, so that a changed function does not
+ * shift the following ones. Relocated words are not compared, their
+ * targets are compared as relocations.
+ */
+func (d *differ) diffCode() {
+	var lines []string
+	for seg := 0; seg < len(d.a.SegTbl) && seg < len(d.b.SegTbl); seg++ {
+		segType := d.a.SegTbl[seg].Type
+		if segType != d.b.SegTbl[seg].Type || !binlib.XoutSegHasData(segType) {
+			continue
+		}
+		dataA, maskA := segContents(d.a, seg)
+		dataB, maskB := segContents(d.b, seg)
+		if dataA == nil || dataB == nil {
+			continue
+		}
+		rangesA, rangesB := symbRanges(d.a, seg), symbRanges(d.b, seg)
+		var names []string
+		for name := range rangesA {
+			if _, ok := rangesB[name]; ok {
+				names = append(names, name)
+			}
+		}
+		sort.Slice(names, func(i, j int) bool { return rangesA[names[i]].start < rangesA[names[j]].start })
+		for _, name := range names {
+			ra, rb := rangesA[name], rangesB[name]
+			if ra.end-ra.start != rb.end-rb.start {
+				lines = append(lines, fmt.Sprintf("~ %d:%s length 0x%04x -> 0x%04x",
+					seg, name, ra.end-ra.start, rb.end-rb.start))
+			}
+			length := ra.end - ra.start
+			if rb.end-rb.start < length {
+				length = rb.end - rb.start
+			}
+			// hunks of differing words
+			same := func(off int) bool {
+				n := length - off
+				if n > 2 {
+					n = 2
+				}
+				return sameBytes(dataA[ra.start+off:], maskA[ra.start+off:],
+					dataB[rb.start+off:], maskB[rb.start+off:], n)
+			}
+			for off := 0; off < length; {
+				if same(off) {
+					off += 2
+					continue
+				}
+				start := off
+				for off < length && !same(off) {
+					off += 2
+				}
+				end := off
+				if end > length {
+					end = length
+				}
+				lines = append(lines, fmt.Sprintf("~ %d:%s+0x%04x %s -> %s", seg, name, start,
+					hexWords(dataA[ra.start+start:ra.start+end]), hexWords(dataB[rb.start+start:rb.start+end])))
+			}
+		}
+	}
+	d.section("code", lines)
+}
+
+/* Whether n bytes are the same or relocated in either */
+func sameBytes(dataA []byte, maskA []bool, dataB []byte, maskB []bool, n int) bool {
+	for idx := 0; idx < n; idx++ {
+		if !maskA[idx] && !maskB[idx] && dataA[idx] != dataB[idx] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"binlib"
+	"binlib/xouttest"
+)
+
+func TestSame(t *testing.T) {
+	var buf bytes.Buffer
+	a := xouttest.Sample(binlib.XoutMagicNonSeg).XoutFile()
+	b := xouttest.Sample(binlib.XoutMagicNonSeg).XoutFile()
+	// relocated words are not compared
+	b.CodePart[0x06] = 0x55
+	if n := diff(&buf, a, b); n != 0 {
+		t.Errorf("%d differences\n%s", n, buf.String())
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := xouttest.Sample(binlib.XoutMagicNonSeg).XoutFile()
+	obj := xouttest.Sample(binlib.XoutMagicNonSeg)
+	obj.Code[0x1c] = 0x00                       // in _glob
+	obj.Relocs[1].Location = 0x08               // XOFF to _ext moved in loc
+	obj.Relocs = obj.Relocs[:len(obj.Relocs)-1] // XOFF in the protectable mix removed
+	obj.Symbs[4] = xouttest.Symb(0xff, binlib.XoutSymbLocal, 0x1234, "ABS2")
+	obj.Symbs[7].Value = 0x0004 // _gbss moved
+	b := obj.XoutFile()
+
+	var buf bytes.Buffer
+	n := diff(&buf, a, b)
+	want := `symbols
+  - ABS local abs 0x1234
+  ~ _gbss global 5:0x0000 -> 5:0x0004
+  + ABS2 local abs 0x1234
+relocations
+  ~ 0:loc+0x0002 XOFF _ext moved to +0x0004
+  - 4:+0x0000 XOFF loc
+code
+  ~ 0:_glob+0x000c bcbd -> 00bd
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+	if n != 6 {
+		t.Errorf("%d differences", n)
+	}
+}
@@ -0,0 +1,45 @@
+/*
+ *  xoutdiff.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Compare two XOUT files by segments, symbols, relocations and code
+ *  The exit status is 0 for the same files, 1 for different ones and 2 for
+ *  trouble, as diff.
+ */
+
+package main
+
+import (
+	"log"
+	"os"
+
+	"binlib"
+)
+
+func main() {
+	if len(os.Args) != 3 {
+		log.Println("Usage: xoutdiff old.rel new.rel")
+		os.Exit(2)
+	}
+	var files [2]*binlib.XoutFile
+	for idx, infpath := range os.Args[1:] {
+		infile, err := os.Open(infpath)
+		if err != nil {
+			log.Printf("can not open %s\n", infpath)
+			os.Exit(2)
+		}
+		files[idx] = &binlib.XoutFile{}
+		err = files[idx].Read(infile)
+		infile.Close()
+		if err != nil {
+			log.Printf("%s: %v\n", infpath, err)
+			os.Exit(2)
+		}
+	}
+	if diff(os.Stdout, files[0], files[1]) > 0 {
+		os.Exit(1)
+	}
+}
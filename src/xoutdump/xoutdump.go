@@ -6,72 +6,171 @@
  *  See LICENSE.
  *
  *  Dump a XOUT file information
+ *  Libraries are dumped member by member with their ar headers.
  */
 
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
 
 	"binlib"
 )
 
 func main() {
-	if len(os.Args) == 1 {
+	members := flag.String("m", "", "library members to dump, separated by commas")
+	flag.Parse()
+	if flag.NArg() == 0 {
 		log.Fatalln("No input file")
 	}
-	infpath := os.Args[1]
+	infpath := flag.Arg(0)
 	infile, err := os.Open(infpath)
 	if err != nil {
 		log.Fatalf("can not open %s\n", infpath)
 	}
 	defer infile.Close()
 
+	head := make([]byte, len(binlib.GnuArMagic))
+	n, _ := io.ReadFull(infile, head)
+	infile.Seek(0, io.SeekStart)
+	kind := binlib.Identify(head[:n])
+	if err = binlib.CheckKind(head[:n], binlib.KindXoutObject, binlib.KindXoutExec, binlib.KindXoutLib); err != nil {
+		log.Fatalf("%s: %v\n", infpath, err)
+	}
+	if kind == binlib.KindXoutLib {
+		var names []string
+		if *members != "" {
+			names = strings.Split(*members, ",")
+		}
+		if err = dumpLibrary(os.Stdout, infpath, infile, names); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if *members != "" {
+		log.Fatalf("%s is not a library\n", infpath)
+	}
+
 	xf := binlib.XoutFile{}
 	err = xf.Read(infile)
 	if err != nil {
 		fmt.Println(err)
 	}
-	fmt.Println()
-	fmt.Println("File =", os.Args[1])
-	fmt.Printf("  Magic = 0x%4x\n", xf.Header.Magic)
-	fmt.Printf("  nSegs = %d\n", xf.Header.NumSegs)
-	fmt.Printf("  SegInfo    FilePos = 0x%04x\n", binlib.XoutHdrLen)
-	fmt.Printf("  Code       FilePos = 0x%04x  Size = %d\n", xf.CodePos, xf.Header.CodePartLen)
-	fmt.Printf("  RelocTable FilePos = 0x%04x  Size = %d\n", xf.RelocTblPos, xf.Header.RelocsLen)
-	fmt.Printf("  SymbTable  FilePos = 0x%04x  Size = %d\n", xf.SymbTblPos, xf.Header.SymbsLen)
-	fmt.Println()
+	dump(os.Stdout, infpath, &xf)
+}
+
+func dump(w io.Writer, name string, xf *binlib.XoutFile) {
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "File =", name)
+	fmt.Fprintf(w, "  Magic = 0x%4x\n", xf.Header.Magic)
+	fmt.Fprintf(w, "  Model = %s\n", binlib.XoutModel(xf.Header.Magic))
+	fmt.Fprintf(w, "  nSegs = %d\n", xf.Header.NumSegs)
+	fmt.Fprintf(w, "  SegInfo    FilePos = 0x%04x\n", binlib.XoutHdrLen)
+	fmt.Fprintf(w, "  Code       FilePos = 0x%04x  Size = %d\n", xf.CodePos, xf.Header.CodePartLen)
+	fmt.Fprintf(w, "  RelocTable FilePos = 0x%04x  Size = %d\n", xf.RelocTblPos, xf.Header.RelocsLen)
+	fmt.Fprintf(w, "  SymbTable  FilePos = 0x%04x  Size = %d\n", xf.SymbTblPos, xf.Header.SymbsLen)
+	fmt.Fprintln(w)
 
-	printSegInfo(xf)
-	printRelocs(xf)
-	printSymbs(xf)
+	printSegInfo(w, xf)
+	printRelocs(w, xf)
+	printSymbs(w, xf)
+}
+
+/* Dump the members of a library, or the named ones */
+func dumpLibrary(w io.Writer, name string, r io.Reader, members []string) error {
+	ar, err := binlib.NewArReader(r)
+	if err != nil {
+		return err
+	}
+	selected := make(map[string]bool)
+	for _, member := range members {
+		selected[member] = false
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Library =", name)
+	for {
+		arhdr, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		member := binlib.ConvertArName(arhdr.Name)
+		if _, ok := selected[member]; len(members) > 0 && !ok {
+			continue
+		}
+		selected[member] = true
+		data, err := io.ReadAll(ar)
+		if err != nil {
+			return fmt.Errorf("%s: %v", member, err)
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Member =", member)
+		if date, ok := binlib.ArTime(arhdr.Date); ok {
+			fmt.Fprintf(w, "  Date = 0x%08x (%s)\n", arhdr.Date, date.Format("2006-01-02 15:04:05"))
+		} else {
+			fmt.Fprintf(w, "  Date = 0x%08x (none)\n", arhdr.Date)
+		}
+		fmt.Fprintf(w, "  UID = %d, GID = %d, Mode = 0%03o\n", arhdr.UID, arhdr.GID, arhdr.Mode)
+		fmt.Fprintf(w, "  Size = %d\n", arhdr.Size)
+		xf := binlib.XoutFile{}
+		if err = xf.Parse(data); err != nil {
+			fmt.Fprintln(w, " ", err)
+			continue
+		}
+		dump(w, name+"("+member+")", &xf)
+	}
+	for _, member := range members {
+		if !selected[member] {
+			return fmt.Errorf("%s: no member %s", name, member)
+		}
+	}
+	return nil
 }
 
-func printSegInfo(xf binlib.XoutFile) {
-	fmt.Println("Segment Info")
+/* Executables also show the linked addresses, and the spaces of split I/D */
+func printSegInfo(w io.Writer, xf *binlib.XoutFile) {
+	fmt.Fprintln(w, "Segment Info")
+	magic := xf.Header.Magic
+	bases := xf.DefaultBases()
 	for idx, seg := range xf.SegTbl {
-		fmt.Printf(" %4d : No. = %1d, Type = %d, Size = %5d\n",
+		fmt.Fprintf(w, " %4d : No. = %1d, Type = %d, Size = %5d",
 			idx, seg.Number, seg.Type, seg.Length)
+		if binlib.XoutExecutable(magic) {
+			fmt.Fprintf(w, ", Addr = 0x%06x", bases[idx])
+			if binlib.XoutSplitID(magic) {
+				space := "D"
+				if seg.Type == binlib.XoutSegCODE {
+					space = "I"
+				}
+				fmt.Fprintf(w, " (%s)", space)
+			}
+		}
+		fmt.Fprintln(w)
 	}
-	fmt.Println()
+	fmt.Fprintln(w)
 }
 
-func printRelocs(xf binlib.XoutFile) {
-	fmt.Println("Relocation items")
+func printRelocs(w io.Writer, xf *binlib.XoutFile) {
+	fmt.Fprintln(w, "Relocation items")
 	for idx, reloc := range xf.RelocTbl {
-		fmt.Printf(" %4d : Seg = %3d, Type = %1d, Offset = 0x%04x, Symb = %d\n",
+		fmt.Fprintf(w, " %4d : Seg = %3d, Type = %1d, Offset = 0x%04x, Symb = %d\n",
 			idx, reloc.SegIdx, reloc.Type, reloc.Location, reloc.SymbIdx)
 	}
-	fmt.Println()
+	fmt.Fprintln(w)
 }
 
-func printSymbs(xf binlib.XoutFile) {
-	fmt.Println("Symbol table")
+func printSymbs(w io.Writer, xf *binlib.XoutFile) {
+	fmt.Fprintln(w, "Symbol table")
 	for idx, symb := range xf.SymbTbl {
-		fmt.Printf(" %4d : Seg = %3d, Type = %1d,  Val = 0x%04x, Name = %-8s \n",
+		fmt.Fprintf(w, " %4d : Seg = %3d, Type = %1d,  Val = 0x%04x, Name = %-8s \n",
 			idx, symb.SegIdx, symb.Type, symb.Value, binlib.ConvertName(symb.Name))
 	}
-	fmt.Println()
+	fmt.Fprintln(w)
 }
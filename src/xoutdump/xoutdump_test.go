@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"binlib"
+	"binlib/xouttest"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+func TestDumpGolden(t *testing.T) {
+	tests := []struct {
+		golden string
+		magic  uint16
+	}{
+		{"sample.dump", binlib.XoutMagicNonSeg},
+		{"sample_seg.dump", binlib.XoutMagicSeg},
+		{"sample_split.dump", binlib.XoutMagicNonSegXSplit},
+		{"sample_shared.dump", binlib.XoutMagicNonSegShared},
+	}
+	for _, test := range tests {
+		t.Run(test.golden, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sample.rel")
+			if err := os.WriteFile(path, xouttest.Sample(test.magic).Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			var xf binlib.XoutFile
+			if err = xf.Read(file); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			dump(&buf, "sample.rel", &xf)
+
+			golden := filepath.Join("testdata", test.golden)
+			if *update {
+				if err = os.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != string(want) {
+				t.Errorf("dump differs\ngot:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestDumpLibrary(t *testing.T) {
+	members := xouttest.SampleMembers()
+	members = append(members, xouttest.Member{Name: "README", Mode: 0644,
+		Data: []byte("not XOUT")})
+	lib := xouttest.Library(members)
+	var buf bytes.Buffer
+	if err := dumpLibrary(&buf, "sample.a", bytes.NewReader(lib), nil); err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join("testdata", "sample_lib.dump")
+	if *update {
+		if err := os.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != string(want) {
+		t.Errorf("dump differs\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	buf.Reset()
+	if err := dumpLibrary(&buf, "sample.a", bytes.NewReader(lib), []string{"second.o"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); !strings.Contains(got, "Member = second.o") ||
+		strings.Contains(got, "Member = first.o") || !strings.Contains(got, "File = sample.a(second.o)") {
+		t.Errorf("selected dump\n%s", got)
+	}
+	if err := dumpLibrary(&buf, "sample.a", bytes.NewReader(lib), []string{"none.o"}); err == nil {
+		t.Error("missing member: no error")
+	}
+	if err := dumpLibrary(&buf, "sample.rel", bytes.NewReader(xouttest.Sample(binlib.XoutMagicNonSeg).Bytes()), nil); err == nil {
+		t.Error("not a library: no error")
+	}
+}
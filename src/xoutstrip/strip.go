@@ -0,0 +1,106 @@
+/*
+ *  strip.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Filtering and renaming symbols of XOUT files
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"binlib"
+)
+
+type options struct {
+	stripAll      bool              // remove all symbols
+	discardLocals bool              // remove local symbols
+	keep          map[string]bool   // globals to keep, nil keeps all
+	localize      map[string]bool   // globals made local
+	globalize     map[string]bool   // locals made global
+	rename        map[string]string // new names by old names
+}
+
+/*
+ * Filter and rename the symbols, and renumber the relocations referring
+ * them. Names in the options are the names in the input. Symbols referred
+ * by relocations are not removed, globals not kept are made local then.
+ */
+func strip(xf *binlib.XoutFile, opts *options) (*binlib.XoutFile, error) {
+	refs := make(map[int]bool)
+	for _, reloc := range xf.RelocTbl {
+		switch reloc.Type {
+		case binlib.XoutRelocXOFF, binlib.XoutRelocXSSG, binlib.XoutRelocXLSG:
+			if int(reloc.SymbIdx) >= len(xf.SymbTbl) {
+				return nil, fmt.Errorf("relocation at %d:%04x refers no symbol", reloc.SegIdx, reloc.Location)
+			}
+			refs[int(reloc.SymbIdx)] = true
+		}
+	}
+	if opts.stripAll && len(refs) > 0 {
+		return nil, fmt.Errorf("%d symbols are referred by relocations", len(refs))
+	}
+
+	nxf := *xf
+	nxf.SymbTbl = nil
+	newIdx := make(map[int]int)
+	globals := make(map[string]bool)
+	for idx, symb := range xf.SymbTbl {
+		if opts.stripAll {
+			break
+		}
+		name := binlib.ConvertName(symb.Name)
+		switch {
+		case opts.localize[name]:
+			if symb.Type == binlib.XoutSymbUndefEX {
+				return nil, fmt.Errorf("undefined symbol %s can not be local", name)
+			}
+			if symb.Type == binlib.XoutSymbGlobal {
+				symb.Type = binlib.XoutSymbLocal
+			}
+		case opts.globalize[name]:
+			if symb.Type == binlib.XoutSymbLocal {
+				symb.Type = binlib.XoutSymbGlobal
+			}
+		case opts.keep != nil && !opts.keep[name] && symb.Type == binlib.XoutSymbGlobal:
+			if !refs[idx] {
+				continue
+			}
+			symb.Type = binlib.XoutSymbLocal
+		}
+		if opts.discardLocals && !refs[idx] &&
+			(symb.Type == binlib.XoutSymbLocal || symb.Type == binlib.XoutSymbSeg) {
+			continue
+		}
+		if newName, ok := opts.rename[name]; ok {
+			if len(newName) > binlib.XoutNameLen {
+				return nil, fmt.Errorf("name %s longer than %d characters", newName, binlib.XoutNameLen)
+			}
+			symb.Name = [binlib.XoutNameLen]byte{}
+			copy(symb.Name[:], newName)
+			name = newName
+		}
+		if symb.Type == binlib.XoutSymbGlobal || symb.Type == binlib.XoutSymbUndefEX {
+			if globals[name] {
+				return nil, fmt.Errorf("duplicate global symbol %s", name)
+			}
+			globals[name] = true
+		}
+		newIdx[idx] = len(nxf.SymbTbl)
+		nxf.SymbTbl = append(nxf.SymbTbl, symb)
+	}
+
+	nxf.RelocTbl = append([]binlib.XoutRelocItem(nil), xf.RelocTbl...)
+	for idx, reloc := range nxf.RelocTbl {
+		switch reloc.Type {
+		case binlib.XoutRelocXOFF, binlib.XoutRelocXSSG, binlib.XoutRelocXLSG:
+			nxf.RelocTbl[idx].SymbIdx = uint16(newIdx[int(reloc.SymbIdx)])
+		}
+	}
+	nxf.Layout()
+	return &nxf, nil
+}
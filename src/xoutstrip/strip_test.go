@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"binlib"
+	"binlib/xouttest"
+)
+
+func names(xf *binlib.XoutFile) []string {
+	var names []string
+	for _, symb := range xf.SymbTbl {
+		names = append(names, binlib.ConvertName(symb.Name))
+	}
+	return names
+}
+
+func checkNames(t *testing.T, xf *binlib.XoutFile, want ...string) {
+	t.Helper()
+	got := names(xf)
+	if len(got) != len(want) {
+		t.Fatalf("symbols %q, want %q", got, want)
+	}
+	for idx := range want {
+		if got[idx] != want[idx] {
+			t.Fatalf("symbols %q, want %q", got, want)
+		}
+	}
+}
+
+/* Relocations refer the same names as before */
+func checkRelocs(t *testing.T, xf, nxf *binlib.XoutFile) {
+	t.Helper()
+	for idx, reloc := range xf.RelocTbl {
+		if reloc.Type < binlib.XoutRelocXOFF {
+			continue
+		}
+		name := binlib.ConvertName(xf.SymbTbl[reloc.SymbIdx].Name)
+		newName := binlib.ConvertName(nxf.SymbTbl[nxf.RelocTbl[idx].SymbIdx].Name)
+		if name != newName {
+			t.Errorf("relocation %d refers %s, want %s", idx, newName, name)
+		}
+	}
+}
+
+func TestDiscardLocals(t *testing.T) {
+	xf := xouttest.Sample(binlib.XoutMagicNonSeg).XoutFile()
+	nxf, err := strip(xf, &options{discardLocals: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first loc is referred by a relocation
+	checkNames(t, nxf, "loc", "_glob", "_gdata", "_gbss", "_ext", "_ext2", "_comm", "_comm2")
+	checkRelocs(t, xf, nxf)
+
+	data, err := nxf.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rxf binlib.XoutFile
+	if err = rxf.Parse(data); err != nil {
+		t.Fatal(err)
+	}
+	if rxf.Header.SymbsLen != 8*binlib.XoutSymbEntryLen || len(rxf.SymbTbl) != 8 {
+		t.Errorf("header %+v", rxf.Header)
+	}
+	if len(xf.SymbTbl) != 12 {
+		t.Error("input modified")
+	}
+}
+
+func TestKeep(t *testing.T) {
+	xf := xouttest.Sample(binlib.XoutMagicNonSeg).XoutFile()
+	nxf, err := strip(xf, &options{keep: map[string]bool{"_gdata": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// _glob is referred, so it is made local, _gbss is removed
+	checkNames(t, nxf, "__text", "__data", "loc", "loc", "ABS", "_glob", "_gdata",
+		"_ext", "_ext2", "_comm", "_comm2")
+	if nxf.SymbTbl[5].Type != binlib.XoutSymbLocal || nxf.SymbTbl[6].Type != binlib.XoutSymbGlobal {
+		t.Errorf("types %d %d", nxf.SymbTbl[5].Type, nxf.SymbTbl[6].Type)
+	}
+	checkRelocs(t, xf, nxf)
+}
+
+func TestLocalizeRename(t *testing.T) {
+	xf := xouttest.Sample(binlib.XoutMagicNonSeg).XoutFile()
+	nxf, err := strip(xf, &options{
+		localize:  map[string]bool{"_gdata": true},
+		globalize: map[string]bool{"ABS": true},
+		rename:    map[string]string{"_glob": "_main", "_ext": "_putchar"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNames(t, nxf, "__text", "__data", "loc", "loc", "ABS", "_main", "_gdata", "_gbss",
+		"_putchar", "_ext2", "_comm", "_comm2")
+	if nxf.SymbTbl[4].Type != binlib.XoutSymbGlobal || nxf.SymbTbl[6].Type != binlib.XoutSymbLocal {
+		t.Errorf("types %d %d", nxf.SymbTbl[4].Type, nxf.SymbTbl[6].Type)
+	}
+}
+
+func TestStripErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		opts options
+	}{
+		{"strip all with relocations", options{stripAll: true}},
+		{"localize undefined", options{localize: map[string]bool{"_ext": true}}},
+		{"long name", options{rename: map[string]string{"_glob": "_toolongname"}}},
+		{"duplicate", options{rename: map[string]string{"_gdata": "_glob"}}},
+	}
+	for _, test := range tests {
+		xf := xouttest.Sample(binlib.XoutMagicNonSeg).XoutFile()
+		if _, err := strip(xf, &test.opts); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+
+	// executables without symbol relocations can be stripped
+	xf := xouttest.Sample(binlib.XoutMagicNonSegX).XoutFile()
+	xf.RelocTbl = nil
+	nxf, err := strip(xf, &options{stripAll: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nxf.SymbTbl) != 0 || nxf.Header.SymbsLen != 0 {
+		t.Error("symbols not removed")
+	}
+}
+
+func TestOutPath(t *testing.T) {
+	dir := t.TempDir()
+	prog := filepath.Join(dir, "prog.z8k")
+	if err := os.WriteFile(prog, []byte{0}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.z8k")
+	if err := os.Symlink("prog.z8k", link); err != nil {
+		t.Fatal(err)
+	}
+	if path, perm, err := outPath(link, ""); err != nil || path != prog || perm != 0755 {
+		t.Errorf("in place %s %v %v", path, perm, err)
+	}
+	if path, perm, err := outPath(link, "out.z8k"); err != nil || path != "out.z8k" || perm != 0644 {
+		t.Errorf("output %s %v %v", path, perm, err)
+	}
+	if _, _, err := outPath(filepath.Join(dir, "none"), ""); err == nil {
+		t.Error("no error for a missing input")
+	}
+}
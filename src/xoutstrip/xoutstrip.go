@@ -0,0 +1,119 @@
+/*
+ *  xoutstrip.go
+ *
+ *  Copyright (c) 2020 4sun5bu
+ *  Released under the MIT license.
+ *  See LICENSE.
+ *
+ *  Strip, keep, localize, globalize and rename symbols of a XOUT file
+ */
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"binlib"
+)
+
+/* A flag of comma separated names, which can be repeated */
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, strings.Split(value, ",")...)
+	return nil
+}
+
+func (l listFlag) set() map[string]bool {
+	if l == nil {
+		return nil
+	}
+	names := make(map[string]bool)
+	for _, name := range l {
+		names[name] = true
+	}
+	return names
+}
+
+func main() {
+	var keep, localize, globalize, rename listFlag
+	stripAll := flag.Bool("s", false, "remove all symbols")
+	discard := flag.Bool("x", false, "remove local symbols")
+	flag.Var(&keep, "K", "keep only these global symbols")
+	flag.Var(&localize, "L", "make these global symbols local")
+	flag.Var(&globalize, "G", "make these local symbols global")
+	flag.Var(&rename, "rename", "rename symbols, old=new")
+	output := flag.String("o", "", "output file, the input file by default")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		log.Fatalln("No input file")
+	}
+
+	opts := options{
+		stripAll:      *stripAll,
+		discardLocals: *discard,
+		keep:          keep.set(),
+		localize:      localize.set(),
+		globalize:     globalize.set(),
+		rename:        make(map[string]string),
+	}
+	for _, pair := range rename {
+		names := strings.SplitN(pair, "=", 2)
+		if len(names) != 2 || names[1] == "" {
+			log.Fatalf("bad rename %s\n", pair)
+		}
+		opts.rename[names[0]] = names[1]
+	}
+
+	infpath := flag.Arg(0)
+	infile, err := os.Open(infpath)
+	if err != nil {
+		log.Fatalf("can not open %s\n", infpath)
+	}
+	xf := binlib.XoutFile{}
+	err = xf.Read(infile)
+	infile.Close()
+	if err != nil {
+		log.Fatalf("%s: %v\n", infpath, err)
+	}
+	nxf, err := strip(&xf, &opts)
+	if err != nil {
+		log.Fatalf("%s: %v\n", infpath, err)
+	}
+	data, err := nxf.Bytes()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	outfpath, perm, err := outPath(infpath, *output)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = binlib.WriteFile(outfpath, data, perm); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+/*
+ * The output file and its mode. The input is rewritten in place without
+ * output, the target of a symbolic link with the mode it has.
+ */
+func outPath(infpath, output string) (string, os.FileMode, error) {
+	if output != "" {
+		return output, 0644, nil
+	}
+	path, err := filepath.EvalSymlinks(infpath)
+	if err != nil {
+		return "", 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", 0, err
+	}
+	return path, info.Mode().Perm(), nil
+}